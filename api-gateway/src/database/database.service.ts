@@ -33,7 +33,7 @@ export class DatabaseService {
 
   async getMessage(id: string): Promise<any> {
     const query = `
-      SELECT idempotency_id, correlation_id, status, payload, created_at, updated_at
+      SELECT idempotency_id, correlation_id, status, version, payload, created_at, updated_at
       FROM messages
       WHERE idempotency_id = $1
     `;
@@ -48,6 +48,7 @@ export class DatabaseService {
       idempotency_id: row.idempotency_id,
       correlation_id: row.correlation_id,
       status: row.status,
+      version: Number(row.version),
       payload: typeof row.payload === 'string' ? JSON.parse(row.payload) : row.payload,
       created_at: row.created_at,
       updated_at: row.updated_at,
@@ -56,7 +57,7 @@ export class DatabaseService {
 
   async getMessageHistory(id: string): Promise<any[]> {
     const query = `
-      SELECT id, idempotency_id, correlation_id, status, service_name, event_id, error_message, created_at
+      SELECT id, idempotency_id, correlation_id, status, service_name, event_id, error_message, from_status, accepted, action, created_at
       FROM message_history
       WHERE idempotency_id = $1
       ORDER BY created_at ASC
@@ -71,6 +72,9 @@ export class DatabaseService {
       service_name: row.service_name,
       event_id: row.event_id,
       error_message: row.error_message,
+      from_status: row.from_status,
+      accepted: row.accepted,
+      action: row.action,
       created_at: row.created_at,
     }));
   }
@@ -1,8 +1,18 @@
 import { NestFactory } from '@nestjs/core';
 import { ValidationPipe } from '@nestjs/common';
 import { AppModule } from './app.module';
+import { setupTracing } from './tracing';
 
 async function bootstrap() {
+  const tracerProvider = setupTracing('api-gateway');
+  if (tracerProvider) {
+    // Flush pending spans before exiting
+    process.once('SIGTERM', async () => {
+      await tracerProvider.shutdown();
+      process.exit(0);
+    });
+  }
+
   const app = await NestFactory.create(AppModule);
   
   app.useGlobalPipes(
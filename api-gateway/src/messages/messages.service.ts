@@ -1,8 +1,10 @@
 import { Injectable, Logger } from '@nestjs/common';
+import { SpanStatusCode } from '@opentelemetry/api';
 import { v4 as uuidv4 } from 'uuid';
 import { CreateMessageDto } from './dto/create-message.dto';
 import { MessagingService } from '../messaging/messaging.service';
 import { DatabaseService } from '../database/database.service';
+import { tracer } from '../tracing';
 
 @Injectable()
 export class MessagesService {
@@ -47,15 +49,31 @@ export class MessagesService {
       payload,
     };
 
-    // Store in database
-    await this.databaseService.createMessage(
-      idempotencyId,
-      correlationId,
-      payload,
-    );
+    // Root span of the request: the trace continues in the Go services
+    // through the trace context headers of the published event
+    await tracer.startActiveSpan(
+      'messages.create',
+      { attributes: { correlation_id: correlationId, idempotency_id: idempotencyId } },
+      async (span) => {
+        try {
+          // Store in database
+          await this.databaseService.createMessage(
+            idempotencyId,
+            correlationId,
+            payload,
+          );
 
-    // Publish event
-    await this.messagingService.publish('message.created', event);
+          // Publish event
+          await this.messagingService.publish('message.created', event);
+        } catch (error) {
+          span.recordException(error);
+          span.setStatus({ code: SpanStatusCode.ERROR, message: error.message });
+          throw error;
+        } finally {
+          span.end();
+        }
+      },
+    );
 
     this.logger.log(
       JSON.stringify({
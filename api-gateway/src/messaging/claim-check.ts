@@ -0,0 +1,153 @@
+import { ConfigService } from '@nestjs/config';
+import { createHash, randomBytes } from 'crypto';
+import { promises as fs } from 'fs';
+import * as path from 'path';
+import { Pool } from 'pg';
+
+// Only payload key of an event whose payload was offloaded, as in
+// shared/messaging/claimcheck.go
+export const CLAIM_CHECK_PAYLOAD_KEY = '_claim_check';
+
+const EXPIRES_SUFFIX = '.expires';
+
+interface ClaimCheckStore {
+  put(data: Buffer, ttlMs: number): Promise<string>;
+}
+
+// Same layout as the Go FileStore: the blob file plus a sidecar holding its
+// expiry as a unix timestamp, both written atomically, expiry first
+class FileStore implements ClaimCheckStore {
+  constructor(private readonly dir: string) {}
+
+  async put(data: Buffer, ttlMs: number): Promise<string> {
+    await fs.mkdir(this.dir, { recursive: true });
+    const ref = newRef();
+    const expiresAt = Math.floor((Date.now() + ttlMs) / 1000).toString();
+
+    await this.writeAtomic(path.join(this.dir, ref + EXPIRES_SUFFIX), Buffer.from(expiresAt));
+    await this.writeAtomic(path.join(this.dir, ref), data);
+    return ref;
+  }
+
+  private async writeAtomic(file: string, data: Buffer): Promise<void> {
+    const tmp = path.join(this.dir, `.tmp-${randomBytes(8).toString('hex')}`);
+    try {
+      await fs.writeFile(tmp, data);
+      await fs.rename(tmp, file);
+    } finally {
+      await fs.rm(tmp, { force: true });
+    }
+  }
+}
+
+// Same table as the Go PostgresStore: blobs are large objects referenced
+// from claim_check_blobs
+class PostgresStore implements ClaimCheckStore {
+  constructor(private readonly pool: Pool) {}
+
+  async put(data: Buffer, ttlMs: number): Promise<string> {
+    const ref = newRef();
+    await this.pool.query(
+      `INSERT INTO claim_check_blobs (ref, blob_oid, size_bytes, created_at, expires_at)
+       VALUES ($1, lo_from_bytea(0, $2), $3, NOW(), $4)`,
+      [ref, data, data.length, new Date(Date.now() + ttlMs)],
+    );
+    return ref;
+  }
+}
+
+function newRef(): string {
+  return randomBytes(16).toString('hex');
+}
+
+// Parses the Go durations used by CLAIM_CHECK_TTL, such as "168h" or "1h30m"
+export function parseDuration(value: string): number | null {
+  const units: Record<string, number> = { ms: 1, s: 1000, m: 60_000, h: 3_600_000 };
+  const pattern = /(\d+(?:\.\d+)?)(ms|h|m|s)/g;
+  let total = 0;
+  let consumed = 0;
+  for (const match of value.matchAll(pattern)) {
+    if (match.index !== consumed) {
+      return null;
+    }
+    total += parseFloat(match[1]) * units[match[2]];
+    consumed += match[0].length;
+  }
+  return consumed === value.length && total > 0 ? total : null;
+}
+
+// Offloads payloads larger than CLAIM_CHECK_THRESHOLD_BYTES to the store
+// shared with the Go services (CLAIM_CHECK_STORE), which rehydrate them on
+// consume. Expired blobs are collected by the Go services
+export class ClaimCheck {
+  private constructor(
+    private readonly store: ClaimCheckStore,
+    private readonly threshold: number,
+    private readonly ttlMs: number,
+  ) {}
+
+  // Returns null when the claim check is disabled
+  static fromConfig(config: ConfigService): ClaimCheck | null {
+    const storeType = config.get<string>('CLAIM_CHECK_STORE', '');
+    if (!storeType) {
+      return null;
+    }
+
+    const thresholdValue = config.get<string>('CLAIM_CHECK_THRESHOLD_BYTES', '262144');
+    const threshold = Number(thresholdValue);
+    if (!Number.isInteger(threshold) || threshold <= 0) {
+      throw new Error(`Invalid CLAIM_CHECK_THRESHOLD_BYTES: ${thresholdValue}`);
+    }
+    const ttlValue = config.get<string>('CLAIM_CHECK_TTL', '168h');
+    const ttlMs = parseDuration(ttlValue);
+    if (ttlMs === null) {
+      throw new Error(`Invalid CLAIM_CHECK_TTL: ${ttlValue}`);
+    }
+
+    switch (storeType) {
+      case 'fs':
+        return new ClaimCheck(
+          new FileStore(config.get<string>('CLAIM_CHECK_DIR', '/var/lib/claim-check')),
+          threshold,
+          ttlMs,
+        );
+      case 'postgres':
+        return new ClaimCheck(
+          new PostgresStore(
+            new Pool({
+              host: config.get<string>('DB_HOST', 'localhost'),
+              port: config.get<number>('DB_PORT', 5432),
+              user: config.get<string>('DB_USER', 'postgres'),
+              password: config.get<string>('DB_PASSWORD', 'postgres'),
+              database: config.get<string>('DB_NAME', 'queue_case'),
+            }),
+          ),
+          threshold,
+          ttlMs,
+        );
+      default:
+        throw new Error(`Unsupported claim check store: ${storeType} (supported: fs, postgres)`);
+    }
+  }
+
+  // Returns the event to publish: event itself when its payload is small
+  // enough, otherwise a copy whose payload only references the blob
+  async offload<T extends { payload: any }>(event: T): Promise<T> {
+    const payload = Buffer.from(JSON.stringify(event.payload));
+    if (payload.length <= this.threshold) {
+      return event;
+    }
+
+    const ref = await this.store.put(payload, this.ttlMs);
+    return {
+      ...event,
+      payload: {
+        [CLAIM_CHECK_PAYLOAD_KEY]: {
+          ref,
+          size: payload.length,
+          sha256: createHash('sha256').update(payload).digest('hex'),
+        },
+      },
+    };
+  }
+}
@@ -2,6 +2,10 @@ import { Injectable, Logger, OnModuleDestroy } from '@nestjs/common';
 import { ConfigService } from '@nestjs/config';
 import * as KafkaJS from 'kafkajs';
 import * as amqp from 'amqplib';
+import { createHmac } from 'crypto';
+import { SpanKind, SpanStatusCode } from '@opentelemetry/api';
+import { tracer, traceHeaders } from '../tracing';
+import { ClaimCheck } from './claim-check';
 
 @Injectable()
 export class MessagingService implements OnModuleDestroy {
@@ -10,13 +14,63 @@ export class MessagingService implements OnModuleDestroy {
   private kafkaClient: KafkaJS.Kafka | null = null;
   private rabbitMQChannel: amqp.Channel | null = null;
   private rabbitMQConnection: amqp.Connection | null = null;
+  // Topics whose queue, exchange and binding were declared on the channel
+  private rabbitMQTopics = new Set<string>();
   private brokerType: string;
+  private signingKeyId: string | null = null;
+  private signingKey: string | null = null;
+  private claimCheck: ClaimCheck | null;
 
   constructor(private configService: ConfigService) {
     this.brokerType = this.configService.get<string>('MESSAGE_BROKER', 'kafka');
+    this.loadSigningKey();
+    this.claimCheck = ClaimCheck.fromConfig(this.configService);
     this.initializeBroker();
   }
 
+  // Same format as the Go services: EVENT_SIGNING_KEYS="key-id:secret,..."
+  // and EVENT_SIGNING_KEY_ID selecting the active key (defaults to the first)
+  private loadSigningKey() {
+    const spec = this.configService.get<string>('EVENT_SIGNING_KEYS', '');
+    if (!spec) {
+      return;
+    }
+
+    const keys = new Map<string, string>();
+    for (const entry of spec.split(',')) {
+      // Trimmed as a whole, like the Go services, so a secret read from an
+      // env file or a mounted Secret keeps no trailing newline
+      const pair = entry.trim();
+      const separator = pair.indexOf(':');
+      if (separator <= 0 || separator === pair.length - 1) {
+        throw new Error(`Invalid EVENT_SIGNING_KEYS entry: ${entry}`);
+      }
+      keys.set(pair.slice(0, separator), pair.slice(separator + 1));
+    }
+
+    const activeKeyId = this.configService.get<string>(
+      'EVENT_SIGNING_KEY_ID',
+      keys.keys().next().value,
+    );
+    if (!keys.has(activeKeyId)) {
+      throw new Error(`Active signing key ${activeKeyId} not found in EVENT_SIGNING_KEYS`);
+    }
+
+    this.signingKeyId = activeKeyId;
+    this.signingKey = keys.get(activeKeyId);
+  }
+
+  private signatureHeaders(body: string): Record<string, string> {
+    if (!this.signingKeyId || !this.signingKey) {
+      return {};
+    }
+
+    return {
+      signature_key_id: this.signingKeyId,
+      signature: createHmac('sha256', this.signingKey).update(body).digest('hex'),
+    };
+  }
+
   private async initializeBroker() {
     if (this.brokerType === 'kafka' || this.brokerType === '') {
       await this.initializeKafka();
@@ -54,11 +108,44 @@ export class MessagingService implements OnModuleDestroy {
   }
 
   async publish(topic: string, event: any): Promise<void> {
-    if (this.brokerType === 'kafka' || this.brokerType === '') {
-      await this.publishToKafka(topic, event);
-    } else {
-      await this.publishToRabbitMQ(topic, event);
-    }
+    const system = this.brokerType === 'kafka' || this.brokerType === '' ? 'kafka' : 'rabbitmq';
+
+    // Producer span; its context is injected into the message headers so
+    // the Go consumers continue the same trace
+    await tracer.startActiveSpan(
+      `publish ${topic}`,
+      {
+        kind: SpanKind.PRODUCER,
+        attributes: {
+          'messaging.system': system,
+          'messaging.destination.name': topic,
+          'messaging.message.id': event.event_id,
+          'event.type': event.event_type,
+          correlation_id: event.correlation_id,
+          idempotency_id: event.idempotency_id,
+        },
+      },
+      async (span) => {
+        try {
+          // Oversized payloads travel as a claim check reference, which the
+          // Go consumers rehydrate
+          if (this.claimCheck) {
+            event = await this.claimCheck.offload(event);
+          }
+          if (system === 'kafka') {
+            await this.publishToKafka(topic, event);
+          } else {
+            await this.publishToRabbitMQ(topic, event);
+          }
+        } catch (error) {
+          span.recordException(error);
+          span.setStatus({ code: SpanStatusCode.ERROR, message: error.message });
+          throw error;
+        } finally {
+          span.end();
+        }
+      },
+    );
   }
 
   private async publishToKafka(topic: string, event: any): Promise<void> {
@@ -66,16 +153,20 @@ export class MessagingService implements OnModuleDestroy {
       throw new Error('Kafka producer not initialized');
     }
 
+    const body = JSON.stringify(event);
+
     await this.kafkaProducer.send({
       topic,
       messages: [
         {
           key: event.idempotency_id,
-          value: JSON.stringify(event),
+          value: body,
           headers: {
             correlation_id: event.correlation_id,
             idempotency_id: event.idempotency_id,
             event_type: event.event_type,
+            ...traceHeaders(),
+            ...this.signatureHeaders(body),
           },
         },
       ],
@@ -98,11 +189,21 @@ export class MessagingService implements OnModuleDestroy {
       throw new Error('RabbitMQ channel not initialized');
     }
 
-    await this.rabbitMQChannel.assertQueue(queue, { durable: true });
+    // Published through the fanout exchange named after the queue, like the
+    // Go services, so broadcast subscribers receive the event too
+    if (!this.rabbitMQTopics.has(queue)) {
+      await this.rabbitMQChannel.assertQueue(queue, { durable: true });
+      await this.rabbitMQChannel.assertExchange(queue, 'fanout', { durable: true });
+      await this.rabbitMQChannel.bindQueue(queue, queue, '');
+      this.rabbitMQTopics.add(queue);
+    }
+
+    const body = JSON.stringify(event);
 
-    await this.rabbitMQChannel.sendToQueue(
+    await this.rabbitMQChannel.publish(
+      queue,
       queue,
-      Buffer.from(JSON.stringify(event)),
+      Buffer.from(body),
       {
         persistent: true,
         messageId: event.event_id,
@@ -111,6 +212,8 @@ export class MessagingService implements OnModuleDestroy {
           correlation_id: event.correlation_id,
           idempotency_id: event.idempotency_id,
           event_type: event.event_type,
+          ...traceHeaders(),
+          ...this.signatureHeaders(body),
         },
       },
     );
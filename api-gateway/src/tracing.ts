@@ -0,0 +1,61 @@
+import { context, propagation, trace } from '@opentelemetry/api';
+import {
+  CompositePropagator,
+  W3CBaggagePropagator,
+  W3CTraceContextPropagator,
+} from '@opentelemetry/core';
+import { OTLPTraceExporter } from '@opentelemetry/exporter-trace-otlp-http';
+import { Resource } from '@opentelemetry/resources';
+import {
+  BatchSpanProcessor,
+  ConsoleSpanExporter,
+  SpanExporter,
+} from '@opentelemetry/sdk-trace-base';
+import { NodeTracerProvider } from '@opentelemetry/sdk-trace-node';
+import { SEMRESATTRS_SERVICE_NAME } from '@opentelemetry/semantic-conventions';
+
+export const tracer = trace.getTracer('api-gateway');
+
+// Same variables as the Go services: OTEL_TRACES_EXPORTER selects none
+// (default), otlp or stdout; the OTLP exporter reads the standard
+// OTEL_EXPORTER_OTLP_* variables. Returns null when exporting is disabled
+export function setupTracing(serviceName: string): NodeTracerProvider | null {
+  const propagator = new CompositePropagator({
+    propagators: [new W3CTraceContextPropagator(), new W3CBaggagePropagator()],
+  });
+
+  let exporter: SpanExporter;
+  switch (process.env.OTEL_TRACES_EXPORTER || 'none') {
+    case 'none':
+      propagation.setGlobalPropagator(propagator);
+      return null;
+    case 'otlp':
+      exporter = new OTLPTraceExporter();
+      break;
+    case 'stdout':
+    case 'console':
+      exporter = new ConsoleSpanExporter();
+      break;
+    default:
+      throw new Error(
+        `Unsupported traces exporter: ${process.env.OTEL_TRACES_EXPORTER} (supported: none, otlp, stdout)`,
+      );
+  }
+
+  const provider = new NodeTracerProvider({
+    resource: new Resource({
+      [SEMRESATTRS_SERVICE_NAME]: process.env.OTEL_SERVICE_NAME || serviceName,
+    }),
+  });
+  provider.addSpanProcessor(new BatchSpanProcessor(exporter));
+  provider.register({ propagator });
+
+  return provider;
+}
+
+// W3C trace context headers (traceparent, tracestate) of the active span
+export function traceHeaders(): Record<string, string> {
+  const headers: Record<string, string> = {};
+  propagation.inject(context.active(), headers);
+  return headers;
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/messaging"
+	"queue-microservice-case/shared/simulation"
+)
+
+// Reason codes of failed messages, published in message.status.updated and
+// in the DLQ record
+const (
+	reasonInvalidPayload        = "invalid_payload"
+	reasonProcessingError       = "processing_error"
+	reasonTimeout               = "timeout"
+	reasonDependencyUnavailable = "dependency_unavailable"
+	reasonRetriesExhausted      = "retries_exhausted"
+)
+
+// permanentError marks a processing error that retrying cannot fix
+type permanentError struct {
+	reason string
+	err    error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks err as permanent, with the given reason code
+func permanent(reason string, err error) error {
+	return &permanentError{reason: reason, err: err}
+}
+
+// failure is the classification of a processing error
+type failure struct {
+	reason    string
+	permanent bool
+}
+
+// classifyFailure tells permanent failures (invalid payloads, errors marked
+// with permanent) from transient ones (timeouts, database or broker
+// unavailable), which are retried
+func classifyFailure(err error) failure {
+	var permanentErr *permanentError
+	switch {
+	case errors.As(err, &permanentErr):
+		return failure{reason: permanentErr.reason, permanent: true}
+	case contracts.ValidationField(err) != "":
+		return failure{reason: reasonInvalidPayload, permanent: true}
+	case errors.Is(err, simulation.ErrPermanentFailure):
+		return failure{reason: reasonProcessingError, permanent: true}
+	case errors.Is(err, simulation.ErrTransientFailure):
+		return failure{reason: reasonProcessingError}
+	case errors.Is(err, context.DeadlineExceeded):
+		return failure{reason: reasonTimeout}
+	default:
+		return failure{reason: reasonDependencyUnavailable}
+	}
+}
+
+// handleFailure records a processing error of a claimed message. Transient
+// failures leave the message processing and acknowledge the event: the
+// reconciler owns the retry and republishes it once the lease expires, so
+// the broker neither dead-letters nor redelivers it. Permanent failures move
+// it to failed, publish the failed status and send the event to the DLQ
+func handleFailure(ctx context.Context, store database.MessageStore, broker messaging.MessageBroker, appLogger *logger.Logger, event *contracts.Event, msg *database.Message, err error) error {
+	f := classifyFailure(err)
+	if !f.permanent {
+		appLogger.Warn(ctx, "Processing failed, message left for the reconciler to retry", "reason_code", f.reason, "error", err.Error())
+		return nil
+	}
+
+	errorMsg := fmt.Sprintf("%s: %v", f.reason, err)
+	_, casErr := store.CompareAndSwapStatus(
+		ctx,
+		event.IdempotencyID,
+		event.CorrelationID,
+		msg.Version,
+		database.StatusFailed,
+		serviceName,
+		event.EventID,
+		&errorMsg,
+	)
+	if isStaleTransition(casErr) {
+		appLogger.Warn(ctx, "Message status changed concurrently, skipping", "error", casErr.Error())
+		return nil
+	}
+	if casErr != nil {
+		appLogger.Error(ctx, "Failed to update message status", casErr)
+		return fmt.Errorf("failed to update status: %w", casErr)
+	}
+
+	appLogger.Error(ctx, "Message processing failed permanently", err, "reason_code", f.reason)
+	return publishFailure(ctx, broker, event, f.reason, err, msg.ReconcileAttempts)
+}
+
+// publishFailure announces a failed message with its reason code and
+// dead-letters its event
+func publishFailure(ctx context.Context, broker messaging.MessageBroker, event *contracts.Event, reason string, err error, retryCount int) error {
+	statusEvent := contracts.NewEvent(
+		contracts.EventTypeMessageStatusUpdated,
+		event.CorrelationID,
+		event.IdempotencyID,
+		serviceName,
+		map[string]interface{}{
+			"idempotency_id": event.IdempotencyID,
+			"status":         database.StatusFailed,
+			"reason_code":    reason,
+			"failed_at":      time.Now().UTC().Format(time.RFC3339),
+		},
+	)
+	if err := broker.Publish(ctx, topicOut, statusEvent); err != nil {
+		return fmt.Errorf("failed to publish failed status: %w", err)
+	}
+
+	dlqEvent := messaging.NewDLQEvent(event, err, retryCount)
+	dlqEvent.ReasonCode = reason
+	dlqEvent.Service = serviceName
+	if err := broker.PublishToDLQ(ctx, topicIn, dlqEvent); err != nil {
+		return fmt.Errorf("failed to dead-letter failed event: %w", err)
+	}
+	return nil
+}
@@ -3,14 +3,26 @@ module queue-microservice-case/message-processor
 go 1.21
 
 require (
+	queue-microservice-case/shared/claimcheck v0.0.0
 	queue-microservice-case/shared/contracts v0.0.0
 	queue-microservice-case/shared/database v0.0.0
+	queue-microservice-case/shared/health v0.0.0
 	queue-microservice-case/shared/logger v0.0.0
 	queue-microservice-case/shared/messaging v0.0.0
+	queue-microservice-case/shared/metrics v0.0.0
+	queue-microservice-case/shared/redact v0.0.0
+	queue-microservice-case/shared/simulation v0.0.0
+	queue-microservice-case/shared/tracing v0.0.0
 )
 
+replace queue-microservice-case/shared/claimcheck => ../shared/claimcheck
 replace queue-microservice-case/shared/contracts => ../shared/contracts
 replace queue-microservice-case/shared/database => ../shared/database
+replace queue-microservice-case/shared/health => ../shared/health
 replace queue-microservice-case/shared/logger => ../shared/logger
 replace queue-microservice-case/shared/messaging => ../shared/messaging
+replace queue-microservice-case/shared/metrics => ../shared/metrics
+replace queue-microservice-case/shared/redact => ../shared/redact
+replace queue-microservice-case/shared/simulation => ../shared/simulation
+replace queue-microservice-case/shared/tracing => ../shared/tracing
 
@@ -2,18 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"queue-microservice-case/shared/claimcheck"
 	"queue-microservice-case/shared/contracts"
 	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/health"
 	"queue-microservice-case/shared/logger"
 	"queue-microservice-case/shared/messaging"
+	"queue-microservice-case/shared/metrics"
+	"queue-microservice-case/shared/redact"
+	"queue-microservice-case/shared/simulation"
+	"queue-microservice-case/shared/tracing"
 )
 
 const (
@@ -23,117 +31,337 @@ const (
 )
 
 func main() {
-	// Initialize logger
-	appLogger := logger.NewLogger(serviceName)
+	// Initialize logger; std log output goes through it too
+	appLogger, err := logger.NewLogger(serviceName)
+	if err != nil {
+		log.Fatalf("Failed to configure logger: %v", err)
+	}
+	appLogger.SetDefault()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Get database connection string
 	dbConnStr := getDatabaseConnectionString()
-	repo, err := database.NewRepository(dbConnStr)
+	repo, err := database.NewRepository(dbConnStr,
+		database.WithQueryTimeout(getDurationEnv("DB_QUERY_TIMEOUT", database.DefaultQueryTimeout)))
 	if err != nil {
-		appLogger.Error("Failed to connect to database", "", "", err, nil)
-		log.Fatalf("Failed to connect to database: %v", err)
+		appLogger.Fatal(ctx, "Failed to connect to database", err)
 	}
 	defer repo.Close()
 
+	// "migrate" subcommand: manage the schema and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.RunMigrateCommand(ctx, repo, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Migration failed", err)
+		}
+		return
+	}
+
+	// Apply pending migrations; replicas serialize on an advisory lock
+	if getBoolEnv("DB_MIGRATE_ON_STARTUP", true) {
+		applied, err := repo.Migrate(ctx)
+		if err != nil {
+			appLogger.Fatal(ctx, "Failed to apply database migrations", err)
+		}
+		for _, migration := range applied {
+			appLogger.Info(ctx, "Applied database migration", "version", migration.Version, "name", migration.Name)
+		}
+	}
+
+	// Export spans and propagate W3C trace context through the broker
+	shutdownTracing, err := tracing.Setup(ctx, tracing.ConfigFromEnv(serviceName))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to set up tracing", err)
+	}
+
+	// PII redaction rules applied to DLQ records (the logger loads the same
+	// rules on its own)
+	redactor, err := redact.FromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load redaction rules", err)
+	}
+
+	// Load event signing keys and per-topic verification policy
+	signingKeys, err := messaging.KeyRingFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signing keys", err)
+	}
+	signaturePolicy, err := messaging.SignaturePolicyFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signature policy", err)
+	}
+
+	// Claim check store for payloads too large for the broker
+	claimCheckConfig, err := claimcheck.ConfigFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load claim check configuration", err)
+	}
+	claimCheckStore, err := claimcheck.Open(claimCheckConfig, dbConnStr)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to open claim check store", err)
+	}
+
 	// Initialize message broker
-	broker, err := messaging.NewMessageBroker()
+	broker, err := messaging.NewMessageBroker(
+		messaging.WithKeyRing(signingKeys),
+		messaging.WithClaimCheck(claimCheckStore, claimCheckConfig.Threshold, claimCheckConfig.TTL),
+		messaging.WithRedactor(redactor),
+	)
 	if err != nil {
-		appLogger.Error("Failed to initialize message broker", "", "", err, nil)
-		log.Fatalf("Failed to initialize message broker: %v", err)
+		appLogger.Fatal(ctx, "Failed to initialize message broker", err)
 	}
 	defer broker.Close()
 
+	if claimCheckStore != nil {
+		go claimcheck.RunCollector(ctx, claimCheckStore, claimCheckConfig.GCInterval)
+	}
+
+	// Recover messages stuck in pending or processing
+	if reconciler := reconcilerConfigFromEnv(); reconciler.interval > 0 {
+		go runReconciler(ctx, repo, broker, reconciler, appLogger)
+	}
+
+	// Simulated workload of the processing (latency, failures, CPU work)
+	workloadProfile, err := simulation.ProfileFromEnv(serviceName, simulation.ConstantProfile(300*time.Millisecond))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load simulation profile", err)
+	}
+	workload, err := simulation.New(workloadProfile)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to create workload simulator", err)
+	}
+	registerProcessor(20, Selector{EventType: contracts.EventTypeMessageCreated}, &simulatedWork{name: "execute", simulator: workload})
+	appLogger.Info(ctx, "Workload simulation profile loaded",
+		"distribution", workloadProfile.Latency.Distribution,
+		"transient_failure_rate", workloadProfile.TransientFailureRate,
+		"permanent_failure_rate", workloadProfile.PermanentFailureRate,
+		"cpu_iterations", workloadProfile.CPUIterations,
+		"seed", workloadProfile.Seed,
+	)
+
+	// Each replica claims the messages it processes under its own lease
+	hostname, _ := os.Hostname()
+	lease := processingLease{
+		owner: getEnv("WORKER_ID", hostname),
+		ttl:   getDurationEnv("PROCESSING_LEASE_TTL", 30*time.Second),
+	}
+
 	// Subscribe to message.created events
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	handler := messaging.Chain(
+		createMessageHandler(repo, broker, lease, appLogger),
+		messaging.VerifySignatures(signingKeys, signaturePolicy, broker),
+		messaging.RecordTimings(messaging.StoreTimings(repo, serviceName)),
+	)
 
-	err = broker.Subscribe(ctx, topicIn, createMessageHandler(repo, broker, appLogger))
+	subscription, err := broker.Subscribe(ctx, topicIn, handler)
 	if err != nil {
-		appLogger.Error("Failed to subscribe to topic", "", "", err, nil)
-		log.Fatalf("Failed to subscribe: %v", err)
+		appLogger.Fatal(ctx, "Failed to subscribe to topic", err)
 	}
 
-	appLogger.Info("Message processor started", "", "", map[string]interface{}{
-		"topic_in":  topicIn,
-		"topic_out": topicOut,
-	})
+	// Expose liveness and readiness probes
+	healthChecks := health.New()
+	healthChecks.AddLivenessCheck(health.Heartbeat("consumer", subscription, getDurationEnv("HEALTH_MAX_HANDLER_DURATION", 2*time.Minute)))
+	healthChecks.AddReadinessCheck(health.Ping("database", repo))
+	healthChecks.AddReadinessCheck(health.Ping("broker", broker))
+	healthChecks.AddReadinessCheck(health.ConsumerLag("consumer_lag", subscription, getIntEnv("HEALTH_MAX_CONSUMER_LAG", 0)))
+
+	mux := http.NewServeMux()
+	healthChecks.Register(mux)
+	metrics.Register(mux)
+	httpServer := &http.Server{Addr: getEnv("HTTP_ADDR", ":8080"), Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			appLogger.Error(ctx, "HTTP server failed", err)
+		}
+	}()
+
+	appLogger.Info(ctx, "Message processor started",
+		"topic_in", topicIn,
+		"topic_out", topicOut,
+	)
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case <-sigChan:
+	case <-subscription.Done():
+		appLogger.Warn(ctx, "Subscription stopped unexpectedly", "topic", subscription.Topic())
+	}
+
+	appLogger.Info(ctx, "Shutting down message processor")
 
-	appLogger.Info("Shutting down message processor", "", "", nil)
+	// Stop fetching and let in-flight messages finish before the deferred
+	// Close calls tear down the broker and database connections. The 25s
+	// default leaves room within the 30s Kubernetes termination grace period
+	healthChecks.MarkShuttingDown()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), getDurationEnv("SHUTDOWN_TIMEOUT", 25*time.Second))
+	defer cancelShutdown()
+	if err := broker.Shutdown(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Broker did not drain before the shutdown deadline", "error", err.Error())
+	}
+	httpServer.Shutdown(shutdownCtx)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Failed to flush pending spans", "error", err.Error())
+	}
+}
+
+// processingLease identifies this replica when claiming messages
+type processingLease struct {
+	owner string
+	ttl   time.Duration
+}
+
+// keep renews the lease on a claimed message every ttl/3 until stop is
+// called. If another worker reclaimed the message, the returned context is
+// canceled and stop returns database.ErrLeaseNotOwned; other renewal errors
+// are retried on the next tick
+func (l processingLease) keep(ctx context.Context, store database.MessageStore, idempotencyID string, appLogger *logger.Logger) (_ context.Context, stop func() error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := store.RenewLease(ctx, idempotencyID, l.owner, l.ttl)
+				if errors.Is(err, database.ErrLeaseNotOwned) {
+					cancel(err)
+					return
+				}
+				if err != nil && ctx.Err() == nil {
+					appLogger.Warn(ctx, "Failed to renew processing lease", "error", err.Error())
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ctx, func() error {
+		close(done)
+		<-stopped
+		err := context.Cause(ctx)
+		cancel(nil)
+		if errors.Is(err, database.ErrLeaseNotOwned) {
+			return err
+		}
+		return nil
+	}
 }
 
-func createMessageHandler(repo *database.Repository, broker messaging.MessageBroker, appLogger *logger.Logger) messaging.MessageHandler {
+func createMessageHandler(store database.MessageStore, broker messaging.MessageBroker, lease processingLease, appLogger *logger.Logger) messaging.MessageHandler {
 	return func(ctx context.Context, event *contracts.Event) error {
-		appLogger.Info("Received message.created event", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-			"event_id": event.EventID,
-		})
+		appLogger.Info(ctx, "Received message.created event")
 
 		// Idempotency check: verify if this idempotency_id was already processed
-		msg, exists, err := repo.CreateOrGetMessage(
+		msg, exists, err := store.CreateOrGetMessage(
+			ctx,
 			event.IdempotencyID,
 			event.CorrelationID,
 			event.Payload,
 		)
 		if err != nil {
-			appLogger.Error("Failed to check/create message", event.CorrelationID, event.IdempotencyID, err, nil)
+			appLogger.Error(ctx, "Failed to check/create message", err)
 			return fmt.Errorf("failed to check/create message: %w", err)
 		}
 
-		if exists && msg.Status != "pending" {
-			appLogger.Info("Message already processed, skipping", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-				"current_status": msg.Status,
-			})
+		if exists && database.IsFinalStatus(msg.Status) {
+			appLogger.Info(ctx, "Message already processed, skipping", "current_status", msg.Status)
 			return nil // Idempotent: message already processed
 		}
 
-		// Simulate processing
-		appLogger.Info("Processing message", event.CorrelationID, event.IdempotencyID, nil)
-		time.Sleep(100 * time.Millisecond) // Simulate work
-
-		// Update status to processing
-		err = repo.UpdateMessageStatus(
+		// Claim the message: only one replica moves it to processing, the
+		// others back off while its lease is live
+		msg, err = store.ClaimMessage(
+			ctx,
 			event.IdempotencyID,
 			event.CorrelationID,
-			"processing",
+			lease.owner,
+			lease.ttl,
 			serviceName,
 			event.EventID,
-			nil,
 		)
+		if errors.Is(err, database.ErrLeaseHeld) {
+			appLogger.Info(ctx, "Message is being processed by another worker, skipping")
+			return nil
+		}
+		if isStaleTransition(err) {
+			appLogger.Info(ctx, "Message already processed, skipping", "error", err.Error())
+			return nil
+		}
 		if err != nil {
-			appLogger.Error("Failed to update message status", event.CorrelationID, event.IdempotencyID, err, nil)
-			return fmt.Errorf("failed to update status: %w", err)
+			appLogger.Error(ctx, "Failed to claim message", err)
+			return fmt.Errorf("failed to claim message: %w", err)
 		}
 
-		// Simulate more processing
-		time.Sleep(200 * time.Millisecond)
+		// Run the processing steps registered for this event
+		steps := processors.Pipeline(event)
+		appLogger.Info(ctx, "Processing message", "lease_owner", lease.owner, "steps", stepNames(steps))
+		processing := newProcessing(event, emitStage(broker, event))
+
+		// Renew the lease while the pipeline runs, so the reconciler does not
+		// hand the message to another worker; losing it aborts the pipeline
+		pipelineCtx, stopRenewing := lease.keep(ctx, store, event.IdempotencyID, appLogger)
+		err = runPipeline(pipelineCtx, steps, processing)
+		if leaseErr := stopRenewing(); leaseErr != nil {
+			appLogger.Warn(ctx, "Processing lease lost, leaving the message to its new owner", "error", leaseErr.Error())
+			return nil
+		}
+		if err != nil {
+			return handleFailure(ctx, store, broker, appLogger, event, msg, err)
+		}
+
+		version := msg.Version
+		if processing.Enriched() {
+			version, err = store.UpdateMessagePayload(ctx, event.IdempotencyID, msg.Version, processing.Payload)
+			if isStaleTransition(err) {
+				appLogger.Warn(ctx, "Message status changed concurrently, skipping", "error", err.Error())
+				return nil
+			}
+			if err != nil {
+				appLogger.Error(ctx, "Failed to store enriched payload", err)
+				return fmt.Errorf("failed to store enriched payload: %w", err)
+			}
+		}
 
-		// Update status to processed
-		err = repo.UpdateMessageStatus(
+		// Update status to processed; fails if the lease expired and another
+		// worker reclaimed the message in the meantime
+		_, err = store.CompareAndSwapStatus(
+			ctx,
 			event.IdempotencyID,
 			event.CorrelationID,
-			"processed",
+			version,
+			database.StatusProcessed,
 			serviceName,
 			event.EventID,
 			nil,
 		)
+		if isStaleTransition(err) {
+			appLogger.Warn(ctx, "Message status changed concurrently, skipping", "error", err.Error())
+			return nil
+		}
 		if err != nil {
-			appLogger.Error("Failed to update message status", event.CorrelationID, event.IdempotencyID, err, nil)
+			appLogger.Error(ctx, "Failed to update message status", err)
 			return fmt.Errorf("failed to update status: %w", err)
 		}
 
 		// Publish message.status.updated event
 		statusPayload := map[string]interface{}{
 			"idempotency_id": event.IdempotencyID,
-			"status":         "processed",
+			"status":         database.StatusProcessed,
 			"processed_at":   time.Now().UTC().Format(time.RFC3339),
 		}
 
 		statusEvent := contracts.NewEvent(
-			"message.status.updated",
+			contracts.EventTypeMessageStatusUpdated,
 			event.CorrelationID,
 			event.IdempotencyID,
 			serviceName,
@@ -142,18 +370,50 @@ func createMessageHandler(repo *database.Repository, broker messaging.MessageBro
 
 		err = broker.Publish(ctx, topicOut, statusEvent)
 		if err != nil {
-			appLogger.Error("Failed to publish status update", event.CorrelationID, event.IdempotencyID, err, nil)
+			appLogger.Error(ctx, "Failed to publish status update", err)
 			return fmt.Errorf("failed to publish status update: %w", err)
 		}
 
-		appLogger.Info("Message processed successfully", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-			"status": "processed",
-		})
+		appLogger.Info(ctx, "Message processed successfully", "status", database.StatusProcessed)
 
 		return nil
 	}
 }
 
+// emitStage publishes the intermediate stages of the processing of event
+// as message.stage.updated events, on the status topic so that they are
+// ordered with the status changes of the message
+func emitStage(broker messaging.MessageBroker, event *contracts.Event) func(ctx context.Context, stage string) error {
+	return func(ctx context.Context, stage string) error {
+		stageEvent := contracts.NewEvent(
+			contracts.EventTypeMessageStageUpdated,
+			event.CorrelationID,
+			event.IdempotencyID,
+			serviceName,
+			map[string]interface{}{
+				"idempotency_id": event.IdempotencyID,
+				"stage":          stage,
+			},
+		)
+		return broker.Publish(ctx, topicOut, stageEvent)
+	}
+}
+
+func stepNames(steps []Processor) []string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.Name()
+	}
+	return names
+}
+
+// isStaleTransition reports whether a status update was refused because the
+// message moved on (another delivery processed or cancelled it), in which
+// case retrying is pointless
+func isStaleTransition(err error) bool {
+	return errors.Is(err, database.ErrVersionConflict) || errors.Is(err, database.ErrIllegalTransition)
+}
+
 func getDatabaseConnectionString() string {
 	host := getEnv("DB_HOST", "localhost")
 	port := getEnv("DB_PORT", "5432")
@@ -172,3 +432,27 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getDurationEnv reads a duration such as "30s"
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func getIntEnv(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"queue-microservice-case/shared/contracts"
+)
+
+// Processor is one step of the processing of a message. Steps are picked
+// per event by the selector they are registered with (see registerProcessor)
+type Processor interface {
+	// Name identifies the step in logs, errors and intermediate statuses
+	Name() string
+
+	// RetrySafe reports whether the step can run again for the same message
+	// (it is idempotent or has no side effects). A transient failure after
+	// a step that is not retry-safe has run fails the message permanently
+	RetrySafe() bool
+
+	// Process runs the step. Errors wrapped with permanent fail the
+	// message; other errors are retried
+	Process(ctx context.Context, p *Processing) error
+}
+
+// Processing is the message going through the pipeline
+type Processing struct {
+	Event *contracts.Event
+
+	// Payload is the payload of the message, enriched by the steps
+	Payload map[string]interface{}
+
+	enriched bool
+	emit     func(ctx context.Context, stage string) error
+}
+
+func newProcessing(event *contracts.Event, emit func(ctx context.Context, stage string) error) *Processing {
+	payload := make(map[string]interface{}, len(event.Payload))
+	for key, value := range event.Payload {
+		payload[key] = value
+	}
+	return &Processing{Event: event, Payload: payload, emit: emit}
+}
+
+// Enrich sets key in the payload. The enriched payload is stored with the
+// message once the pipeline succeeds
+func (p *Processing) Enrich(key string, value interface{}) {
+	p.Payload[key] = value
+	p.enriched = true
+}
+
+// Enriched reports whether a step changed the payload
+func (p *Processing) Enriched() bool {
+	return p.enriched
+}
+
+// EmitStatus publishes a message.stage.updated event announcing stage, an
+// intermediate step of the processing
+func (p *Processing) EmitStatus(ctx context.Context, stage string) error {
+	if p.emit == nil {
+		return nil
+	}
+	return p.emit(ctx, stage)
+}
+
+// Selector chooses the events a processor applies to. Empty fields match
+// every event
+type Selector struct {
+	EventType string
+
+	// Attributes are payload values, by dotted path, that must all match
+	// (e.g. "metadata.source": "batch")
+	Attributes map[string]string
+}
+
+// Matches reports whether event is selected
+func (s Selector) Matches(event *contracts.Event) bool {
+	if s.EventType != "" && s.EventType != event.EventType {
+		return false
+	}
+	for path, expected := range s.Attributes {
+		value, ok := payloadValue(event.Payload, path)
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// payloadValue looks up a dotted path in a payload
+func payloadValue(payload map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+type registration struct {
+	order     int
+	selector  Selector
+	processor Processor
+}
+
+// ProcessorRegistry holds the processing steps and the events they apply to
+type ProcessorRegistry struct {
+	mu    sync.RWMutex
+	steps []registration
+}
+
+// Register adds processor for the events matched by selector. Steps run by
+// ascending order, then registration order
+func (r *ProcessorRegistry) Register(order int, selector Selector, processor Processor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, registration{order: order, selector: selector, processor: processor})
+	sort.SliceStable(r.steps, func(i, j int) bool {
+		return r.steps[i].order < r.steps[j].order
+	})
+}
+
+// Pipeline returns the steps that apply to event, in order
+func (r *ProcessorRegistry) Pipeline(event *contracts.Event) []Processor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var steps []Processor
+	for _, step := range r.steps {
+		if step.selector.Matches(event) {
+			steps = append(steps, step.processor)
+		}
+	}
+	return steps
+}
+
+// processors is the registry of the service; steps register themselves
+// from init functions with registerProcessor
+var processors = &ProcessorRegistry{}
+
+func registerProcessor(order int, selector Selector, processor Processor) {
+	processors.Register(order, selector, processor)
+}
+
+// runPipeline runs steps on p, stopping at the first error
+func runPipeline(ctx context.Context, steps []Processor, p *Processing) error {
+	unsafeRan := false
+	for _, step := range steps {
+		err := step.Process(ctx, p)
+		if !step.RetrySafe() {
+			unsafeRan = true
+		}
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("step %s: %w", step.Name(), err)
+		if unsafeRan && !classifyFailure(err).permanent {
+			// Retrying would run a step that is not retry-safe again
+			return permanent(reasonProcessingError, fmt.Errorf("%w (not retried: a step that is not retry-safe already ran)", err))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/simulation"
+)
+
+// Built-in processing steps. New steps register themselves the same way,
+// from their own file, without touching the message handler. The simulated
+// workload is registered by main, once its profile is loaded
+func init() {
+	registerProcessor(30, Selector{EventType: contracts.EventTypeMessageCreated}, contentStats{})
+}
+
+// simulatedWork stands for the business processing of a message: it runs
+// the workload of the simulation profile and announces its stage
+type simulatedWork struct {
+	name      string
+	simulator *simulation.Simulator
+}
+
+func (w *simulatedWork) Name() string    { return w.name }
+func (w *simulatedWork) RetrySafe() bool { return true }
+
+func (w *simulatedWork) Process(ctx context.Context, p *Processing) error {
+	if err := p.EmitStatus(ctx, w.name); err != nil {
+		return err
+	}
+	return w.simulator.Run(ctx)
+}
+
+// contentStats enriches the payload with the length of its content
+type contentStats struct{}
+
+func (contentStats) Name() string    { return "content_stats" }
+func (contentStats) RetrySafe() bool { return true }
+
+func (contentStats) Process(ctx context.Context, p *Processing) error {
+	content, _ := p.Payload["content"].(string)
+	p.Enrich("content_length", utf8.RuneCountInString(content))
+	return nil
+}
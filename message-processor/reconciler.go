@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/messaging"
+	"queue-microservice-case/shared/metrics"
+)
+
+// reconcilerConfig controls the recovery of stuck messages: rows left
+// pending (the gateway stored them but failed to publish) or processing (a
+// replica crashed mid-handler) past their thresholds
+type reconcilerConfig struct {
+	interval    time.Duration
+	criteria    database.StuckCriteria
+	maxAttempts int
+}
+
+func reconcilerConfigFromEnv() reconcilerConfig {
+	return reconcilerConfig{
+		interval: getDurationEnv("RECONCILER_INTERVAL", time.Minute),
+		criteria: database.StuckCriteria{
+			PendingAfter:    getDurationEnv("RECONCILER_PENDING_AFTER", 5*time.Minute),
+			ProcessingAfter: getDurationEnv("RECONCILER_PROCESSING_AFTER", time.Minute),
+			Limit:           int(getIntEnv("RECONCILER_BATCH_SIZE", 100)),
+		},
+		maxAttempts: int(getIntEnv("RECONCILER_MAX_ATTEMPTS", 3)),
+	}
+}
+
+// runReconciler recovers stuck messages every interval until ctx is done.
+// Every replica runs it: the version check of each action makes sure only
+// one of them acts on a given message
+func runReconciler(ctx context.Context, store database.MessageStore, broker messaging.MessageBroker, cfg reconcilerConfig, appLogger *logger.Logger) {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reconcile(ctx, store, broker, cfg, appLogger)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcile handles one batch of stuck messages: each is republished as a
+// message.created event, which the idempotent handler picks up again, until
+// it reaches maxAttempts and is marked failed (and dead-lettered)
+func reconcile(ctx context.Context, store database.MessageStore, broker messaging.MessageBroker, cfg reconcilerConfig, appLogger *logger.Logger) {
+	stuck, err := store.FindStuckMessages(ctx, cfg.criteria)
+	if err != nil {
+		appLogger.Warn(ctx, "Failed to find stuck messages", "error", err.Error())
+		return
+	}
+
+	for i := range stuck {
+		msg := &stuck[i]
+		msgCtx := logger.ContextWithFields(ctx, logger.Fields{
+			CorrelationID: msg.CorrelationID,
+			IdempotencyID: msg.IdempotencyID,
+		})
+
+		if msg.ReconcileAttempts >= cfg.maxAttempts {
+			reason := fmt.Sprintf("stuck in %s after %d reconcile attempts", msg.Status, msg.ReconcileAttempts)
+			err := store.FailStuckMessage(msgCtx, msg, reason, serviceName)
+			if isStaleTransition(err) {
+				continue // another replica or the handler got to it first
+			}
+			metrics.ObserveReconcile(database.ActionFail, err)
+			if err != nil {
+				appLogger.Error(msgCtx, "Failed to mark stuck message as failed", err)
+				continue
+			}
+			appLogger.Warn(msgCtx, "Marked stuck message as failed", "previous_status", msg.Status, "attempts", msg.ReconcileAttempts)
+
+			event := contracts.NewEvent(contracts.EventTypeMessageCreated, msg.CorrelationID, msg.IdempotencyID, serviceName, msg.Payload)
+			if err := publishFailure(msgCtx, broker, event, reasonRetriesExhausted, errors.New(reason), msg.ReconcileAttempts); err != nil {
+				appLogger.Error(msgCtx, "Failed to publish stuck message failure", err)
+			}
+			continue
+		}
+
+		// Record the attempt before publishing, so only the replica that
+		// wins the version check republishes. A failed publish is retried
+		// once the message is stuck again
+		event := contracts.NewEvent(
+			contracts.EventTypeMessageCreated,
+			msg.CorrelationID,
+			msg.IdempotencyID,
+			serviceName,
+			msg.Payload,
+		)
+		err := store.MarkRepublished(msgCtx, msg, serviceName, event.EventID)
+		if isStaleTransition(err) {
+			continue
+		}
+		if err == nil {
+			err = broker.Publish(msgCtx, topicIn, event)
+		}
+		metrics.ObserveReconcile(database.ActionRepublish, err)
+		if err != nil {
+			appLogger.Error(msgCtx, "Failed to republish stuck message", err)
+			continue
+		}
+		appLogger.Info(msgCtx, "Republished stuck message", "status", msg.Status, "attempt", msg.ReconcileAttempts+1, "event_id", event.EventID)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// EmailConfig holds the SMTP settings of the email channel
+type EmailConfig struct {
+	// Addr is the host:port of the SMTP server
+	Addr string
+	From string
+	// To are the default recipients, used when the notification has no
+	// address
+	To []string
+
+	// Username and Password enable PLAIN authentication, which requires
+	// STARTTLS unless the server is on localhost
+	Username string
+	Password string
+
+	// Timeout bounds the whole SMTP conversation
+	Timeout time.Duration
+}
+
+// EmailNotifier sends notifications as plain text emails over SMTP, with an
+// HTML alternative when there is an HTML template. It uses STARTTLS when the
+// server offers it
+type EmailNotifier struct {
+	cfg  EmailConfig
+	host string
+}
+
+func newEmailNotifier(cfg EmailConfig) (*EmailNotifier, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_SMTP_ADDR %q: %w", cfg.Addr, err)
+	}
+	if cfg.From == "" {
+		return nil, fmt.Errorf("the email channel requires NOTIFY_SMTP_FROM")
+	}
+	return &EmailNotifier{cfg: cfg, host: host}, nil
+}
+
+func (e *EmailNotifier) Channel() string { return "email" }
+
+func (e *EmailNotifier) Send(ctx context.Context, n *Notification) error {
+	to := e.cfg.To
+	if n.Address != "" {
+		to = []string{n.Address}
+	}
+	if len(to) == 0 {
+		return permanent(fmt.Errorf("no email recipient: set NOTIFY_SMTP_TO or the address of the subscription"))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", e.cfg.Addr, err)
+	}
+	// net/smtp does not take a context: the deadline bounds every command
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return classifySMTP("failed to greet", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return classifySMTP("failed to start TLS", err)
+		}
+	}
+	if e.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.host)); err != nil {
+			return classifySMTP("failed to authenticate", err)
+		}
+	}
+
+	if err := client.Mail(e.cfg.From); err != nil {
+		return classifySMTP("sender rejected", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return classifySMTP(fmt.Sprintf("recipient %s rejected", rcpt), err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return classifySMTP("failed to start message", err)
+	}
+	if _, err := w.Write(e.message(n, to)); err != nil {
+		return classifySMTP("failed to write message", err)
+	}
+	if err := w.Close(); err != nil {
+		return classifySMTP("message rejected", err)
+	}
+	return client.Quit()
+}
+
+// message renders the headers and body of the email. Newlines in the body
+// are sent as CRLF by the DATA writer
+func (e *EmailNotifier) message(n *Notification, to []string) []byte {
+	var msg strings.Builder
+	header := func(key, value string) {
+		// Drop line breaks so no header can be injected
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		fmt.Fprintf(&msg, "%s: %s\r\n", key, value)
+	}
+	header("From", e.cfg.From)
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", n.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("X-Correlation-ID", n.CorrelationID)
+
+	if n.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		msg.WriteString("\r\n")
+		msg.WriteString(n.Text)
+		return []byte(msg.String())
+	}
+
+	// Clients show the last alternative they support
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", n.Text},
+		{"text/html; charset=utf-8", n.HTML},
+	} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		io.WriteString(w, part.content)
+	}
+	parts.Close()
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return []byte(msg.String())
+}
+
+// classifySMTP wraps an SMTP error; permanent replies (5xx) are permanent
+func classifySMTP(action string, err error) error {
+	err = fmt.Errorf("%s: %w", action, err)
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanent(err)
+	}
+	return err
+}
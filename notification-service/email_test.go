@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer speaks just enough SMTP for net/smtp, without STARTTLS or
+// AUTH. replies overrides the reply to a command ("MAIL", "RCPT", or
+// "DATA" for the end of the message)
+type fakeSMTPServer struct {
+	listener net.Listener
+	replies  map[string]string
+
+	mu       sync.Mutex
+	from     string
+	rcpts    []string
+	messages [][]byte
+}
+
+func newFakeSMTPServer(t *testing.T, replies map[string]string) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener, replies: replies}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) reply(command, fallback string) string {
+	if reply, ok := s.replies[command]; ok {
+		return reply
+	}
+	return fallback
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 8BITMIME")
+		case "HELO", "NOOP", "RSET":
+			text.PrintfLine("250 OK")
+		case "MAIL":
+			s.mu.Lock()
+			s.from = arg
+			s.mu.Unlock()
+			text.PrintfLine(s.reply("MAIL", "250 OK"))
+		case "RCPT":
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, arg)
+			s.mu.Unlock()
+			text.PrintfLine(s.reply("RCPT", "250 OK"))
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			message, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+			text.PrintfLine(s.reply("DATA", "250 OK: queued"))
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received() (rcpts []string, messages [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.rcpts...), append([][]byte(nil), s.messages...)
+}
+
+func TestEmailNotifierSend(t *testing.T) {
+	tests := []struct {
+		name          string
+		replies       map[string]string
+		wantErr       bool
+		wantPermanent bool
+		wantMessage   bool
+	}{
+		{name: "accepted", wantMessage: true},
+		{name: "sender rejected", replies: map[string]string{"MAIL": "550 Sender rejected"}, wantErr: true, wantPermanent: true},
+		{name: "recipient unknown", replies: map[string]string{"RCPT": "550 No such user"}, wantErr: true, wantPermanent: true},
+		{name: "mailbox busy", replies: map[string]string{"RCPT": "450 Mailbox busy"}, wantErr: true},
+		{name: "message rejected", replies: map[string]string{"DATA": "554 Message rejected"}, wantErr: true, wantPermanent: true, wantMessage: true},
+		{name: "message deferred", replies: map[string]string{"DATA": "451 Try again later"}, wantErr: true, wantMessage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, tt.replies)
+			email, err := newEmailNotifier(EmailConfig{
+				Addr:    server.listener.Addr().String(),
+				From:    "queue@example.com",
+				To:      []string{"ops@example.com"},
+				Timeout: time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = email.Send(context.Background(), testNotification())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+
+			rcpts, messages := server.received()
+			if (len(messages) == 1) != tt.wantMessage {
+				t.Fatalf("server received %d messages, want message %v", len(messages), tt.wantMessage)
+			}
+			if tt.wantMessage {
+				if len(rcpts) != 1 || rcpts[0] != "TO:<ops@example.com>" {
+					t.Errorf("recipients = %q", rcpts)
+				}
+				msg, err := mail.ReadMessage(strings.NewReader(string(messages[0])))
+				if err != nil {
+					t.Fatalf("invalid message: %v", err)
+				}
+				if got := msg.Header.Get("To"); got != "ops@example.com" {
+					t.Errorf("To = %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestEmailNotifierSendUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	email, err := newEmailNotifier(EmailConfig{Addr: addr, From: "queue@example.com", To: []string{"ops@example.com"}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = email.Send(context.Background(), testNotification())
+	if err == nil || isPermanent(err) {
+		t.Errorf("Send() error = %v, want a transient error", err)
+	}
+}
+
+func TestClassifySMTP(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+	}{
+		{"mailbox unavailable", &textproto.Error{Code: 550, Msg: "No such user"}, true},
+		{"transaction failed", &textproto.Error{Code: 554, Msg: "Rejected"}, true},
+		{"service not available", &textproto.Error{Code: 421, Msg: "Closing"}, false},
+		{"mailbox busy", &textproto.Error{Code: 450, Msg: "Busy"}, false},
+		{"connection closed", io.EOF, false},
+		{"timeout", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifySMTP("recipient rejected", tt.err)
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("classifySMTP() = %v, does not wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	email := &EmailNotifier{cfg: EmailConfig{From: "queue@example.com"}}
+
+	tests := []struct {
+		name  string
+		setup func(n *Notification)
+		check func(t *testing.T, msg *mail.Message)
+	}{
+		{
+			name: "plain text",
+			check: func(t *testing.T, msg *mail.Message) {
+				if got := msg.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+					t.Errorf("Content-Type = %q", got)
+				}
+				body, _ := io.ReadAll(msg.Body)
+				if string(body) != "Message idem-1 failed" {
+					t.Errorf("body = %q", body)
+				}
+			},
+		},
+		{
+			name: "header injection",
+			setup: func(n *Notification) {
+				n.CorrelationID = "corr-1\r\nBcc: victim@example.com"
+				n.Subject = "Failed\r\nBcc: victim@example.com"
+			},
+			check: func(t *testing.T, msg *mail.Message) {
+				if got := msg.Header.Get("Bcc"); got != "" {
+					t.Errorf("injected Bcc header %q", got)
+				}
+				if got := msg.Header.Get("X-Correlation-ID"); got != "corr-1  Bcc: victim@example.com" {
+					t.Errorf("X-Correlation-ID = %q", got)
+				}
+				subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+				if err != nil || subject != "Failed\r\nBcc: victim@example.com" {
+					t.Errorf("Subject = %q (%v), want the encoded original", subject, err)
+				}
+			},
+		},
+		{
+			name: "html alternative",
+			setup: func(n *Notification) {
+				n.HTML = "<p>Message <b>idem-1</b> failed</p>"
+			},
+			check: func(t *testing.T, msg *mail.Message) {
+				mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+				if err != nil || mediaType != "multipart/alternative" {
+					t.Fatalf("Content-Type = %q (%v)", msg.Header.Get("Content-Type"), err)
+				}
+				parts := multipart.NewReader(msg.Body, params["boundary"])
+				want := []struct{ contentType, content string }{
+					{"text/plain; charset=utf-8", "Message idem-1 failed"},
+					{"text/html; charset=utf-8", "<p>Message <b>idem-1</b> failed</p>"},
+				}
+				for _, w := range want {
+					part, err := parts.NextPart()
+					if err != nil {
+						t.Fatalf("missing %s part: %v", w.contentType, err)
+					}
+					content, _ := io.ReadAll(part)
+					if part.Header.Get("Content-Type") != w.contentType || string(content) != w.content {
+						t.Errorf("part %q = %q, want %q", part.Header.Get("Content-Type"), content, w.content)
+					}
+				}
+				if _, err := parts.NextPart(); err != io.EOF {
+					t.Errorf("unexpected extra part (%v)", err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := testNotification()
+			if tt.setup != nil {
+				tt.setup(n)
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(string(email.message(n, []string{"ops@example.com"}))))
+			if err != nil {
+				t.Fatalf("invalid message: %v", err)
+			}
+			if got := msg.Header.Get("From"); got != "queue@example.com" {
+				t.Errorf("From = %q", got)
+			}
+			tt.check(t, msg)
+		})
+	}
+}
@@ -2,16 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	_ "time/tzdata" // recipient timezones, without relying on the image
 
+	"queue-microservice-case/shared/claimcheck"
 	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/health"
 	"queue-microservice-case/shared/logger"
 	"queue-microservice-case/shared/messaging"
+	"queue-microservice-case/shared/metrics"
+	"queue-microservice-case/shared/redact"
+	"queue-microservice-case/shared/simulation"
+	"queue-microservice-case/shared/tracing"
 )
 
 const (
@@ -20,65 +32,373 @@ const (
 )
 
 func main() {
-	// Initialize logger
-	appLogger := logger.NewLogger(serviceName)
+	// Initialize logger; std log output goes through it too
+	appLogger, err := logger.NewLogger(serviceName)
+	if err != nil {
+		log.Fatalf("Failed to configure logger: %v", err)
+	}
+	appLogger.SetDefault()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Get database connection string
+	dbConnStr := getDatabaseConnectionString()
+	repo, err := database.NewRepository(dbConnStr,
+		database.WithQueryTimeout(getDurationEnv("DB_QUERY_TIMEOUT", database.DefaultQueryTimeout)))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to connect to database", err)
+	}
+	defer repo.Close()
+
+	// "migrate" subcommand: manage the schema and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.RunMigrateCommand(ctx, repo, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Migration failed", err)
+		}
+		return
+	}
+
+	// Apply pending migrations; replicas serialize on an advisory lock
+	if getBoolEnv("DB_MIGRATE_ON_STARTUP", true) {
+		applied, err := repo.Migrate(ctx)
+		if err != nil {
+			appLogger.Fatal(ctx, "Failed to apply database migrations", err)
+		}
+		for _, migration := range applied {
+			appLogger.Info(ctx, "Applied database migration", "version", migration.Version, "name", migration.Name)
+		}
+	}
+
+	// "subscriptions" subcommand: manage recipients and exit
+	if len(os.Args) > 1 && os.Args[1] == "subscriptions" {
+		if err := runSubscriptionsCommand(ctx, repo, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Subscriptions command failed", err)
+		}
+		return
+	}
+
+	// Notification templates: the builtin ones and those of
+	// NOTIFY_TEMPLATES_DIR, reloaded when its files change
+	templates, err := templatesFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load notification templates", err)
+	}
+
+	// "templates" subcommand: list or preview templates and exit
+	if len(os.Args) > 1 && os.Args[1] == "templates" {
+		if err := runTemplatesCommand(ctx, repo, repo, templates, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Templates command failed", err)
+		}
+		return
+	}
+
+	// "replay" subcommand: deliver failed webhook notifications again and exit
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplayCommand(ctx, repo, appLogger, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Replay failed", err)
+		}
+		return
+	}
+
+	// Export spans and propagate W3C trace context through the broker
+	shutdownTracing, err := tracing.Setup(ctx, tracing.ConfigFromEnv(serviceName))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to set up tracing", err)
+	}
+
+	// PII redaction rules applied to DLQ records (the logger loads the same
+	// rules on its own)
+	redactor, err := redact.FromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load redaction rules", err)
+	}
+
+	// Load event signing keys and per-topic verification policy
+	signingKeys, err := messaging.KeyRingFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signing keys", err)
+	}
+	signaturePolicy, err := messaging.SignaturePolicyFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signature policy", err)
+	}
+
+	// Claim check store for payloads too large for the broker
+	claimCheckConfig, err := claimcheck.ConfigFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load claim check configuration", err)
+	}
+	claimCheckStore, err := claimcheck.Open(claimCheckConfig, dbConnStr)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to open claim check store", err)
+	}
 
 	// Initialize message broker
-	broker, err := messaging.NewMessageBroker()
+	broker, err := messaging.NewMessageBroker(
+		messaging.WithKeyRing(signingKeys),
+		messaging.WithClaimCheck(claimCheckStore, claimCheckConfig.Threshold, claimCheckConfig.TTL),
+		messaging.WithRedactor(redactor),
+	)
 	if err != nil {
-		appLogger.Error("Failed to initialize message broker", "", "", err, nil)
-		log.Fatalf("Failed to initialize message broker: %v", err)
+		appLogger.Fatal(ctx, "Failed to initialize message broker", err)
 	}
 	defer broker.Close()
 
+	if claimCheckStore != nil {
+		go claimcheck.RunCollector(ctx, claimCheckStore, claimCheckConfig.GCInterval)
+	}
+
+	// Simulated workload of sending a notification
+	workloadProfile, err := simulation.ProfileFromEnv(serviceName, simulation.ConstantProfile(50*time.Millisecond))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load simulation profile", err)
+	}
+	workload, err := simulation.New(workloadProfile)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to create workload simulator", err)
+	}
+	appLogger.Info(ctx, "Workload simulation profile loaded",
+		"distribution", workloadProfile.Latency.Distribution,
+		"transient_failure_rate", workloadProfile.TransientFailureRate,
+		"permanent_failure_rate", workloadProfile.PermanentFailureRate,
+		"cpu_iterations", workloadProfile.CPUIterations,
+		"seed", workloadProfile.Seed,
+	)
+
+	// Notification channels and the statuses routed to them
+	notifiers, err := notifiersFromEnv(repo, workload, appLogger)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to configure notification channels", err)
+	}
+	appLogger.Info(ctx, "Notification channels configured", "channels", strings.Join(notifiers.Channels(), ","))
+	go templates.Watch(ctx, getDurationEnv("NOTIFY_TEMPLATES_RELOAD_INTERVAL", 10*time.Second), appLogger)
+
+	// Rate limits and digests, shared with the other replicas through the
+	// database
+	throttle, err := throttleFromEnv(repo, repo)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to configure notification rate limits", err)
+	}
+	go throttle.RunDigestFlusher(ctx, notifiers, templates, getDurationEnv("NOTIFY_DIGEST_FLUSH_INTERVAL", 10*time.Second), appLogger)
+
 	// Subscribe to message.status.updated events
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	handler := messaging.Chain(
+		createNotificationHandler(repo, repo, repo, notifiers, templates, throttle, appLogger),
+		messaging.VerifySignatures(signingKeys, signaturePolicy, broker),
+		messaging.RecordTimings(messaging.StoreTimings(repo, serviceName)),
+	)
 
-	err = broker.Subscribe(ctx, topicIn, createNotificationHandler(appLogger))
+	subscription, err := broker.Subscribe(ctx, topicIn, handler)
 	if err != nil {
-		appLogger.Error("Failed to subscribe to topic", "", "", err, nil)
-		log.Fatalf("Failed to subscribe: %v", err)
+		appLogger.Fatal(ctx, "Failed to subscribe to topic", err)
 	}
 
-	appLogger.Info("Notification service started", "", "", map[string]interface{}{
-		"topic_in": topicIn,
-	})
+	// Expose liveness and readiness probes
+	healthChecks := health.New()
+	healthChecks.AddLivenessCheck(health.Heartbeat("consumer", subscription, getDurationEnv("HEALTH_MAX_HANDLER_DURATION", 2*time.Minute)))
+	healthChecks.AddReadinessCheck(health.Ping("database", repo))
+	healthChecks.AddReadinessCheck(health.Ping("broker", broker))
+	healthChecks.AddReadinessCheck(health.ConsumerLag("consumer_lag", subscription, getIntEnv("HEALTH_MAX_CONSUMER_LAG", 0)))
+
+	mux := http.NewServeMux()
+	healthChecks.Register(mux)
+	metrics.Register(mux)
+	httpServer := &http.Server{Addr: getEnv("HTTP_ADDR", ":8080"), Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			appLogger.Error(ctx, "HTTP server failed", err)
+		}
+	}()
+
+	appLogger.Info(ctx, "Notification service started", "topic_in", topicIn)
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case <-sigChan:
+	case <-subscription.Done():
+		appLogger.Warn(ctx, "Subscription stopped unexpectedly", "topic", subscription.Topic())
+	}
 
-	appLogger.Info("Shutting down notification service", "", "", nil)
+	appLogger.Info(ctx, "Shutting down notification service")
+
+	// Stop fetching and let in-flight messages finish before the deferred
+	// Close calls tear down the broker and database connections. The 25s
+	// default leaves room within the 30s Kubernetes termination grace period
+	healthChecks.MarkShuttingDown()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), getDurationEnv("SHUTDOWN_TIMEOUT", 25*time.Second))
+	defer cancelShutdown()
+	if err := broker.Shutdown(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Broker did not drain before the shutdown deadline", "error", err.Error())
+	}
+	httpServer.Shutdown(shutdownCtx)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Failed to flush pending spans", "error", err.Error())
+	}
 }
 
-func createNotificationHandler(appLogger *logger.Logger) messaging.MessageHandler {
+func createNotificationHandler(store database.MessageStore, subscriptions database.SubscriptionStore, deliveries database.DeliveryLog, notifiers *Notifiers, templates *Templates, throttle *Throttle, appLogger *logger.Logger) messaging.MessageHandler {
 	return func(ctx context.Context, event *contracts.Event) error {
-		appLogger.Info("Received message.status.updated event", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-			"event_id": event.EventID,
-		})
+		// Stage updates share the topic but only status changes notify
+		if event.EventType != contracts.EventTypeMessageStatusUpdated {
+			return nil
+		}
+		appLogger.Info(ctx, "Received message.status.updated event")
 
 		// Extract status from payload
 		status, ok := event.Payload["status"].(string)
 		if !ok {
-			appLogger.Warn("Status not found in payload", event.CorrelationID, event.IdempotencyID, nil)
+			appLogger.Warn(ctx, "Status not found in payload")
 			return nil
 		}
 
-		// Simulate notification logic
-		appLogger.Info("Sending notification", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-			"status": status,
-		})
+		// The metadata of the message can choose its channels; the payload
+		// and history feed the templates
+		var payload map[string]interface{}
+		var history []database.MessageHistory
+		msg, err := store.GetMessage(ctx, event.IdempotencyID)
+		switch {
+		case errors.Is(err, database.ErrMessageNotFound):
+			appLogger.Warn(ctx, "Message not found, notifying by status only")
+		case err != nil:
+			appLogger.Error(ctx, "Failed to load message", err)
+			return fmt.Errorf("failed to load message: %w", err)
+		default:
+			payload = msg.Payload
+			if history, err = store.GetMessageHistory(ctx, event.IdempotencyID); err != nil {
+				appLogger.Error(ctx, "Failed to load message history", err)
+				return fmt.Errorf("failed to load message history: %w", err)
+			}
+		}
+
+		notification := newNotification(event, status, payload, history)
+		targets, err := resolveTargets(ctx, subscriptions, notifiers, notification, appLogger)
+		if err != nil {
+			appLogger.Error(ctx, "Failed to resolve notification targets", err)
+			return err
+		}
+
+		// Targets done with in an earlier delivery of the event are skipped,
+		// so a redelivery (after a crash or a rebalance, or a replay from
+		// the DLQ) only retries those that failed transiently
+		outcomes, err := deliveries.ListNotificationOutcomes(ctx, event.EventID)
+		if err != nil {
+			appLogger.Error(ctx, "Failed to load notification outcomes", err)
+			return fmt.Errorf("failed to load notification outcomes: %w", err)
+		}
+		done := make(map[[2]string]bool, len(outcomes))
+		for _, o := range outcomes {
+			done[[2]string{o.Channel, o.RecipientID}] = true
+		}
+
+		// Every target is attempted, and the channels retry transient
+		// failures themselves. The event fails if a target still failed
+		// transiently, so that it is dead-lettered with no outcome recorded
+		// for that target. Permanent failures would fail again, so they are
+		// only logged
+		var errs []error
+		for _, t := range targets {
+			channel := t.notifier.Channel()
+			recipientID := ""
+			if t.notification.Recipient != nil {
+				recipientID = t.notification.Recipient.ID
+			}
+			if done[[2]string{channel, recipientID}] {
+				appLogger.Info(ctx, "Notification already handled by an earlier delivery, skipping", "channel", channel, "recipient_id", recipientID, "status", status)
+				continue
+			}
+
+			// A template that does not render fails again if retried. Rate
+			// limited and digested notifications are sent later in a digest
+			start := time.Now()
+			var deferred string
+			rendered, err := templates.Render(channel, t.notification)
+			if err != nil {
+				err = permanent(err)
+			} else {
+				deferred, err = throttle.Dispatch(ctx, t.notifier, rendered)
+			}
 
-		// Simulate notification delay
-		time.Sleep(50 * time.Millisecond)
+			outcome := database.NotificationSent
+			switch {
+			case err == nil && deferred != "":
+				outcome = database.NotificationDeferred
+				metrics.ObserveNotificationDeferred(channel, deferred)
+				appLogger.Info(ctx, "Notification added to digest", "channel", channel, "recipient_id", recipientID, "status", status, "reason", deferred)
+			case err != nil:
+				outcome = database.NotificationFailed
+				metrics.ObserveNotification(channel, start, err)
+				appLogger.Error(ctx, "Failed to send notification", err,
+					"channel", channel, "recipient_id", recipientID, "status", status, "permanent", isPermanent(err))
+				if !isPermanent(err) {
+					errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+					continue
+				}
+			default:
+				metrics.ObserveNotification(channel, start, nil)
+				appLogger.Info(ctx, "Notification sent successfully", "channel", channel, "recipient_id", recipientID, "status", status)
+			}
 
-		appLogger.Info("Notification sent successfully", event.CorrelationID, event.IdempotencyID, map[string]interface{}{
-			"status": status,
-		})
+			// At worst, a target whose outcome is lost is notified again
+			err = deliveries.RecordNotificationOutcome(context.WithoutCancel(ctx), &database.NotificationOutcome{
+				EventID:     event.EventID,
+				Channel:     channel,
+				RecipientID: recipientID,
+				Outcome:     outcome,
+			})
+			if err != nil {
+				appLogger.Error(ctx, "Failed to record notification outcome", err, "channel", channel, "recipient_id", recipientID)
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("failed to send notification: %w", errors.Join(errs...))
+		}
 
 		return nil
 	}
 }
 
+func getDatabaseConnectionString() string {
+	host := getEnv("DB_HOST", "localhost")
+	port := getEnv("DB_PORT", "5432")
+	user := getEnv("DB_USER", "postgres")
+	password := getEnv("DB_PASSWORD", "postgres")
+	dbname := getEnv("DB_NAME", "queue_case")
+
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getDurationEnv reads a duration such as "30s"
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func getIntEnv(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
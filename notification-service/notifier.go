@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/simulation"
+)
+
+// Notification is what is sent to the channels about a status update of a
+// message
+type Notification struct {
+	Event         *contracts.Event
+	IdempotencyID string
+	CorrelationID string
+	Status        string
+	ReasonCode    string
+
+	// Payload is the stored payload of the message, Metadata its metadata
+	// and History its status history; they are empty when the message is
+	// not stored
+	Payload  map[string]interface{}
+	Metadata map[string]interface{}
+	History  []database.MessageHistory
+
+	// Recipient is the subscriber notified, nil for the channels routed by
+	// status. Address overrides the address configured for the channel
+	Recipient *database.Recipient
+	Address   string
+
+	// DigestWindow batches the notification into a digest (see Throttle);
+	// Digest lists the notifications of a digest being sent
+	DigestWindow time.Duration
+	Digest       []database.DigestItem
+
+	// Subject, Text and HTML are rendered for each channel from Template
+	// (see Templates.Render); HTML is empty without an HTML template
+	Template string
+	Subject  string
+	Text     string
+	HTML     string
+}
+
+// forSubscriber returns a copy of n addressed to a subscriber
+func (n *Notification) forSubscriber(s database.Subscriber) *Notification {
+	addressed := *n
+	addressed.Recipient = &s.Recipient
+	addressed.Address = s.Subscription.Address
+	addressed.DigestWindow, _ = s.Subscription.Digest()
+	return &addressed
+}
+
+// recipientID returns the ID of the recipient, nil for routed notifications
+func (n *Notification) recipientID() *string {
+	if n.Recipient == nil {
+		return nil
+	}
+	return &n.Recipient.ID
+}
+
+// newNotification builds the notification of a message.status.updated event
+// about the message with payload and history
+func newNotification(event *contracts.Event, status string, payload map[string]interface{}, history []database.MessageHistory) *Notification {
+	n := &Notification{
+		Event:         event,
+		IdempotencyID: event.IdempotencyID,
+		CorrelationID: event.CorrelationID,
+		Status:        status,
+		Payload:       payload,
+		History:       history,
+	}
+	n.ReasonCode, _ = event.Payload["reason_code"].(string)
+	n.Metadata, _ = payload["metadata"].(map[string]interface{})
+	return n
+}
+
+// templateData is what the templates of channel are executed with
+func (n *Notification) templateData(channel, locale string) *TemplateData {
+	return &TemplateData{
+		Channel:       channel,
+		Locale:        locale,
+		EventID:       n.Event.EventID,
+		EventType:     n.Event.EventType,
+		IdempotencyID: n.IdempotencyID,
+		CorrelationID: n.CorrelationID,
+		Status:        n.Status,
+		ReasonCode:    n.ReasonCode,
+		Timestamp:     n.Event.Timestamp,
+		Payload:       n.Payload,
+		Metadata:      n.Metadata,
+		History:       n.History,
+		Recipient:     n.Recipient,
+		Digest:        n.Digest,
+	}
+}
+
+// Notifier sends notifications through one channel. Each channel applies
+// its own timeout
+type Notifier interface {
+	// Channel names the channel in routes, logs and metrics
+	Channel() string
+
+	// Send delivers n. Errors wrapped with permanent will fail again if
+	// retried (the recipient rejected the notification)
+	Send(ctx context.Context, n *Notification) error
+}
+
+// permanentError marks a delivery error that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent reports whether err was marked with permanent
+func isPermanent(err error) bool {
+	var permanentErr *permanentError
+	return errors.As(err, &permanentErr)
+}
+
+// RetryConfig holds the retries of the channels that do not retry on their
+// own. The brokers do not redeliver an event whose handler failed (Kafka
+// commits it and RabbitMQ dead-letters it), so transient failures are
+// retried here
+type RetryConfig struct {
+	// MaxAttempts caps the attempts of a send. Transient failures are
+	// retried after Backoff, doubled on each retry up to MaxBackoff
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// retryingNotifier retries the transient failures of the notifier it wraps
+type retryingNotifier struct {
+	Notifier
+	cfg    RetryConfig
+	logger *logger.Logger
+}
+
+func withRetries(notifier Notifier, cfg RetryConfig, appLogger *logger.Logger) Notifier {
+	if cfg.MaxAttempts <= 1 {
+		return notifier
+	}
+	return &retryingNotifier{Notifier: notifier, cfg: cfg, logger: appLogger}
+}
+
+func (r *retryingNotifier) Send(ctx context.Context, n *Notification) error {
+	backoff := r.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		err := r.Notifier.Send(ctx, n)
+		if err == nil || isPermanent(err) || attempt >= r.cfg.MaxAttempts {
+			return err
+		}
+
+		r.logger.Warn(ctx, "Notification failed, retrying",
+			"channel", r.Channel(), "attempt", attempt, "backoff", backoff.String(), "error", err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		}
+		backoff *= 2
+		if backoff > r.cfg.MaxBackoff {
+			backoff = r.cfg.MaxBackoff
+		}
+	}
+}
+
+// metadataChannelsKey is the key of the message metadata that overrides the
+// routes of its notifications, as a list or a comma-separated string
+const metadataChannelsKey = "notify_channels"
+
+// Routes maps a status to the channels notified about it; the "default"
+// entry applies to the statuses not listed
+type Routes map[string][]string
+
+// defaultRoutes sends every status update to the log channel
+var defaultRoutes = Routes{"default": {"log"}}
+
+// Notifiers holds the configured channels and picks the ones a
+// notification goes to
+type Notifiers struct {
+	channels map[string]Notifier
+	routes   Routes
+}
+
+// newNotifiers checks that every routed channel is configured
+func newNotifiers(routes Routes, notifiers ...Notifier) (*Notifiers, error) {
+	s := &Notifiers{channels: make(map[string]Notifier, len(notifiers)), routes: routes}
+	for _, notifier := range notifiers {
+		s.channels[notifier.Channel()] = notifier
+	}
+	for status, channels := range routes {
+		for _, channel := range channels {
+			if _, ok := s.channels[channel]; !ok {
+				return nil, fmt.Errorf("route %q uses channel %q, which is not configured (configured: %s)", status, channel, strings.Join(s.Channels(), ", "))
+			}
+		}
+	}
+	return s, nil
+}
+
+// Channels returns the names of the configured channels
+func (s *Notifiers) Channels() []string {
+	names := make([]string, 0, len(s.channels))
+	for name := range s.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the notifier of channel
+func (s *Notifiers) Get(channel string) (Notifier, bool) {
+	notifier, ok := s.channels[channel]
+	return notifier, ok
+}
+
+// Route returns the notifiers of n: the channels listed in the message
+// metadata, if any, otherwise the route of its status. Channels that are
+// not configured are returned in unknown
+func (s *Notifiers) Route(n *Notification) (notifiers []Notifier, unknown []string) {
+	channels, ok := metadataChannels(n.Metadata)
+	if !ok {
+		channels, ok = s.routes[n.Status]
+		if !ok {
+			channels = s.routes["default"]
+		}
+	}
+	for _, channel := range channels {
+		notifier, ok := s.channels[channel]
+		if !ok {
+			unknown = append(unknown, channel)
+			continue
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, unknown
+}
+
+func metadataChannels(metadata map[string]interface{}) ([]string, bool) {
+	var channels []string
+	switch value := metadata[metadataChannelsKey].(type) {
+	case string:
+		channels = strings.Split(value, ",")
+	case []interface{}:
+		for _, item := range value {
+			channels = append(channels, fmt.Sprint(item))
+		}
+	default:
+		return nil, false
+	}
+	for i := range channels {
+		channels[i] = strings.TrimSpace(channels[i])
+	}
+	return channels, true
+}
+
+// routesFromEnv reads NOTIFY_ROUTES, a JSON object mapping statuses to
+// channels, such as {"failed": ["email", "slack"], "default": ["webhook"]}
+func routesFromEnv() (Routes, error) {
+	value := os.Getenv("NOTIFY_ROUTES")
+	if value == "" {
+		return defaultRoutes, nil
+	}
+	var routes Routes
+	if err := json.Unmarshal([]byte(value), &routes); err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_ROUTES: %w", err)
+	}
+	return routes, nil
+}
+
+// notifiersFromEnv builds the channels configured in the environment and
+// their routes. The log and slack channels are always available; webhook is
+// enabled by NOTIFY_WEBHOOK_URL or NOTIFY_WEBHOOK_SECRET and email by
+// NOTIFY_SMTP_ADDR. The URLs and NOTIFY_SMTP_TO are the default addresses,
+// used by routes and by subscriptions without an address. Every channel but
+// webhook, which has its own retries, is retried as set by retryConfigFromEnv
+func notifiersFromEnv(deliveries database.DeliveryLog, workload *simulation.Simulator, appLogger *logger.Logger) (*Notifiers, error) {
+	retry := retryConfigFromEnv()
+	notifiers := []Notifier{
+		withRetries(&logNotifier{workload: workload, logger: appLogger}, retry, appLogger),
+		withRetries(newSlackNotifier(os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"), getDurationEnv("NOTIFY_SLACK_TIMEOUT", 5*time.Second)), retry, appLogger),
+	}
+
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" || os.Getenv("NOTIFY_WEBHOOK_SECRET") != "" {
+		webhook, err := newWebhookNotifier(webhookConfigFromEnv(url), deliveries, appLogger)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, webhook)
+	}
+	if addr := os.Getenv("NOTIFY_SMTP_ADDR"); addr != "" {
+		email, err := newEmailNotifier(EmailConfig{
+			Addr:     addr,
+			From:     os.Getenv("NOTIFY_SMTP_FROM"),
+			To:       splitList(os.Getenv("NOTIFY_SMTP_TO")),
+			Username: os.Getenv("NOTIFY_SMTP_USERNAME"),
+			Password: os.Getenv("NOTIFY_SMTP_PASSWORD"),
+			Timeout:  getDurationEnv("NOTIFY_SMTP_TIMEOUT", 10*time.Second),
+		})
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, withRetries(email, retry, appLogger))
+	}
+
+	routes, err := routesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return newNotifiers(routes, notifiers...)
+}
+
+// webhookConfigFromEnv reads NOTIFY_WEBHOOK_SECRET, NOTIFY_WEBHOOK_TIMEOUT,
+// NOTIFY_WEBHOOK_MAX_ATTEMPTS, NOTIFY_WEBHOOK_BACKOFF and
+// NOTIFY_WEBHOOK_MAX_BACKOFF
+func webhookConfigFromEnv(url string) WebhookConfig {
+	return WebhookConfig{
+		URL:         url,
+		Secret:      os.Getenv("NOTIFY_WEBHOOK_SECRET"),
+		Timeout:     getDurationEnv("NOTIFY_WEBHOOK_TIMEOUT", 5*time.Second),
+		MaxAttempts: int(getIntEnv("NOTIFY_WEBHOOK_MAX_ATTEMPTS", 5)),
+		Backoff:     getDurationEnv("NOTIFY_WEBHOOK_BACKOFF", 500*time.Millisecond),
+		MaxBackoff:  getDurationEnv("NOTIFY_WEBHOOK_MAX_BACKOFF", 10*time.Second),
+	}
+}
+
+// retryConfigFromEnv reads NOTIFY_RETRY_MAX_ATTEMPTS, NOTIFY_RETRY_BACKOFF and
+// NOTIFY_RETRY_MAX_BACKOFF
+func retryConfigFromEnv() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: int(getIntEnv("NOTIFY_RETRY_MAX_ATTEMPTS", 3)),
+		Backoff:     getDurationEnv("NOTIFY_RETRY_BACKOFF", time.Second),
+		MaxBackoff:  getDurationEnv("NOTIFY_RETRY_MAX_BACKOFF", 10*time.Second),
+	}
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// logNotifier only logs the notification, after running the simulated
+// workload of sending it
+type logNotifier struct {
+	workload *simulation.Simulator
+	logger   *logger.Logger
+}
+
+func (l *logNotifier) Channel() string { return "log" }
+
+func (l *logNotifier) Send(ctx context.Context, n *Notification) error {
+	l.logger.Info(ctx, "Sending notification", "status", n.Status, "template", n.Template, "subject", n.Subject)
+	err := l.workload.Run(ctx)
+	if errors.Is(err, simulation.ErrPermanentFailure) {
+		return permanent(err)
+	}
+	return err
+}
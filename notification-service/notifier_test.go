@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeNotifier returns errs in turn, then nil
+type fakeNotifier struct {
+	errs  []error
+	sends int
+}
+
+func (f *fakeNotifier) Channel() string { return "fake" }
+
+func (f *fakeNotifier) Send(ctx context.Context, n *Notification) error {
+	f.sends++
+	if f.sends > len(f.errs) {
+		return nil
+	}
+	return f.errs[f.sends-1]
+}
+
+func TestRetryingNotifier(t *testing.T) {
+	errTransient := errors.New("connection reset")
+	errRejected := permanent(errors.New("recipient rejected"))
+
+	tests := []struct {
+		name          string
+		errs          []error
+		cancel        bool
+		wantErr       error
+		wantPermanent bool
+		wantSends     int
+	}{
+		{name: "sent", wantSends: 1},
+		{name: "transient then sent", errs: []error{errTransient, errTransient}, wantSends: 3},
+		{name: "permanent", errs: []error{errRejected}, wantErr: errRejected, wantPermanent: true, wantSends: 1},
+		{name: "transient then permanent", errs: []error{errTransient, errRejected}, wantErr: errRejected, wantPermanent: true, wantSends: 2},
+		{name: "attempts exhausted", errs: []error{errTransient, errTransient, errTransient, errTransient}, wantErr: errTransient, wantSends: 3},
+		{name: "cancelled during backoff", errs: []error{errTransient}, cancel: true, wantErr: context.Canceled, wantSends: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeNotifier{errs: tt.errs}
+			notifier := withRetries(fake, RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}, testLogger())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			err := notifier.Send(ctx, testNotification())
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Send() error = %v, want %v", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+			if fake.sends != tt.wantSends {
+				t.Errorf("got %d sends, want %d", fake.sends, tt.wantSends)
+			}
+			if notifier.Channel() != "fake" {
+				t.Errorf("Channel() = %q, want the wrapped channel", notifier.Channel())
+			}
+		})
+	}
+}
+
+func TestRetryingNotifierSlack(t *testing.T) {
+	server := newTestServer(t, time.Second, http.StatusServiceUnavailable, http.StatusOK)
+	slack := withRetries(newSlackNotifier(server.URL, time.Second), RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}, testLogger())
+
+	if err := slack.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if requests := server.received(); len(requests) != 2 {
+		t.Errorf("got %d requests, want 2", len(requests))
+	}
+}
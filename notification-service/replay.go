@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+// runReplayCommand implements the "replay" subcommand, which delivers again
+// the webhook notifications whose last attempt was not delivered:
+//
+//	replay [-since 24h] [-quiet 1m] [-limit 100] [-id DELIVERY_ID]
+//
+// Each replay gets the retries of a regular delivery and is recorded in
+// notification_deliveries under the same delivery ID
+func runReplayCommand(ctx context.Context, store database.DeliveryLog, appLogger *logger.Logger, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(out)
+	since := flags.Duration("since", 24*time.Hour, "replay deliveries last attempted within this period")
+	quiet := flags.Duration("quiet", time.Minute, "skip deliveries attempted more recently, which may still be retrying")
+	limit := flags.Int("limit", 100, "maximum number of deliveries to replay")
+	deliveryID := flags.String("id", "", "replay only this delivery")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	webhook, err := newWebhookNotifier(webhookConfigFromEnv(os.Getenv("NOTIFY_WEBHOOK_URL")), store, appLogger)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	deliveries, err := store.FindFailedDeliveries(ctx, database.FailedDeliveryCriteria{
+		DeliveryID: *deliveryID,
+		Since:      now.Add(-*since),
+		Until:      now.Add(-*quiet),
+		Limit:      *limit,
+	})
+	if err != nil {
+		return err
+	}
+	if len(deliveries) == 0 {
+		fmt.Fprintln(out, "no failed deliveries to replay")
+		return nil
+	}
+
+	failed := 0
+	for _, delivery := range deliveries {
+		if err := webhook.Replay(ctx, delivery); err != nil {
+			failed++
+			fmt.Fprintf(out, "%s %s: failed again: %v\n", delivery.DeliveryID, delivery.IdempotencyID, err)
+			continue
+		}
+		fmt.Fprintf(out, "%s %s: delivered\n", delivery.DeliveryID, delivery.IdempotencyID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deliveries failed again", failed, len(deliveries))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+// target is a notification to send through one notifier
+type target struct {
+	notifier     Notifier
+	notification *Notification
+}
+
+// resolveTargets fans n out to the channels routed by status and to every
+// subscriber of the status update. Subscribers in their quiet hours are
+// skipped; opt-outs are applied by ResolveSubscribers
+func resolveTargets(ctx context.Context, subscriptions database.SubscriptionStore, notifiers *Notifiers, n *Notification, appLogger *logger.Logger) ([]target, error) {
+	var targets []target
+
+	routed, unknown := notifiers.Route(n)
+	if len(unknown) > 0 {
+		appLogger.Warn(ctx, "Skipping channels that are not configured", "channels", strings.Join(unknown, ","))
+	}
+	for _, notifier := range routed {
+		targets = append(targets, target{notifier: notifier, notification: n})
+	}
+
+	subscribers, err := subscriptions.ResolveSubscribers(ctx, database.SubscriberQuery{
+		Status:        n.Status,
+		CorrelationID: n.CorrelationID,
+		Metadata:      n.Metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve subscribers: %w", err)
+	}
+
+	now := time.Now()
+	for _, subscriber := range subscribers {
+		recipientID, channel := subscriber.Recipient.ID, subscriber.Subscription.Channel
+		if subscriber.Recipient.InQuietHours(now) {
+			appLogger.Info(ctx, "Recipient in quiet hours, skipping notification", "recipient_id", recipientID, "channel", channel)
+			continue
+		}
+		notifier, ok := notifiers.Get(channel)
+		if !ok {
+			appLogger.Warn(ctx, "Subscription uses a channel that is not configured", "recipient_id", recipientID, "channel", channel)
+			continue
+		}
+		targets = append(targets, target{notifier: notifier, notification: n.forSubscriber(subscriber)})
+	}
+	return targets, nil
+}
+
+// runSubscriptionsCommand implements the "subscriptions" subcommand:
+//
+//	subscriptions apply FILE              create or update the recipients in FILE (JSON)
+//	subscriptions list [RECIPIENT]        print recipients and subscriptions as JSON
+//	subscriptions opt-out RECIPIENT [CHANNEL]
+//	subscriptions opt-in RECIPIENT [CHANNEL]
+//
+// apply replaces the subscriptions of each recipient in FILE and keeps its
+// opt-outs. Without CHANNEL, opt-out and opt-in apply to every channel
+func runSubscriptionsCommand(ctx context.Context, store database.SubscriptionStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subscriptions command (supported: apply FILE, list [RECIPIENT], opt-out RECIPIENT [CHANNEL], opt-in RECIPIENT [CHANNEL])")
+	}
+
+	switch command := args[0]; command {
+	case "apply":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: subscriptions apply FILE")
+		}
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", args[1], err)
+		}
+		var recipients []database.Recipient
+		if err := json.Unmarshal(data, &recipients); err != nil {
+			return fmt.Errorf("invalid recipients file %s: %w", args[1], err)
+		}
+		for i := range recipients {
+			if err := store.SaveRecipient(ctx, &recipients[i]); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "saved %s (%d subscriptions)\n", recipients[i].ID, len(recipients[i].Subscriptions))
+		}
+		return nil
+
+	case "list":
+		recipientID := ""
+		if len(args) > 1 {
+			recipientID = args[1]
+		}
+		recipients, err := store.ListRecipients(ctx, recipientID)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(recipients)
+
+	case "opt-out", "opt-in":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: subscriptions %s RECIPIENT [CHANNEL]", command)
+		}
+		channel := ""
+		if len(args) > 2 {
+			channel = args[2]
+		}
+		if err := store.SetOptOut(ctx, args[1], channel, command == "opt-out"); err != nil {
+			return err
+		}
+		if channel == "" {
+			channel = "all channels"
+		}
+		fmt.Fprintf(out, "%s: %s %s\n", args[1], command, channel)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown subscriptions command %q (supported: apply, list, opt-out, opt-in)", command)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+// builtinTemplates are the default templates; the files of
+// NOTIFY_TEMPLATES_DIR override them
+//
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// Template files are named CHANNEL.STATUS[.LOCALE].tmpl (text/template) or
+// CHANNEL.STATUS[.LOCALE].html (html/template), such as
+// email.failed.pt-BR.html; "default" as channel or status matches any.
+// Text templates define "subject" and "body". HTML templates define "body",
+// sent by the email channel as an alternative to the text
+const (
+	templateTextExt = ".tmpl"
+	templateHTMLExt = ".html"
+	templateAny     = "default"
+)
+
+// metadataLocaleKey is the key of the message metadata that sets the locale
+// of the notifications not sent to a subscriber
+const metadataLocaleKey = "locale"
+
+// TemplateData is what the templates are executed with
+type TemplateData struct {
+	Channel string
+	Locale  string
+
+	EventID       string
+	EventType     string
+	IdempotencyID string
+	CorrelationID string
+	Status        string
+	ReasonCode    string
+	Timestamp     string
+
+	// Payload is the stored payload of the message and Metadata its
+	// metadata; both are nil when the message is not stored
+	Payload  map[string]interface{}
+	Metadata map[string]interface{}
+	// History is the status history of the message, oldest first
+	History []database.MessageHistory
+
+	// Recipient is nil for the channels routed by status
+	Recipient *database.Recipient
+
+	// Digest lists the notifications of a digest, whose status is "digest"
+	Digest []database.DigestItem
+}
+
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// templateSet is one parsed generation of the templates, keyed by file name
+// without extension, lower-cased
+type templateSet struct {
+	text    map[string]*template.Template
+	html    map[string]*htmltemplate.Template
+	sources map[string]string
+}
+
+func parseTemplates(dir string) (*templateSet, error) {
+	set := &templateSet{
+		text:    make(map[string]*template.Template),
+		html:    make(map[string]*htmltemplate.Template),
+		sources: make(map[string]string),
+	}
+	if err := set.add(builtinTemplates, "templates", "builtin"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := set.add(os.DirFS(dir), ".", dir); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// add parses the template files of root, replacing those of the same name.
+// Hidden files are skipped, such as the "..data" links of a mounted ConfigMap
+func (s *templateSet) add(fsys fs.FS, root, source string) error {
+	entries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return fmt.Errorf("failed to read templates from %s: %w", source, err)
+	}
+	for _, entry := range entries {
+		name, ext := entry.Name(), path.Ext(entry.Name())
+		if strings.HasPrefix(name, ".") || (ext != templateTextExt && ext != templateHTMLExt) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSuffix(name, ext))
+		if parts := strings.Split(key, "."); len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("invalid template name %s (expected CHANNEL.STATUS[.LOCALE]%s)", name, ext)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(root, name))
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %w", name, err)
+		}
+
+		if ext == templateTextExt {
+			t, err := template.New(name).Funcs(templateFuncs).Parse(string(data))
+			if err != nil {
+				return fmt.Errorf("invalid template %s: %w", name, err)
+			}
+			if t.Lookup("subject") == nil || t.Lookup("body") == nil {
+				return fmt.Errorf("template %s must define \"subject\" and \"body\"", name)
+			}
+			s.text[key] = t
+		} else {
+			t, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(string(data))
+			if err != nil {
+				return fmt.Errorf("invalid template %s: %w", name, err)
+			}
+			if t.Lookup("body") == nil {
+				return fmt.Errorf("template %s must define \"body\"", name)
+			}
+			s.html[key] = t
+		}
+		s.sources[name] = source
+	}
+	return nil
+}
+
+// templateKeys lists the keys that may render a notification, most specific
+// first. The locale matters most: a template in the language of the
+// recipient is preferred to one more specific in another language. Digests
+// only use digest templates, which list their notifications
+func templateKeys(channel, status, locale, defaultLocale string) []string {
+	var locales []string
+	seen := make(map[string]bool)
+	for _, l := range []string{locale, defaultLocale} {
+		l = strings.ToLower(l)
+		candidates := []string{l}
+		if i := strings.IndexByte(l, '-'); i > 0 {
+			candidates = append(candidates, l[:i])
+		}
+		for _, candidate := range candidates {
+			if candidate != "" && !seen[candidate] {
+				seen[candidate] = true
+				locales = append(locales, candidate)
+			}
+		}
+	}
+	locales = append(locales, "")
+	statuses := []string{status}
+	if status != digestStatus {
+		statuses = append(statuses, templateAny)
+	}
+
+	var keys []string
+	for _, l := range locales {
+		for _, c := range []string{channel, templateAny} {
+			for _, s := range statuses {
+				key := c + "." + s
+				if l != "" {
+					key += "." + l
+				}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Templates renders notifications with the builtin templates and those of a
+// directory, reloaded when its files change
+type Templates struct {
+	dir           string
+	defaultLocale string
+
+	mu          sync.RWMutex
+	set         *templateSet
+	fingerprint string
+}
+
+// loadTemplates parses the builtin templates and those of dir, if not empty
+func loadTemplates(dir, defaultLocale string) (*Templates, error) {
+	t := &Templates{dir: dir, defaultLocale: defaultLocale}
+	if _, err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// templatesFromEnv reads NOTIFY_TEMPLATES_DIR and NOTIFY_DEFAULT_LOCALE (en)
+func templatesFromEnv() (*Templates, error) {
+	return loadTemplates(os.Getenv("NOTIFY_TEMPLATES_DIR"), getEnv("NOTIFY_DEFAULT_LOCALE", "en"))
+}
+
+// Reload parses the templates again if the files of the directory changed.
+// If they do not parse, the templates in use are kept and the same files are
+// not parsed again
+func (t *Templates) Reload() (bool, error) {
+	fingerprint, err := fingerprintDir(t.dir)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	if t.set != nil && fingerprint == t.fingerprint {
+		t.mu.Unlock()
+		return false, nil
+	}
+	t.fingerprint = fingerprint
+	t.mu.Unlock()
+
+	set, err := parseTemplates(t.dir)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	t.set = set
+	t.mu.Unlock()
+	return true, nil
+}
+
+// fingerprintDir summarizes the names, sizes and modification times of the
+// files of dir. Links are followed, so a ConfigMap update changes it
+func fingerprintDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read templates from %s: %w", dir, err)
+	}
+	var fingerprint strings.Builder
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return "", fmt.Errorf("failed to stat template %s: %w", entry.Name(), err)
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return fingerprint.String(), nil
+}
+
+// Watch reloads the templates every interval until ctx is done. It returns
+// at once when there is no template directory
+func (t *Templates) Watch(ctx context.Context, interval time.Duration, appLogger *logger.Logger) {
+	if t.dir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := t.Reload()
+			if err != nil {
+				appLogger.Error(ctx, "Failed to reload notification templates, keeping the previous ones", err, "dir", t.dir)
+				continue
+			}
+			if reloaded {
+				appLogger.Info(ctx, "Notification templates reloaded", "dir", t.dir)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sources maps the file name of every template in use to where it was
+// loaded from ("builtin" or the directory)
+func (t *Templates) Sources() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.set.sources
+}
+
+// Locale returns the locale of n: the locale of its recipient, else the
+// locale in the message metadata, else the default locale
+func (t *Templates) Locale(n *Notification) string {
+	if n.Recipient != nil && n.Recipient.Locale != "" {
+		return n.Recipient.Locale
+	}
+	if locale, _ := n.Metadata[metadataLocaleKey].(string); locale != "" {
+		return locale
+	}
+	return t.defaultLocale
+}
+
+// Render returns a copy of n with the subject, text and HTML of the
+// templates of channel, the status and the locale of n
+func (t *Templates) Render(channel string, n *Notification) (*Notification, error) {
+	t.mu.RLock()
+	set := t.set
+	t.mu.RUnlock()
+
+	locale := t.Locale(n)
+	data := n.templateData(channel, locale)
+	keys := templateKeys(channel, n.Status, locale, t.defaultLocale)
+	rendered := *n
+
+	var text *template.Template
+	for _, key := range keys {
+		if text = set.text[key]; text != nil {
+			break
+		}
+	}
+	if text == nil {
+		return nil, fmt.Errorf("no template for channel %s, status %s, locale %s", channel, n.Status, locale)
+	}
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", text.Name(), err)
+	}
+	if err := text.ExecuteTemplate(&body, "body", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", text.Name(), err)
+	}
+	rendered.Template = text.Name()
+	rendered.Subject = strings.TrimSpace(subject.String())
+	rendered.Text = body.String()
+	rendered.HTML = ""
+
+	for _, key := range keys {
+		html := set.html[key]
+		if html == nil {
+			continue
+		}
+		var body bytes.Buffer
+		if err := html.ExecuteTemplate(&body, "body", data); err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", html.Name(), err)
+		}
+		rendered.HTML = body.String()
+		break
+	}
+	return &rendered, nil
+}
+
+// runTemplatesCommand implements the "templates" subcommand:
+//
+//	templates list                 print the templates in use and their source
+//	templates preview [flags]      render a notification without sending it
+//
+// preview renders the stored message given by -id, with its history, or
+// sample data without -id
+func runTemplatesCommand(ctx context.Context, store database.MessageStore, subscriptions database.SubscriptionStore, templates *Templates, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing templates command (supported: list, preview)")
+	}
+
+	switch command := args[0]; command {
+	case "list":
+		sources := templates.Sources()
+		names := make([]string, 0, len(sources))
+		for name := range sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s\t%s\n", name, sources[name])
+		}
+		return nil
+
+	case "preview":
+		flags := flag.NewFlagSet("templates preview", flag.ContinueOnError)
+		flags.SetOutput(out)
+		channel := flags.String("channel", "log", "channel to render for")
+		status := flags.String("status", "", "status of the update (default: the status of the message, or failed for sample data)")
+		idempotencyID := flags.String("id", "", "render the stored message with this idempotency ID instead of sample data")
+		recipientID := flags.String("recipient", "", "render for this recipient")
+		locale := flags.String("locale", "", "locale to render in, instead of the one of the recipient or message")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		n, err := previewNotification(ctx, store, *idempotencyID, *status)
+		if err != nil {
+			return err
+		}
+		if *recipientID != "" {
+			recipients, err := subscriptions.ListRecipients(ctx, *recipientID)
+			if err != nil {
+				return err
+			}
+			if len(recipients) == 0 {
+				return fmt.Errorf("%w: %s", database.ErrRecipientNotFound, *recipientID)
+			}
+			n.Recipient = &recipients[0]
+		}
+		if *locale != "" {
+			n = withLocale(n, *locale)
+		}
+
+		rendered, err := templates.Render(*channel, n)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Template: %s\nLocale: %s\nSubject: %s\n\n%s", rendered.Template, templates.Locale(n), rendered.Subject, rendered.Text)
+		if rendered.HTML != "" {
+			fmt.Fprintf(out, "\n--- HTML ---\n%s", rendered.HTML)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown templates command %q (supported: list, preview)", command)
+	}
+}
+
+// previewNotification builds the notification of a status update of the
+// stored message idempotencyID, or of a sample message if empty
+func previewNotification(ctx context.Context, store database.MessageStore, idempotencyID, status string) (*Notification, error) {
+	if idempotencyID == "" {
+		if status == "" {
+			status = "failed"
+		}
+		event := contracts.NewEvent(topicIn, "sample-correlation-id", "sample-idempotency-id", serviceName,
+			map[string]interface{}{"status": status, "reason_code": "SAMPLE_REASON"})
+		payload := map[string]interface{}{
+			"content":  "sample content",
+			"metadata": map[string]interface{}{"source": "preview"},
+		}
+		history := []database.MessageHistory{
+			{IdempotencyID: event.IdempotencyID, CorrelationID: event.CorrelationID, Status: "received", ServiceName: "api-gateway", Accepted: true, CreatedAt: time.Now().Add(-time.Minute)},
+			{IdempotencyID: event.IdempotencyID, CorrelationID: event.CorrelationID, Status: status, ServiceName: "message-processor", Accepted: true, CreatedAt: time.Now()},
+		}
+		return newNotification(event, status, payload, history), nil
+	}
+
+	msg, err := store.GetMessage(ctx, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.GetMessageHistory(ctx, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		status = msg.Status
+	}
+	event := contracts.NewEvent(topicIn, msg.CorrelationID, msg.IdempotencyID, serviceName, map[string]interface{}{"status": status})
+	return newNotification(event, status, msg.Payload, history), nil
+}
+
+// withLocale returns a copy of n rendered in locale: the locale of its
+// recipient, or of its message metadata when it has no recipient
+func withLocale(n *Notification, locale string) *Notification {
+	localized := *n
+	if n.Recipient != nil {
+		recipient := *n.Recipient
+		recipient.Locale = locale
+		localized.Recipient = &recipient
+		return &localized
+	}
+	localized.Metadata = make(map[string]interface{}, len(n.Metadata)+1)
+	for key, value := range n.Metadata {
+		localized.Metadata[key] = value
+	}
+	localized.Metadata[metadataLocaleKey] = locale
+	return &localized
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/metrics"
+)
+
+// Reasons a notification is added to a digest instead of sent
+const (
+	deferDigest      = "digest"
+	deferRateLimited = "rate_limited"
+)
+
+// digestStatus is the status of the templates of digests, such as
+// email.digest.pt-BR.tmpl; their data lists the notifications in .Digest
+const digestStatus = "digest"
+
+// digestEventType is the event type of digest notifications
+const digestEventType = "notification.digest"
+
+// digestBatchSize caps the digests claimed per flush
+const digestBatchSize = 50
+
+// rateLimitConfig is a limit of NOTIFY_RATE_LIMITS
+type rateLimitConfig struct {
+	Limit  int    `json:"limit"`
+	Window string `json:"window"`
+}
+
+// rateLimitsConfig is NOTIFY_RATE_LIMITS: the limit of each recipient,
+// across channels, and of each channel, across recipients
+type rateLimitsConfig struct {
+	Recipient *rateLimitConfig           `json:"recipient,omitempty"`
+	Channels  map[string]rateLimitConfig `json:"channels,omitempty"`
+}
+
+func (c rateLimitConfig) rateLimit(key string) (database.RateLimit, error) {
+	window, err := time.ParseDuration(c.Window)
+	if err != nil || window < time.Second || c.Limit < 1 {
+		return database.RateLimit{}, fmt.Errorf("invalid rate limit %s: %d per %q (expected a positive limit per a window of at least 1s)", key, c.Limit, c.Window)
+	}
+	return database.RateLimit{Key: key, Limit: c.Limit, Window: window}, nil
+}
+
+// Throttle applies the rate limits and digests of notifications. Over a
+// limit, notifications are not dropped: they join a digest sent when the
+// window of the limit ends. The counters and digests are kept in PostgreSQL,
+// so they hold across replicas
+type Throttle struct {
+	store      database.ThrottleStore
+	recipients database.SubscriptionStore
+
+	// recipient has an empty key, set per recipient
+	recipient *database.RateLimit
+	channels  map[string]database.RateLimit
+
+	// digestLease bounds the time to send a digest before another replica
+	// may claim it
+	digestLease time.Duration
+}
+
+// throttleFromEnv reads NOTIFY_RATE_LIMITS, a JSON object such as
+// {"recipient": {"limit": 10, "window": "1m"}, "channels": {"slack": {"limit": 30, "window": "1m"}}},
+// and NOTIFY_DIGEST_LEASE (2m). Without NOTIFY_RATE_LIMITS only the digests
+// of subscriptions apply
+func throttleFromEnv(store database.ThrottleStore, recipients database.SubscriptionStore) (*Throttle, error) {
+	t := &Throttle{
+		store:       store,
+		recipients:  recipients,
+		channels:    make(map[string]database.RateLimit),
+		digestLease: getDurationEnv("NOTIFY_DIGEST_LEASE", 2*time.Minute),
+	}
+	value := os.Getenv("NOTIFY_RATE_LIMITS")
+	if value == "" {
+		return t, nil
+	}
+
+	var cfg rateLimitsConfig
+	if err := json.Unmarshal([]byte(value), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_RATE_LIMITS: %w", err)
+	}
+	if cfg.Recipient != nil {
+		limit, err := cfg.Recipient.rateLimit("recipient")
+		if err != nil {
+			return nil, err
+		}
+		t.recipient = &limit
+	}
+	for channel, c := range cfg.Channels {
+		limit, err := c.rateLimit("channel:" + channel)
+		if err != nil {
+			return nil, err
+		}
+		t.channels[channel] = limit
+	}
+	return t, nil
+}
+
+// limits returns the rate limits that apply to n sent through channel
+func (t *Throttle) limits(channel string, n *Notification) []database.RateLimit {
+	var limits []database.RateLimit
+	if t.recipient != nil && n.Recipient != nil {
+		limit := *t.recipient
+		limit.Key = "recipient:" + n.Recipient.ID
+		limits = append(limits, limit)
+	}
+	if limit, ok := t.channels[channel]; ok {
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+// Dispatch sends n through notifier, unless its subscription digests
+// notifications or a rate limit was reached: then n is added to a digest and
+// deferred names the reason
+func (t *Throttle) Dispatch(ctx context.Context, notifier Notifier, n *Notification) (deferred string, err error) {
+	channel := notifier.Channel()
+	if n.DigestWindow > 0 {
+		return deferDigest, t.addToDigest(ctx, channel, n, n.DigestWindow)
+	}
+
+	if limits := t.limits(channel, n); len(limits) > 0 {
+		exceeded, err := t.store.AcquireRateLimits(ctx, limits)
+		if err != nil {
+			return "", err
+		}
+		if exceeded != nil {
+			return deferRateLimited, t.addToDigest(ctx, channel, n, exceeded.RetryAfter)
+		}
+	}
+	return "", notifier.Send(ctx, n)
+}
+
+// addToDigest adds the rendered n to the digest of its channel, recipient
+// and address, due after delay if it is a new digest
+func (t *Throttle) addToDigest(ctx context.Context, channel string, n *Notification, delay time.Duration) error {
+	recipientID := ""
+	if n.Recipient != nil {
+		recipientID = n.Recipient.ID
+	}
+	return t.store.AddDigestItem(ctx,
+		&database.Digest{
+			Key:         database.DigestKey(channel, recipientID, n.Address),
+			RecipientID: n.recipientID(),
+			Channel:     channel,
+			Address:     n.Address,
+		},
+		&database.DigestItem{
+			IdempotencyID: n.IdempotencyID,
+			CorrelationID: n.CorrelationID,
+			Status:        n.Status,
+			Subject:       n.Subject,
+			Text:          n.Text,
+		},
+		delay,
+	)
+}
+
+// RunDigestFlusher sends the digests that are due every interval until ctx
+// is done. Replicas share the work: each digest is leased by one of them
+func (t *Throttle) RunDigestFlusher(ctx context.Context, notifiers *Notifiers, templates *Templates, interval time.Duration, appLogger *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			digests, err := t.store.ClaimDueDigests(ctx, t.digestLease, digestBatchSize)
+			if err != nil {
+				appLogger.Error(ctx, "Failed to claim due digests", err)
+				continue
+			}
+			for i := range digests {
+				t.flushDigest(ctx, &digests[i], notifiers, templates, appLogger)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushDigest sends a claimed digest. A digest that fails transiently, or
+// whose recipient is in quiet hours, is left to be claimed again when its
+// lease expires; one that cannot be delivered is dropped
+func (t *Throttle) flushDigest(ctx context.Context, d *database.Digest, notifiers *Notifiers, templates *Templates, appLogger *logger.Logger) {
+	drop := func(reason string) {
+		appLogger.Warn(ctx, "Dropping notification digest", "digest_key", d.Key, "items", len(d.Items), "reason", reason)
+		if err := t.store.CompleteDigest(ctx, d); err != nil {
+			appLogger.Error(ctx, "Failed to complete digest", err, "digest_key", d.Key)
+		}
+	}
+
+	notifier, ok := notifiers.Get(d.Channel)
+	if !ok {
+		drop("channel not configured")
+		return
+	}
+
+	var recipient *database.Recipient
+	if d.RecipientID != nil {
+		recipients, err := t.recipients.ListRecipients(ctx, *d.RecipientID)
+		if err != nil {
+			appLogger.Error(ctx, "Failed to load digest recipient", err, "digest_key", d.Key)
+			return
+		}
+		if len(recipients) == 0 {
+			drop("recipient removed")
+			return
+		}
+		recipient = &recipients[0]
+		if recipient.OptedOut || containsString(recipient.OptedOutChannels, d.Channel) {
+			drop("recipient opted out")
+			return
+		}
+		if recipient.InQuietHours(time.Now()) {
+			return
+		}
+	}
+
+	rendered, err := templates.Render(d.Channel, newDigestNotification(d, recipient))
+	if err != nil {
+		appLogger.Error(ctx, "Failed to render notification digest", err, "digest_key", d.Key)
+		drop("template failed")
+		return
+	}
+
+	start := time.Now()
+	err = notifier.Send(ctx, rendered)
+	metrics.ObserveNotification(d.Channel, start, err)
+	switch {
+	case err == nil:
+		appLogger.Info(ctx, "Notification digest sent", "channel", d.Channel, "digest_key", d.Key, "items", len(d.Items))
+	case isPermanent(err):
+		appLogger.Error(ctx, "Notification digest rejected", err, "channel", d.Channel, "digest_key", d.Key)
+	default:
+		appLogger.Error(ctx, "Failed to send notification digest, retrying after the lease", err,
+			"channel", d.Channel, "digest_key", d.Key, "lease", t.digestLease.String())
+		return
+	}
+	if err := t.store.CompleteDigest(ctx, d); err != nil {
+		appLogger.Error(ctx, "Failed to complete digest", err, "digest_key", d.Key)
+	}
+}
+
+// newDigestNotification builds the notification of a digest, with the
+// correlation ID its items share, if any
+func newDigestNotification(d *database.Digest, recipient *database.Recipient) *Notification {
+	correlationID := ""
+	for i, item := range d.Items {
+		if i > 0 && item.CorrelationID != correlationID {
+			correlationID = ""
+			break
+		}
+		correlationID = item.CorrelationID
+	}
+	return &Notification{
+		Event:         contracts.NewEvent(digestEventType, correlationID, "", serviceName, nil),
+		CorrelationID: correlationID,
+		Status:        digestStatus,
+		Recipient:     recipient,
+		Address:       d.Address,
+		Digest:        d.Items,
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
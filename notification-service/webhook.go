@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+// responseSnippetSize is how much of a response is kept in errors and in the
+// delivery log
+const responseSnippetSize = 512
+
+// Headers of a signed webhook request. The signature is the hex HMAC-SHA256,
+// with the webhook secret, of "<timestamp>.<body>"
+const (
+	HeaderWebhookID        = "X-Webhook-Id"
+	HeaderWebhookAttempt   = "X-Webhook-Attempt"
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+// WebhookConfig holds the settings of the webhook channel
+type WebhookConfig struct {
+	URL    string
+	Secret string
+
+	// Timeout bounds each attempt
+	Timeout time.Duration
+
+	// MaxAttempts caps the attempts of a delivery. Failed attempts are
+	// retried after Backoff, doubled on each retry up to MaxBackoff
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// WebhookNotifier posts notifications as signed JSON to a URL. Attempts are
+// retried with exponential backoff on timeouts, connection errors and 5xx,
+// stop on 4xx, and are recorded in notification_deliveries
+type WebhookNotifier struct {
+	cfg        WebhookConfig
+	client     *http.Client
+	deliveries database.DeliveryLog
+	logger     *logger.Logger
+}
+
+func newWebhookNotifier(cfg WebhookConfig, deliveries database.DeliveryLog, appLogger *logger.Logger) (*WebhookNotifier, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("the webhook channel requires NOTIFY_WEBHOOK_SECRET")
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	return &WebhookNotifier{cfg: cfg, client: &http.Client{}, deliveries: deliveries, logger: appLogger}, nil
+}
+
+func (w *WebhookNotifier) Channel() string { return "webhook" }
+
+// webhookPayload is the body posted by WebhookNotifier
+type webhookPayload struct {
+	EventID       string `json:"event_id"`
+	EventType     string `json:"event_type"`
+	IdempotencyID string `json:"idempotency_id"`
+	CorrelationID string `json:"correlation_id"`
+	Status        string `json:"status"`
+	ReasonCode    string `json:"reason_code,omitempty"`
+	Subject       string `json:"subject"`
+	Text          string `json:"text"`
+	Timestamp     string `json:"timestamp"`
+	// Digest lists the notifications of a digest
+	Digest []database.DigestItem `json:"digest,omitempty"`
+}
+
+func (w *WebhookNotifier) Send(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(webhookPayload{
+		EventID:       n.Event.EventID,
+		EventType:     n.Event.EventType,
+		IdempotencyID: n.IdempotencyID,
+		CorrelationID: n.CorrelationID,
+		Status:        n.Status,
+		ReasonCode:    n.ReasonCode,
+		Subject:       n.Subject,
+		Text:          n.Text,
+		Timestamp:     n.Event.Timestamp,
+		Digest:        n.Digest,
+	})
+	if err != nil {
+		return permanent(fmt.Errorf("failed to marshal webhook payload: %w", err))
+	}
+
+	url := n.Address
+	if url == "" {
+		url = w.cfg.URL
+	}
+	if url == "" {
+		return permanent(fmt.Errorf("no webhook URL: set NOTIFY_WEBHOOK_URL or the address of the subscription"))
+	}
+
+	return w.deliver(ctx, &database.NotificationDelivery{
+		DeliveryID:    newDeliveryID(),
+		IdempotencyID: n.IdempotencyID,
+		CorrelationID: n.CorrelationID,
+		EventID:       n.Event.EventID,
+		Channel:       w.Channel(),
+		RecipientID:   n.recipientID(),
+		URL:           url,
+		RequestBody:   body,
+	})
+}
+
+// Replay delivers again the request of a delivery that was not delivered,
+// continuing its attempt count
+func (w *WebhookNotifier) Replay(ctx context.Context, last database.NotificationDelivery) error {
+	return w.deliver(ctx, &last)
+}
+
+// deliver runs up to MaxAttempts attempts of d, recording each of them
+func (w *WebhookNotifier) deliver(ctx context.Context, d *database.NotificationDelivery) error {
+	backoff := w.cfg.Backoff
+	for i := 1; ; i++ {
+		d.Attempt++
+		response, err := w.attempt(ctx, d)
+
+		d.LatencyMs = float64(response.latency) / float64(time.Millisecond)
+		d.StatusCode, d.ResponseSnippet, d.ErrorMessage = nil, nil, nil
+		if response.statusCode != 0 {
+			d.StatusCode = &response.statusCode
+			d.ResponseSnippet = &response.snippet
+		}
+		switch {
+		case err == nil:
+			d.Outcome = database.DeliveryDelivered
+		case isPermanent(err):
+			d.Outcome = database.DeliveryRejected
+		default:
+			d.Outcome = database.DeliveryFailed
+		}
+		if err != nil {
+			errorMsg := err.Error()
+			d.ErrorMessage = &errorMsg
+		}
+
+		// The attempt is recorded even if ctx was cancelled meanwhile
+		if recordErr := w.deliveries.RecordDeliveryAttempt(context.WithoutCancel(ctx), d); recordErr != nil {
+			w.logger.Error(ctx, "Failed to record webhook delivery attempt", recordErr, "delivery_id", d.DeliveryID, "attempt", d.Attempt)
+		}
+
+		if d.Outcome != database.DeliveryFailed || i >= w.cfg.MaxAttempts {
+			return err
+		}
+
+		w.logger.Warn(ctx, "Webhook delivery failed, retrying",
+			"delivery_id", d.DeliveryID, "attempt", d.Attempt, "backoff", backoff.String(), "error", err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		}
+		backoff *= 2
+		if backoff > w.cfg.MaxBackoff {
+			backoff = w.cfg.MaxBackoff
+		}
+	}
+}
+
+// attempt posts the request of d once, signed for this attempt
+func (w *WebhookNotifier) attempt(ctx context.Context, d *database.NotificationDelivery) (httpResponse, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(HeaderWebhookID, d.DeliveryID)
+	header.Set(HeaderWebhookAttempt, strconv.Itoa(d.Attempt))
+	header.Set(HeaderWebhookTimestamp, timestamp)
+	header.Set(HeaderWebhookSignature, "sha256="+signWebhook(w.cfg.Secret, timestamp, d.RequestBody))
+	return post(ctx, w.client, d.URL, w.cfg.Timeout, header, d.RequestBody)
+}
+
+// signWebhook computes the signature of body sent at timestamp. Receivers
+// recompute it and reject old timestamps to stop replayed requests
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// SlackNotifier posts notifications to a Slack-compatible incoming webhook
+// (Slack, Mattermost, Rocket.Chat)
+type SlackNotifier struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func newSlackNotifier(url string, timeout time.Duration) *SlackNotifier {
+	return &SlackNotifier{url: url, timeout: timeout, client: &http.Client{}}
+}
+
+func (s *SlackNotifier) Channel() string { return "slack" }
+
+func (s *SlackNotifier) Send(ctx context.Context, n *Notification) error {
+	url := n.Address
+	if url == "" {
+		url = s.url
+	}
+	if url == "" {
+		return permanent(fmt.Errorf("no slack webhook URL: set NOTIFY_SLACK_WEBHOOK_URL or the address of the subscription"))
+	}
+
+	body, err := json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n%s", n.Subject, n.Text)})
+	if err != nil {
+		return permanent(fmt.Errorf("failed to marshal slack message: %w", err))
+	}
+	_, err = post(ctx, s.client, url, s.timeout, nil, body)
+	return err
+}
+
+// sanitizeSnippet makes a response body excerpt storable as text
+func sanitizeSnippet(snippet []byte) string {
+	text := strings.ToValidUTF8(string(snippet), "")
+	return strings.TrimSpace(strings.ReplaceAll(text, "\x00", ""))
+}
+
+// httpResponse is the outcome of a POST; statusCode is zero when no
+// response was received
+type httpResponse struct {
+	statusCode int
+	snippet    string
+	latency    time.Duration
+}
+
+// post sends body as JSON to url within timeout. Client errors (4xx other
+// than 408 and 429) are permanent; timeouts, connection errors and other
+// statuses are not
+func post(ctx context.Context, client *http.Client, url string, timeout time.Duration, header http.Header, body []byte) (httpResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return httpResponse{}, permanent(fmt.Errorf("failed to create request: %w", err))
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", serviceName)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return httpResponse{latency: time.Since(start)}, fmt.Errorf("failed to post to %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, responseSnippetSize))
+	io.Copy(io.Discard, resp.Body)
+	response := httpResponse{
+		statusCode: resp.StatusCode,
+		snippet:    sanitizeSnippet(snippet),
+		latency:    time.Since(start),
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return response, nil
+	}
+
+	err = fmt.Errorf("%s responded %s: %s", req.URL.Host, resp.Status, response.snippet)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return response, permanent(err)
+	}
+	return response, err
+}
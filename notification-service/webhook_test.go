@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+const testWebhookSecret = "test-secret"
+
+// fakeDeliveryLog keeps a copy of every attempt recorded
+type fakeDeliveryLog struct {
+	mu       sync.Mutex
+	attempts []database.NotificationDelivery
+}
+
+func (l *fakeDeliveryLog) RecordDeliveryAttempt(ctx context.Context, d *database.NotificationDelivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attempt := *d
+	if d.StatusCode != nil {
+		statusCode := *d.StatusCode
+		attempt.StatusCode = &statusCode
+	}
+	l.attempts = append(l.attempts, attempt)
+	return nil
+}
+
+func (l *fakeDeliveryLog) FindFailedDeliveries(ctx context.Context, criteria database.FailedDeliveryCriteria) ([]database.NotificationDelivery, error) {
+	return nil, nil
+}
+
+func (l *fakeDeliveryLog) GetMessageDeliveries(ctx context.Context, idempotencyID string) ([]database.NotificationDelivery, error) {
+	return nil, nil
+}
+
+func (l *fakeDeliveryLog) RecordNotificationOutcome(ctx context.Context, outcome *database.NotificationOutcome) error {
+	return nil
+}
+
+func (l *fakeDeliveryLog) ListNotificationOutcomes(ctx context.Context, eventID string) ([]database.NotificationOutcome, error) {
+	return nil, nil
+}
+
+// receivedRequest is a request seen by a test server
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// testServer answers the requests it receives with statuses, in order,
+// repeating the last one; a zero status sleeps past the client timeout
+// instead
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	sleep    time.Duration
+	requests []receivedRequest
+}
+
+func newTestServer(t *testing.T, sleep time.Duration, statuses ...int) *testServer {
+	s := &testServer{statuses: statuses, sleep: sleep}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, receivedRequest{header: r.Header.Clone(), body: body, at: time.Now()})
+		status := s.statuses[min(len(s.requests), len(s.statuses))-1]
+		s.mu.Unlock()
+
+		if status == 0 {
+			select {
+			case <-time.After(s.sleep):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) received() []receivedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedRequest(nil), s.requests...)
+}
+
+func testNotification() *Notification {
+	event := contracts.NewEvent(contracts.EventTypeMessageStatusUpdated, "corr-1", "idem-1", "message-processor",
+		map[string]interface{}{"idempotency_id": "idem-1", "status": "failed"})
+	n := newNotification(event, "failed", nil, nil)
+	n.Subject = "Message failed"
+	n.Text = "Message idem-1 failed"
+	return n
+}
+
+func testLogger() *logger.Logger {
+	return logger.New(serviceName, logger.Config{Writer: io.Discard})
+}
+
+func TestPostClassification(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{"ok", http.StatusOK, false, false},
+		{"no content", http.StatusNoContent, false, false},
+		{"bad request", http.StatusBadRequest, true, true},
+		{"not found", http.StatusNotFound, true, true},
+		{"request timeout", http.StatusRequestTimeout, true, false},
+		{"too many requests", http.StatusTooManyRequests, true, false},
+		{"internal server error", http.StatusInternalServerError, true, false},
+		{"service unavailable", http.StatusServiceUnavailable, true, false},
+		{"timeout", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, time.Second, tt.status)
+
+			response, err := post(context.Background(), server.Client(), server.URL, 100*time.Millisecond, nil, []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("post() error = %v, want error %v", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+			if response.statusCode != tt.status {
+				t.Errorf("statusCode = %d, want %d", response.statusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestWebhookNotifierDeliver(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	tests := []struct {
+		name          string
+		statuses      []int
+		wantErr       bool
+		wantPermanent bool
+		wantOutcomes  []string
+	}{
+		{
+			name:         "delivered",
+			statuses:     []int{http.StatusOK},
+			wantOutcomes: []string{database.DeliveryDelivered},
+		},
+		{
+			name:          "rejected",
+			statuses:      []int{http.StatusBadRequest},
+			wantErr:       true,
+			wantPermanent: true,
+			wantOutcomes:  []string{database.DeliveryRejected},
+		},
+		{
+			name:         "request timeout then delivered",
+			statuses:     []int{http.StatusRequestTimeout, http.StatusOK},
+			wantOutcomes: []string{database.DeliveryFailed, database.DeliveryDelivered},
+		},
+		{
+			name:         "too many requests",
+			statuses:     []int{http.StatusTooManyRequests},
+			wantErr:      true,
+			wantOutcomes: []string{database.DeliveryFailed, database.DeliveryFailed, database.DeliveryFailed},
+		},
+		{
+			name:          "server error then rejected",
+			statuses:      []int{http.StatusBadGateway, http.StatusUnprocessableEntity},
+			wantErr:       true,
+			wantPermanent: true,
+			wantOutcomes:  []string{database.DeliveryFailed, database.DeliveryRejected},
+		},
+		{
+			name:         "server error",
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantErr:      true,
+			wantOutcomes: []string{database.DeliveryFailed, database.DeliveryFailed, database.DeliveryFailed},
+		},
+		{
+			name:         "timeout",
+			statuses:     []int{0},
+			wantErr:      true,
+			wantOutcomes: []string{database.DeliveryFailed, database.DeliveryFailed, database.DeliveryFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, time.Second, tt.statuses...)
+			log := &fakeDeliveryLog{}
+			webhook, err := newWebhookNotifier(WebhookConfig{
+				URL:         server.URL,
+				Secret:      testWebhookSecret,
+				Timeout:     100 * time.Millisecond,
+				MaxAttempts: 3,
+				Backoff:     backoff,
+				MaxBackoff:  time.Second,
+			}, log, testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = webhook.Send(context.Background(), testNotification())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+
+			requests := server.received()
+			if len(requests) != len(tt.wantOutcomes) {
+				t.Fatalf("got %d requests, want %d", len(requests), len(tt.wantOutcomes))
+			}
+			if len(log.attempts) != len(tt.wantOutcomes) {
+				t.Fatalf("recorded %d attempts, want %d", len(log.attempts), len(tt.wantOutcomes))
+			}
+
+			// Retries wait for the backoff, doubled each time
+			for i := 1; i < len(requests); i++ {
+				wantWait := backoff << (i - 1)
+				if wait := requests[i].at.Sub(requests[i-1].at); wait < wantWait {
+					t.Errorf("attempt %d sent %v after the previous one, want at least %v", i+1, wait, wantWait)
+				}
+			}
+
+			deliveryID := log.attempts[0].DeliveryID
+			for i, request := range requests {
+				if got := request.header.Get(HeaderWebhookID); got != deliveryID {
+					t.Errorf("attempt %d: %s = %q, want %q", i+1, HeaderWebhookID, got, deliveryID)
+				}
+				if got := request.header.Get(HeaderWebhookAttempt); got != strconv.Itoa(i+1) {
+					t.Errorf("attempt %d: %s = %q", i+1, HeaderWebhookAttempt, got)
+				}
+				mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+				mac.Write([]byte(request.header.Get(HeaderWebhookTimestamp) + "."))
+				mac.Write(request.body)
+				if got, want := request.header.Get(HeaderWebhookSignature), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+					t.Errorf("attempt %d: %s = %q, want %q", i+1, HeaderWebhookSignature, got, want)
+				}
+			}
+
+			var payload webhookPayload
+			if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+				t.Fatalf("invalid webhook body: %v", err)
+			}
+			if payload.IdempotencyID != "idem-1" || payload.Status != "failed" || payload.Subject != "Message failed" {
+				t.Errorf("unexpected webhook payload %+v", payload)
+			}
+
+			for i, attempt := range log.attempts {
+				if attempt.DeliveryID != deliveryID || attempt.Attempt != i+1 {
+					t.Errorf("attempt %d recorded as %s #%d", i+1, attempt.DeliveryID, attempt.Attempt)
+				}
+				if attempt.Outcome != tt.wantOutcomes[i] {
+					t.Errorf("attempt %d: outcome = %q, want %q", i+1, attempt.Outcome, tt.wantOutcomes[i])
+				}
+				if attempt.IdempotencyID != "idem-1" || attempt.Channel != "webhook" || attempt.URL != server.URL {
+					t.Errorf("attempt %d: unexpected delivery %+v", i+1, attempt)
+				}
+				if string(attempt.RequestBody) != string(requests[i].body) {
+					t.Errorf("attempt %d: recorded body %s, sent %s", i+1, attempt.RequestBody, requests[i].body)
+				}
+
+				status := tt.statuses[min(i+1, len(tt.statuses))-1]
+				switch {
+				case status == 0 && attempt.StatusCode != nil:
+					t.Errorf("attempt %d: status code = %d, want none", i+1, *attempt.StatusCode)
+				case status != 0 && (attempt.StatusCode == nil || *attempt.StatusCode != status):
+					t.Errorf("attempt %d: status code = %v, want %d", i+1, attempt.StatusCode, status)
+				}
+				if (attempt.Outcome == database.DeliveryDelivered) != (attempt.ErrorMessage == nil) {
+					t.Errorf("attempt %d: outcome %s with error message %v", i+1, attempt.Outcome, attempt.ErrorMessage)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackNotifierSend(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{"ok", http.StatusOK, false, false},
+		{"forbidden", http.StatusForbidden, true, true},
+		{"request timeout", http.StatusRequestTimeout, true, false},
+		{"too many requests", http.StatusTooManyRequests, true, false},
+		{"server error", http.StatusInternalServerError, true, false},
+		{"timeout", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, time.Second, tt.status)
+			slack := newSlackNotifier(server.URL, 100*time.Millisecond)
+
+			err := slack.Send(context.Background(), testNotification())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+			}
+			if isPermanent(err) != tt.wantPermanent {
+				t.Errorf("isPermanent(%v) = %v, want %v", err, isPermanent(err), tt.wantPermanent)
+			}
+
+			// Retries are added by retryingNotifier, not by the channel
+			requests := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			var message map[string]string
+			if err := json.Unmarshal(requests[0].body, &message); err != nil {
+				t.Fatalf("invalid slack body: %v", err)
+			}
+			if want := "*Message failed*\nMessage idem-1 failed"; message["text"] != want {
+				t.Errorf("text = %q, want %q", message["text"], want)
+			}
+		})
+	}
+}
+
+func TestSlackNotifierSendWithoutURL(t *testing.T) {
+	err := newSlackNotifier("", time.Second).Send(context.Background(), testNotification())
+	if !isPermanent(err) {
+		t.Errorf("Send() error = %v, want a permanent error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const expiresSuffix = ".expires"
+
+var refPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// FileStore keeps blobs as files in a directory. Each blob has a sidecar
+// file holding its expiry as a unix timestamp. The directory must be shared
+// (e.g. a ReadWriteMany volume) by publishers and consumers
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a file store rooted at dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create claim check directory: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Put(ctx context.Context, data []byte, ttl time.Duration) (string, error) {
+	ref := newRef()
+	expiresAt := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	// Write the expiry first so a crash never leaves a blob the collector
+	// cannot see
+	if err := writeFileAtomic(s.path(ref)+expiresSuffix, []byte(expiresAt)); err != nil {
+		return "", fmt.Errorf("failed to write claim check expiry: %w", err)
+	}
+	if err := writeFileAtomic(s.path(ref), data); err != nil {
+		return "", fmt.Errorf("failed to write claim check blob: %w", err)
+	}
+
+	return ref, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	if !refPattern.MatchString(ref) {
+		return nil, fmt.Errorf("%w: invalid reference %q", ErrNotFound, ref)
+	}
+
+	data, err := os.ReadFile(s.path(ref))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claim check blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, ref string) error {
+	if !refPattern.MatchString(ref) {
+		return fmt.Errorf("%w: invalid reference %q", ErrNotFound, ref)
+	}
+
+	if err := os.Remove(s.path(ref)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete claim check blob: %w", err)
+	}
+	if err := os.Remove(s.path(ref) + expiresSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete claim check expiry: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list claim check directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		ref, ok := strings.CutSuffix(entry.Name(), expiresSuffix)
+		if !ok || !refPattern.MatchString(ref) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+
+		content, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		expiresAt, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil || time.Unix(expiresAt, 0).After(now) {
+			continue
+		}
+
+		if err := s.Delete(ctx, ref); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func (s *FileStore) path(ref string) string {
+	return filepath.Join(s.dir, ref)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,8 @@
+module queue-microservice-case/shared/claimcheck
+
+go 1.21
+
+require (
+	github.com/lib/pq v1.10.9
+)
+
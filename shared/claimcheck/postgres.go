@@ -0,0 +1,95 @@
+package claimcheck
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresStore keeps blobs as PostgreSQL large objects. The claim_check_blobs
+// table maps each reference to its large object and expiry
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore creates a store on an open database
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// OpenPostgresStore opens the database and creates a store on it
+func OpenPostgresStore(connectionString string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return NewPostgresStore(db), nil
+}
+
+func (s *PostgresStore) Put(ctx context.Context, data []byte, ttl time.Duration) (string, error) {
+	ref := newRef()
+	query := `
+		INSERT INTO claim_check_blobs (ref, blob_oid, size_bytes, created_at, expires_at)
+		VALUES ($1, lo_from_bytea(0, $2), $3, NOW(), $4)
+	`
+	_, err := s.db.ExecContext(ctx, query, ref, data, len(data), time.Now().Add(ttl).UTC())
+	if err != nil {
+		return "", fmt.Errorf("failed to store claim check blob: %w", err)
+	}
+	return ref, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	var data []byte
+	query := `SELECT lo_get(blob_oid) FROM claim_check_blobs WHERE ref = $1`
+	err := s.db.QueryRowContext(ctx, query, ref).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get claim check blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, ref string) error {
+	query := `
+		WITH deleted AS (
+			DELETE FROM claim_check_blobs WHERE ref = $1 RETURNING blob_oid
+		)
+		SELECT lo_unlink(blob_oid) FROM deleted
+	`
+	rows, err := s.db.QueryContext(ctx, query, ref)
+	if err != nil {
+		return fmt.Errorf("failed to delete claim check blob: %w", err)
+	}
+	return rows.Close()
+}
+
+func (s *PostgresStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	var removed int
+	query := `
+		WITH deleted AS (
+			DELETE FROM claim_check_blobs WHERE expires_at < $1 RETURNING blob_oid
+		)
+		SELECT COUNT(lo_unlink(blob_oid)) FROM deleted
+	`
+	if err := s.db.QueryRowContext(ctx, query, now.UTC()).Scan(&removed); err != nil {
+		return 0, fmt.Errorf("failed to delete expired claim check blobs: %w", err)
+	}
+	return removed, nil
+}
+
+// Close closes the database connection
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
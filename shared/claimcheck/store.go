@@ -0,0 +1,135 @@
+package claimcheck
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrNotFound is returned when a blob does not exist (or was collected)
+var ErrNotFound = errors.New("claim check blob not found")
+
+// Store keeps payloads that are too large to travel through the broker.
+// Publishers Put the payload and send only the returned reference;
+// consumers Get it back before handling the event
+type Store interface {
+	// Put stores data until now+ttl and returns its reference
+	Put(ctx context.Context, data []byte, ttl time.Duration) (string, error)
+
+	// Get returns the data stored under ref
+	Get(ctx context.Context, ref string) ([]byte, error)
+
+	// Delete removes the blob stored under ref
+	Delete(ctx context.Context, ref string) error
+
+	// DeleteExpired removes every blob that expired before now and returns
+	// how many were removed
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// Config holds the claim check settings of a service
+type Config struct {
+	Store      string // "fs", "postgres" or "" (disabled)
+	Dir        string
+	Threshold  int
+	TTL        time.Duration
+	GCInterval time.Duration
+}
+
+// Enabled reports whether payloads should be offloaded
+func (c Config) Enabled() bool {
+	return c.Store != ""
+}
+
+// ConfigFromEnv reads CLAIM_CHECK_STORE, CLAIM_CHECK_DIR,
+// CLAIM_CHECK_THRESHOLD_BYTES, CLAIM_CHECK_TTL and CLAIM_CHECK_GC_INTERVAL
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Store:      os.Getenv("CLAIM_CHECK_STORE"),
+		Dir:        getEnv("CLAIM_CHECK_DIR", "/var/lib/claim-check"),
+		Threshold:  256 * 1024,
+		TTL:        7 * 24 * time.Hour,
+		GCInterval: 10 * time.Minute,
+	}
+
+	if value := os.Getenv("CLAIM_CHECK_THRESHOLD_BYTES"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold <= 0 {
+			return cfg, fmt.Errorf("invalid CLAIM_CHECK_THRESHOLD_BYTES: %q", value)
+		}
+		cfg.Threshold = threshold
+	}
+	if value := os.Getenv("CLAIM_CHECK_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return cfg, fmt.Errorf("invalid CLAIM_CHECK_TTL: %q", value)
+		}
+		cfg.TTL = ttl
+	}
+	if value := os.Getenv("CLAIM_CHECK_GC_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return cfg, fmt.Errorf("invalid CLAIM_CHECK_GC_INTERVAL: %q", value)
+		}
+		cfg.GCInterval = interval
+	}
+
+	return cfg, nil
+}
+
+// Open creates the store selected by cfg. databaseURL is only used by the
+// postgres store. Returns a nil store when the claim check is disabled
+func Open(cfg Config, databaseURL string) (Store, error) {
+	switch cfg.Store {
+	case "":
+		return nil, nil
+	case "fs":
+		return NewFileStore(cfg.Dir)
+	case "postgres":
+		return OpenPostgresStore(databaseURL)
+	default:
+		return nil, fmt.Errorf("unsupported claim check store: %s (supported: fs, postgres)", cfg.Store)
+	}
+}
+
+// RunCollector deletes expired blobs every interval until ctx is done
+func RunCollector(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := store.DeleteExpired(ctx, time.Now())
+			if err != nil {
+				log.Printf("Failed to collect expired claim check blobs: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("Collected %d expired claim check blobs", removed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newRef generates a random blob reference
+func newRef() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -1,6 +1,9 @@
 package contracts
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrMissingEventID       = errors.New("event_id is required")
@@ -9,5 +12,39 @@ var (
 	ErrMissingEventType     = errors.New("event_type is required")
 	ErrMissingSourceService = errors.New("source_service is required")
 	ErrMissingTimestamp     = errors.New("timestamp is required")
+
+	ErrInvalidTimestamp   = errors.New("invalid timestamp")
+	ErrUnknownEventType   = errors.New("unknown event type")
+	ErrInvalidIDFormat    = errors.New("invalid id format")
+	ErrFieldTooLong       = errors.New("field too long")
+	ErrPayloadTooLarge    = errors.New("payload too large")
+	ErrInvalidPayload     = errors.New("invalid payload")
+	ErrInvalidEventSchema = errors.New("invalid event schema")
 )
 
+// ValidationError reports which field of an event failed validation.
+// Err holds one of the sentinel errors above, so callers can still use
+// errors.Is(err, ErrMissingEventID) and friends
+type ValidationError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationField returns the field that failed validation, or "" if err
+// is not a validation error
+func ValidationField(err error) string {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Field
+	}
+	return ""
+}
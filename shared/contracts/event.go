@@ -1,16 +1,39 @@
 package contracts
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Limits enforced by Validate
+const (
+	MaxIDLength = 128
+	// Payloads above the broker message size are offloaded by the claim
+	// check, so this limit is independent of Kafka/RabbitMQ settings
+	MaxPayloadSize = 16 << 20 // 16 MiB, encoded as JSON
+)
+
+var (
+	// event_id is generated either by NewEvent (32 hex chars) or by the
+	// API gateway (UUID)
+	eventIDPattern = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+	// correlation_id and idempotency_id are opaque, but must be safe to use
+	// as message keys, headers and log fields
+	opaqueIDPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+	serviceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
 
 // Event represents the standard event contract used across all microservices
 type Event struct {
-	EventID        string                 `json:"event_id"`
-	CorrelationID  string                 `json:"correlation_id"`
-	IdempotencyID  string                 `json:"idempotency_id"`
-	EventType      string                 `json:"event_type"`
-	SourceService  string                 `json:"source_service"`
-	Timestamp      string                 `json:"timestamp"` // ISO-8601 format
-	Payload        map[string]interface{} `json:"payload"`
+	EventID       string                 `json:"event_id"`
+	CorrelationID string                 `json:"correlation_id"`
+	IdempotencyID string                 `json:"idempotency_id"`
+	EventType     string                 `json:"event_type"`
+	SourceService string                 `json:"source_service"`
+	Timestamp     string                 `json:"timestamp"` // ISO-8601 format
+	Payload       map[string]interface{} `json:"payload"`
 }
 
 // NewEvent creates a new event with required fields
@@ -21,31 +44,71 @@ func NewEvent(eventType, correlationID, idempotencyID, sourceService string, pay
 		IdempotencyID: idempotencyID,
 		EventType:     eventType,
 		SourceService: sourceService,
-		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
 		Payload:       payload,
 	}
 }
 
-// Validate ensures all required fields are present
+// Time parses Timestamp, the moment the event was created
+func (e *Event) Time() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, e.Timestamp)
+}
+
+// Validate ensures all required fields are present and well formed, that
+// the event type is registered and that the payload satisfies its schema.
+// Failures are returned as *ValidationError
 func (e *Event) Validate() error {
-	if e.EventID == "" {
-		return ErrMissingEventID
+	required := []struct {
+		field string
+		value string
+		err   error
+	}{
+		{"event_id", e.EventID, ErrMissingEventID},
+		{"correlation_id", e.CorrelationID, ErrMissingCorrelationID},
+		{"idempotency_id", e.IdempotencyID, ErrMissingIdempotencyID},
+		{"event_type", e.EventType, ErrMissingEventType},
+		{"source_service", e.SourceService, ErrMissingSourceService},
+		{"timestamp", e.Timestamp, ErrMissingTimestamp},
 	}
-	if e.CorrelationID == "" {
-		return ErrMissingCorrelationID
+	for _, r := range required {
+		if r.value == "" {
+			return &ValidationError{Field: r.field, Reason: "is required", Err: r.err}
+		}
 	}
-	if e.IdempotencyID == "" {
-		return ErrMissingIdempotencyID
+
+	if !eventIDPattern.MatchString(e.EventID) {
+		return &ValidationError{Field: "event_id", Reason: "must be a UUID or 32 lowercase hex characters", Err: ErrInvalidIDFormat}
 	}
-	if e.EventType == "" {
-		return ErrMissingEventType
+	for _, id := range []struct{ field, value string }{
+		{"correlation_id", e.CorrelationID},
+		{"idempotency_id", e.IdempotencyID},
+	} {
+		if len(id.value) > MaxIDLength {
+			return &ValidationError{Field: id.field, Reason: fmt.Sprintf("must be at most %d characters", MaxIDLength), Err: ErrFieldTooLong}
+		}
+		if !opaqueIDPattern.MatchString(id.value) {
+			return &ValidationError{Field: id.field, Reason: "must contain only letters, digits, '.', '_', ':' or '-'", Err: ErrInvalidIDFormat}
+		}
 	}
-	if e.SourceService == "" {
-		return ErrMissingSourceService
+	if len(e.SourceService) > MaxIDLength || !serviceNamePattern.MatchString(e.SourceService) {
+		return &ValidationError{Field: "source_service", Reason: "must be a lowercase service name", Err: ErrInvalidIDFormat}
 	}
-	if e.Timestamp == "" {
-		return ErrMissingTimestamp
+
+	if _, err := e.Time(); err != nil {
+		return &ValidationError{Field: "timestamp", Reason: "must be an ISO-8601 (RFC 3339) timestamp", Err: ErrInvalidTimestamp}
 	}
-	return nil
-}
 
+	if !IsRegisteredEventType(e.EventType) {
+		return &ValidationError{Field: "event_type", Reason: fmt.Sprintf("%q is not a registered event type", e.EventType), Err: ErrUnknownEventType}
+	}
+
+	encodedPayload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return &ValidationError{Field: "payload", Reason: fmt.Sprintf("cannot be encoded as JSON: %v", err), Err: ErrInvalidPayload}
+	}
+	if len(encodedPayload) > MaxPayloadSize {
+		return &ValidationError{Field: "payload", Reason: fmt.Sprintf("must be at most %d bytes", MaxPayloadSize), Err: ErrPayloadTooLarge}
+	}
+
+	return validatePayload(e.EventType, encodedPayload)
+}
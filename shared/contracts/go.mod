@@ -2,3 +2,5 @@ module queue-microservice-case/shared/contracts
 
 go 1.21
 
+
+require github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
@@ -0,0 +1,127 @@
+package contracts
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Event types exchanged between the services
+const (
+	EventTypeMessageCreated       = "message.created"
+	EventTypeMessageStatusUpdated = "message.status.updated"
+	EventTypeMessageStageUpdated  = "message.stage.updated"
+)
+
+//go:embed schemas/*.json
+var builtinSchemas embed.FS
+
+var registry = struct {
+	sync.RWMutex
+	schemas map[string]*jsonschema.Schema
+}{schemas: make(map[string]*jsonschema.Schema)}
+
+func init() {
+	entries, err := builtinSchemas.ReadDir("schemas")
+	if err != nil {
+		panic(fmt.Sprintf("contracts: failed to read built-in schemas: %v", err))
+	}
+	for _, entry := range entries {
+		schema, err := builtinSchemas.ReadFile(path.Join("schemas", entry.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("contracts: failed to read schema %s: %v", entry.Name(), err))
+		}
+		if err := RegisterEventType(strings.TrimSuffix(entry.Name(), ".json"), schema); err != nil {
+			panic(fmt.Sprintf("contracts: %v", err))
+		}
+	}
+}
+
+// RegisterEventType adds an event type to the registry, with the JSON Schema
+// its payload must satisfy. Registering an existing type replaces its schema
+func RegisterEventType(eventType string, schema []byte) error {
+	if eventType == "" {
+		return ErrMissingEventType
+	}
+
+	url := "contracts://schemas/" + eventType + ".json"
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(schema)); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidEventSchema, eventType, err)
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidEventSchema, eventType, err)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	registry.schemas[eventType] = compiled
+	return nil
+}
+
+// IsRegisteredEventType reports whether eventType is known
+func IsRegisteredEventType(eventType string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	_, ok := registry.schemas[eventType]
+	return ok
+}
+
+// RegisteredEventTypes returns the known event types, sorted
+func RegisteredEventTypes() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	types := make([]string, 0, len(registry.schemas))
+	for eventType := range registry.schemas {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// validatePayload checks the encoded payload against the schema registered
+// for eventType
+func validatePayload(eventType string, encodedPayload []byte) error {
+	registry.RLock()
+	schema, ok := registry.schemas[eventType]
+	registry.RUnlock()
+	if !ok {
+		return &ValidationError{Field: "event_type", Reason: fmt.Sprintf("%q is not a registered event type", eventType), Err: ErrUnknownEventType}
+	}
+
+	// Decode again so the validator sees plain JSON values (json.Number
+	// instead of Go ints, nil instead of typed nil maps...)
+	decoder := json.NewDecoder(bytes.NewReader(encodedPayload))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return &ValidationError{Field: "payload", Reason: fmt.Sprintf("is not valid JSON: %v", err), Err: ErrInvalidPayload}
+	}
+
+	if err := schema.Validate(document); err != nil {
+		var schemaErr *jsonschema.ValidationError
+		if !errors.As(err, &schemaErr) {
+			return &ValidationError{Field: "payload", Reason: err.Error(), Err: ErrInvalidPayload}
+		}
+		leaf := schemaErr
+		for len(leaf.Causes) > 0 {
+			leaf = leaf.Causes[0]
+		}
+		return &ValidationError{
+			Field:  "payload" + strings.ReplaceAll(leaf.InstanceLocation, "/", "."),
+			Reason: leaf.Message,
+			Err:    ErrInvalidPayload,
+		}
+	}
+
+	return nil
+}
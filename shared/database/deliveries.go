@@ -0,0 +1,251 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Outcomes of a notification delivery attempt
+const (
+	// DeliveryDelivered: the recipient accepted the notification
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed: the attempt failed in a way worth retrying (timeout,
+	// connection error, 5xx)
+	DeliveryFailed = "failed"
+	// DeliveryRejected: the recipient rejected the notification (4xx)
+	DeliveryRejected = "rejected"
+)
+
+// NotificationDelivery is one attempt to deliver a notification, stored in
+// notification_deliveries. The attempts of a delivery share DeliveryID
+type NotificationDelivery struct {
+	ID            int64  `json:"id"`
+	DeliveryID    string `json:"delivery_id"`
+	IdempotencyID string `json:"idempotency_id"`
+	CorrelationID string `json:"correlation_id"`
+	EventID       string `json:"event_id"`
+	Channel       string `json:"channel"`
+	// RecipientID is set when the notification went to a subscriber
+	RecipientID *string         `json:"recipient_id,omitempty"`
+	URL         string          `json:"url"`
+	RequestBody json.RawMessage `json:"request_body"`
+	Attempt     int             `json:"attempt"`
+	// StatusCode is nil when no response was received (timeout, connection
+	// error)
+	StatusCode      *int      `json:"status_code,omitempty"`
+	LatencyMs       float64   `json:"latency_ms"`
+	ResponseSnippet *string   `json:"response_snippet,omitempty"`
+	ErrorMessage    *string   `json:"error_message,omitempty"`
+	Outcome         string    `json:"outcome"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Outcomes of the notification of an event to a target, stored in
+// notification_outcomes
+const (
+	// NotificationSent: the notifier delivered the notification
+	NotificationSent = "sent"
+	// NotificationDeferred: the notification joined a digest
+	NotificationDeferred = "deferred"
+	// NotificationFailed: the notification failed in a way retrying cannot
+	// fix
+	NotificationFailed = "failed"
+)
+
+// NotificationOutcome is what became of the notification of an event to
+// one channel and recipient. A redelivery of the event skips the targets
+// that have one
+type NotificationOutcome struct {
+	EventID string `json:"event_id"`
+	Channel string `json:"channel"`
+	// RecipientID is empty for the channels routed by status
+	RecipientID string    `json:"recipient_id,omitempty"`
+	Outcome     string    `json:"outcome"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FailedDeliveryCriteria selects the deliveries to replay: those whose last
+// attempt was not delivered
+type FailedDeliveryCriteria struct {
+	// DeliveryID selects a single delivery; empty selects every delivery
+	DeliveryID string
+	// Since and Until bound the time of the last attempt. Until leaves out
+	// deliveries that may still be retrying
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of deliveries returned
+	Limit int
+}
+
+const deliveryColumns = `id, delivery_id, idempotency_id, correlation_id, event_id, channel, recipient_id, url, request_body,
+	attempt, status_code, latency_ms, response_snippet, error_message, outcome, created_at`
+
+// RecordDeliveryAttempt stores one delivery attempt
+func (r *Repository) RecordDeliveryAttempt(ctx context.Context, d *NotificationDelivery) (err error) {
+	ctx, end := r.startOperation(ctx, "record_delivery_attempt")
+	defer end(&err)
+
+	query := `
+		INSERT INTO notification_deliveries (delivery_id, idempotency_id, correlation_id, event_id, channel, recipient_id, url, request_body,
+			attempt, status_code, latency_ms, response_snippet, error_message, outcome, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW())
+		RETURNING id, created_at
+	`
+	err = r.db.QueryRowContext(ctx, query,
+		d.DeliveryID,
+		d.IdempotencyID,
+		d.CorrelationID,
+		d.EventID,
+		d.Channel,
+		d.RecipientID,
+		d.URL,
+		[]byte(d.RequestBody),
+		d.Attempt,
+		d.StatusCode,
+		d.LatencyMs,
+		d.ResponseSnippet,
+		d.ErrorMessage,
+		d.Outcome,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert delivery attempt: %w", err)
+	}
+	return nil
+}
+
+// FindFailedDeliveries returns the last attempt of each delivery that was
+// not delivered, oldest first
+func (r *Repository) FindFailedDeliveries(ctx context.Context, criteria FailedDeliveryCriteria) (_ []NotificationDelivery, err error) {
+	ctx, end := r.startOperation(ctx, "find_failed_deliveries")
+	defer end(&err)
+
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM (
+			SELECT DISTINCT ON (delivery_id) ` + deliveryColumns + `
+			FROM notification_deliveries
+			WHERE delivery_id IN (
+				SELECT delivery_id FROM notification_deliveries
+				WHERE outcome <> 'delivered' AND created_at >= $1 AND ($3 = '' OR delivery_id = $3)
+			)
+			ORDER BY delivery_id, attempt DESC
+		) last_attempts
+		WHERE outcome <> 'delivered' AND created_at < $2
+		ORDER BY created_at ASC
+		LIMIT $4
+	`
+	rows, err := r.db.QueryContext(ctx, query, criteria.Since.UTC(), criteria.Until.UTC(), criteria.DeliveryID, criteria.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failed deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDeliveries(rows)
+}
+
+// GetMessageDeliveries retrieves every delivery attempt of the
+// notifications of a message, in order
+func (r *Repository) GetMessageDeliveries(ctx context.Context, idempotencyID string) (_ []NotificationDelivery, err error) {
+	ctx, end := r.startOperation(ctx, "get_message_deliveries")
+	defer end(&err)
+
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM notification_deliveries
+		WHERE idempotency_id = $1
+		ORDER BY created_at ASC, id ASC
+	`
+	rows, err := r.db.QueryContext(ctx, query, idempotencyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	return scanDeliveries(rows)
+}
+
+// RecordNotificationOutcome stores the outcome of the notification of an
+// event to a target, keeping the first one recorded
+func (r *Repository) RecordNotificationOutcome(ctx context.Context, o *NotificationOutcome) (err error) {
+	ctx, end := r.startOperation(ctx, "record_notification_outcome")
+	defer end(&err)
+
+	query := `
+		INSERT INTO notification_outcomes (event_id, channel, recipient_id, outcome, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (event_id, channel, recipient_id) DO NOTHING
+	`
+	if _, err := r.db.ExecContext(ctx, query, o.EventID, o.Channel, o.RecipientID, o.Outcome); err != nil {
+		return fmt.Errorf("failed to insert notification outcome: %w", err)
+	}
+	return nil
+}
+
+// ListNotificationOutcomes retrieves the outcomes recorded for the
+// notifications of an event
+func (r *Repository) ListNotificationOutcomes(ctx context.Context, eventID string) (_ []NotificationOutcome, err error) {
+	ctx, end := r.startOperation(ctx, "list_notification_outcomes")
+	defer end(&err)
+
+	query := `
+		SELECT event_id, channel, recipient_id, outcome, created_at
+		FROM notification_outcomes
+		WHERE event_id = $1
+	`
+	rows, err := r.db.QueryContext(ctx, query, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification outcomes: %w", err)
+	}
+	defer rows.Close()
+
+	var outcomes []NotificationOutcome
+	for rows.Next() {
+		var o NotificationOutcome
+		if err := rows.Scan(&o.EventID, &o.Channel, &o.RecipientID, &o.Outcome, &o.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification outcome: %w", err)
+		}
+		outcomes = append(outcomes, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read notification outcomes: %w", err)
+	}
+	return outcomes, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]NotificationDelivery, error) {
+	var deliveries []NotificationDelivery
+	for rows.Next() {
+		var d NotificationDelivery
+		var body []byte
+		err := rows.Scan(
+			&d.ID,
+			&d.DeliveryID,
+			&d.IdempotencyID,
+			&d.CorrelationID,
+			&d.EventID,
+			&d.Channel,
+			&d.RecipientID,
+			&d.URL,
+			&body,
+			&d.Attempt,
+			&d.StatusCode,
+			&d.LatencyMs,
+			&d.ResponseSnippet,
+			&d.ErrorMessage,
+			&d.Outcome,
+			&d.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery: %w", err)
+		}
+		d.RequestBody = json.RawMessage(body)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DigestItem is a notification waiting in a digest
+type DigestItem struct {
+	ID            int64     `json:"id"`
+	DigestKey     string    `json:"digest_key"`
+	IdempotencyID string    `json:"idempotency_id"`
+	CorrelationID string    `json:"correlation_id"`
+	Status        string    `json:"status"`
+	Subject       string    `json:"subject"`
+	Text          string    `json:"text"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Digest batches the notifications to one address of a channel, sent
+// together once DueAt is reached
+type Digest struct {
+	Key string `json:"key"`
+	// RecipientID is nil for the channels routed by status
+	RecipientID *string      `json:"recipient_id,omitempty"`
+	Channel     string       `json:"channel"`
+	Address     string       `json:"address"`
+	DueAt       time.Time    `json:"due_at"`
+	Items       []DigestItem `json:"items"`
+}
+
+// DigestKey identifies the digest of the notifications of a channel to a
+// recipient (empty for routed notifications) and address
+func DigestKey(channel, recipientID, address string) string {
+	return strings.Join([]string{channel, recipientID, address}, "|")
+}
+
+// AddDigestItem adds item to the digest d, which is created due after delay
+// if it does not exist. The delay of an existing digest is kept, so a digest
+// is sent one window after its first notification
+func (r *Repository) AddDigestItem(ctx context.Context, d *Digest, item *DigestItem, delay time.Duration) (err error) {
+	ctx, end := r.startOperation(ctx, "add_digest_item")
+	defer end(&err)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The no-op update locks an existing digest, so CompleteDigest cannot
+	// remove it before the item is added
+	query := `
+		INSERT INTO notification_digests (digest_key, recipient_id, channel, address, due_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5), NOW())
+		ON CONFLICT (digest_key) DO UPDATE SET digest_key = EXCLUDED.digest_key
+		RETURNING due_at
+	`
+	if err := tx.QueryRowContext(ctx, query, d.Key, d.RecipientID, d.Channel, d.Address, delay.Seconds()).Scan(&d.DueAt); err != nil {
+		return fmt.Errorf("failed to create digest: %w", err)
+	}
+
+	item.DigestKey = d.Key
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO notification_digest_items (digest_key, idempotency_id, correlation_id, status, subject, text, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		RETURNING id, created_at
+	`, item.DigestKey, item.IdempotencyID, item.CorrelationID, item.Status, item.Subject, item.Text).Scan(&item.ID, &item.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert digest item: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit digest item: %w", err)
+	}
+	return nil
+}
+
+// ClaimDueDigests leases up to limit digests that are due, with their
+// items, for lease. A digest whose lease expires (its replica crashed, or
+// could not send it) is claimed again
+func (r *Repository) ClaimDueDigests(ctx context.Context, lease time.Duration, limit int) (_ []Digest, err error) {
+	ctx, end := r.startOperation(ctx, "claim_due_digests")
+	defer end(&err)
+
+	query := `
+		UPDATE notification_digests d
+		SET lease_expires_at = NOW() + make_interval(secs => $1)
+		WHERE d.digest_key IN (
+			SELECT digest_key FROM notification_digests
+			WHERE due_at <= NOW() AND (lease_expires_at IS NULL OR lease_expires_at < NOW())
+			ORDER BY due_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.digest_key, d.recipient_id, d.channel, d.address, d.due_at
+	`
+	rows, err := r.db.QueryContext(ctx, query, lease.Seconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim digests: %w", err)
+	}
+	var digests []Digest
+	for rows.Next() {
+		var d Digest
+		if err := rows.Scan(&d.Key, &d.RecipientID, &d.Channel, &d.Address, &d.DueAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan digest: %w", err)
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read digests: %w", err)
+	}
+
+	for i := range digests {
+		if digests[i].Items, err = r.digestItems(ctx, digests[i].Key); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+func (r *Repository) digestItems(ctx context.Context, key string) ([]DigestItem, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, digest_key, idempotency_id, correlation_id, status, subject, text, created_at
+		FROM notification_digest_items
+		WHERE digest_key = $1
+		ORDER BY id
+	`, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query digest items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []DigestItem
+	for rows.Next() {
+		var item DigestItem
+		if err := rows.Scan(&item.ID, &item.DigestKey, &item.IdempotencyID, &item.CorrelationID, &item.Status, &item.Subject, &item.Text, &item.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan digest item: %w", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read digest items: %w", err)
+	}
+	return items, nil
+}
+
+// CompleteDigest removes the items of d, once sent or dropped. Items added
+// meanwhile start a new window of the same length; without them the digest
+// is removed
+func (r *Repository) CompleteDigest(ctx context.Context, d *Digest) (err error) {
+	ctx, end := r.startOperation(ctx, "complete_digest")
+	defer end(&err)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serializes with AddDigestItem
+	var window float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT extract(epoch FROM due_at - created_at) FROM notification_digests WHERE digest_key = $1 FOR UPDATE
+	`, d.Key).Scan(&window)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock digest: %w", err)
+	}
+
+	var lastID int64
+	for _, item := range d.Items {
+		if item.ID > lastID {
+			lastID = item.ID
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM notification_digest_items WHERE digest_key = $1 AND id <= $2`, d.Key, lastID); err != nil {
+		return fmt.Errorf("failed to delete digest items: %w", err)
+	}
+
+	query := `
+		UPDATE notification_digests
+		SET created_at = NOW(), due_at = NOW() + make_interval(secs => $2), lease_expires_at = NULL
+		WHERE digest_key = $1 AND EXISTS (SELECT 1 FROM notification_digest_items WHERE digest_key = $1)
+	`
+	result, err := tx.ExecContext(ctx, query, d.Key, window)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule digest: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if rows == 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM notification_digests WHERE digest_key = $1`, d.Key); err != nil {
+			return fmt.Errorf("failed to delete digest: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit digest: %w", err)
+	}
+	return nil
+}
@@ -4,5 +4,9 @@ go 1.21
 
 require (
 	github.com/lib/pq v1.10.9
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	queue-microservice-case/shared/metrics v0.0.0
 )
 
+replace queue-microservice-case/shared/metrics => ../metrics
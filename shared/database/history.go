@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Page sizes of ListHistoryAfter
+const (
+	DefaultHistoryPageSize = 100
+	MaxHistoryPageSize     = 1000
+)
+
+var ErrHistoryQueryUnscoped = errors.New("history query requires an idempotency_id or a correlation_id")
+
+// HistoryQuery selects the accepted status changes recorded after the
+// history entry AfterID, of one message or of every message sharing a
+// correlation ID. History IDs grow with every entry, so they serve as
+// positions to resume from, but they are taken on insert, not on commit: an
+// entry may become visible after entries with higher IDs were read. Readers
+// resuming from an ID catch it by reading again the entries created within
+// CreatedWithin
+type HistoryQuery struct {
+	IdempotencyID string
+	CorrelationID string
+	// AfterID is the ID of the last entry already seen, 0 for all entries
+	AfterID int
+	// CreatedWithin, when set, keeps only the entries created within it
+	// before now, by the database clock
+	CreatedWithin time.Duration
+	// Limit is the page size (DefaultHistoryPageSize if zero, capped at
+	// MaxHistoryPageSize)
+	Limit int
+}
+
+// ListHistoryAfter returns the accepted status changes matching query,
+// oldest first. Refused transitions are left out: they changed nothing
+func (r *Repository) ListHistoryAfter(ctx context.Context, query HistoryQuery) (_ []MessageHistory, err error) {
+	ctx, end := r.startOperation(ctx, "list_history_after")
+	defer end(&err)
+
+	if query.IdempotencyID == "" && query.CorrelationID == "" {
+		return nil, ErrHistoryQueryUnscoped
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryPageSize
+	}
+	if limit > MaxHistoryPageSize {
+		limit = MaxHistoryPageSize
+	}
+
+	w := &whereClause{}
+	w.add("accepted")
+	w.add("id > " + w.arg(query.AfterID))
+	if query.CreatedWithin > 0 {
+		w.add("created_at > NOW() - make_interval(secs => " + w.arg(query.CreatedWithin.Seconds()) + ")")
+	}
+	if query.IdempotencyID != "" {
+		w.add("idempotency_id = " + w.arg(query.IdempotencyID))
+	}
+	if query.CorrelationID != "" {
+		w.add("correlation_id = " + w.arg(query.CorrelationID))
+	}
+	sqlQuery := `
+		SELECT id, idempotency_id, correlation_id, status, service_name, event_id, error_message, from_status, accepted, action, created_at
+		FROM message_history
+		` + w.String() + `
+		ORDER BY id ASC
+		LIMIT ` + w.arg(limit)
+
+	rows, err := r.db.QueryContext(ctx, sqlQuery, w.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []MessageHistory
+	for rows.Next() {
+		var h MessageHistory
+		err := rows.Scan(&h.ID, &h.IdempotencyID, &h.CorrelationID, &h.Status, &h.ServiceName, &h.EventID,
+			&h.ErrorMessage, &h.FromStatus, &h.Accepted, &h.Action, &h.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan history: %w", err)
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return history, nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"queue-microservice-case/shared/metrics"
+)
+
+var tracer = otel.Tracer("queue-microservice-case/shared/database")
+
+// startOperation starts the span of a repository operation and bounds it by
+// the repository query timeout. The returned function ends it and records
+// its latency; err is a pointer so it can be deferred before the error is
+// known:
+//
+//	ctx, end := r.startOperation(ctx, "get_message")
+//	defer end(&err)
+func (r *Repository) startOperation(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, cancel := r.withTimeout(ctx)
+	ctx, span := tracer.Start(ctx, "Repository."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation.name", operation),
+		),
+	)
+	return ctx, func(err *error) {
+		if err != nil && *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		cancel()
+		metrics.ObserveQuery(operation, start, err)
+	}
+}
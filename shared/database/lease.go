@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLeaseHeld     = errors.New("message is leased by another worker")
+	ErrLeaseNotOwned = errors.New("processing lease is not owned by this worker")
+)
+
+// ClaimMessage atomically moves a pending message to processing, leasing it
+// to owner for ttl. A processing message whose lease expired (its worker
+// crashed or stalled) is reclaimed the same way. Only one worker wins the
+// claim: the others get ErrLeaseHeld while the lease is live, and a
+// *TransitionError wrapping ErrIllegalTransition once the message is final.
+// The returned message carries the version to complete it with
+// CompareAndSwapStatus; a worker that lost its lease gets ErrVersionConflict
+func (r *Repository) ClaimMessage(ctx context.Context, idempotencyID, correlationID, owner string, ttl time.Duration, serviceName, eventID string) (_ *Message, err error) {
+	ctx, end := r.startOperation(ctx, "claim_message")
+	defer end(&err)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// previous captures the status before the update for the history entry
+	query := `
+		WITH previous AS (
+			SELECT idempotency_id, status FROM messages WHERE idempotency_id = $1 FOR UPDATE
+		)
+		UPDATE messages m
+		SET status = 'processing', lease_owner = $2, lease_expires_at = NOW() + make_interval(secs => $3),
+			version = m.version + 1, updated_at = NOW()
+		FROM previous
+		WHERE m.idempotency_id = previous.idempotency_id
+			AND (m.status = 'pending' OR (m.status = 'processing' AND m.lease_expires_at < NOW()))
+		RETURNING ` + prefixColumns("m", messageColumns) + `, previous.status
+	`
+	var from string
+	msg, err := scanMessage(tx.QueryRowContext(ctx, query, idempotencyID, owner, ttl.Seconds()), &from)
+	if err == sql.ErrNoRows {
+		return nil, r.claimRefused(ctx, tx, idempotencyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim message: %w", err)
+	}
+
+	if err := insertHistory(ctx, tx, &MessageHistory{
+		IdempotencyID: idempotencyID,
+		CorrelationID: correlationID,
+		Status:        StatusProcessing,
+		FromStatus:    &from,
+		Accepted:      true,
+		ServiceName:   serviceName,
+		EventID:       eventID,
+	}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit claim: %w", err)
+	}
+	return msg, nil
+}
+
+// claimRefused explains why ClaimMessage updated no row
+func (r *Repository) claimRefused(ctx context.Context, tx *sql.Tx, idempotencyID string) error {
+	var status string
+	var version int64
+	err := tx.QueryRowContext(ctx, `SELECT status, version FROM messages WHERE idempotency_id = $1`, idempotencyID).Scan(&status, &version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, idempotencyID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get message status: %w", err)
+	}
+	if status == StatusProcessing {
+		return ErrLeaseHeld
+	}
+	return &TransitionError{IdempotencyID: idempotencyID, From: status, To: StatusProcessing, Version: version, Err: ErrIllegalTransition}
+}
+
+// RenewLease extends the lease owner holds on a processing message by ttl,
+// for handlers that run longer than the lease. Returns ErrLeaseNotOwned if
+// the lease expired and another worker reclaimed the message
+func (r *Repository) RenewLease(ctx context.Context, idempotencyID, owner string, ttl time.Duration) (err error) {
+	ctx, end := r.startOperation(ctx, "renew_lease")
+	defer end(&err)
+
+	query := `
+		UPDATE messages SET lease_expires_at = NOW() + make_interval(secs => $3)
+		WHERE idempotency_id = $1 AND status = 'processing' AND lease_owner = $2
+	`
+	result, err := r.db.ExecContext(ctx, query, idempotencyID, owner, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+	if renewed == 0 {
+		return ErrLeaseNotOwned
+	}
+	return nil
+}
+
+// prefixColumns qualifies a comma-separated column list with table
+func prefixColumns(table, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = table + "." + name
+	}
+	return strings.Join(names, ", ")
+}
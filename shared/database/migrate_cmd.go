@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RunMigrateCommand implements the "migrate" subcommand of the services:
+//
+//	migrate [up]       apply the pending migrations
+//	migrate down [N]   revert the last N applied migrations (default 1)
+//	migrate status     list the migrations and whether they are applied
+func RunMigrateCommand(ctx context.Context, repo *Repository, args []string, out io.Writer) error {
+	migrator, err := repo.Migrator()
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to revert: %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Fprintf(out, "reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.UTC().Format("2006-01-02T15:04:05Z")
+			}
+			fmt.Fprintf(out, "%04d_%-40s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command %q (supported: up, down [N], status)", command)
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS message_history;
+DROP TABLE IF EXISTS messages;
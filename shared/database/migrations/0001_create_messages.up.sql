@@ -0,0 +1,29 @@
+-- Messages table with idempotency_id as unique constraint
+CREATE TABLE IF NOT EXISTS messages (
+    idempotency_id VARCHAR(255) PRIMARY KEY,
+    correlation_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    payload JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_correlation_id ON messages(correlation_id);
+CREATE INDEX IF NOT EXISTS idx_status ON messages(status);
+
+-- Message history table to track all status changes
+CREATE TABLE IF NOT EXISTS message_history (
+    id SERIAL PRIMARY KEY,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    service_name VARCHAR(100) NOT NULL,
+    event_id VARCHAR(255),
+    error_message TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (idempotency_id) REFERENCES messages(idempotency_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_history_idempotency_id ON message_history(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_history_correlation_id ON message_history(correlation_id);
+CREATE INDEX IF NOT EXISTS idx_history_created_at ON message_history(created_at);
@@ -0,0 +1,3 @@
+-- Release the large objects before dropping their references
+SELECT lo_unlink(blob_oid) FROM claim_check_blobs;
+DROP TABLE IF EXISTS claim_check_blobs;
@@ -0,0 +1,10 @@
+-- Claim check blobs: oversized event payloads stored as large objects
+CREATE TABLE IF NOT EXISTS claim_check_blobs (
+    ref VARCHAR(64) PRIMARY KEY,
+    blob_oid OID NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_claim_check_blobs_expires_at ON claim_check_blobs(expires_at);
@@ -0,0 +1,21 @@
+-- Message timings: latency breakdown of every hop (one row per consumed event and service)
+CREATE TABLE IF NOT EXISTS message_timings (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    service_name VARCHAR(100) NOT NULL,
+    broker VARCHAR(20) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    event_timestamp TIMESTAMP NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    handled_at TIMESTAMP NOT NULL,
+    queue_latency_ms DOUBLE PRECISION NOT NULL,
+    processing_latency_ms DOUBLE PRECISION NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_timings_idempotency_id ON message_timings(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_message_timings_broker_created_at ON message_timings(broker, created_at);
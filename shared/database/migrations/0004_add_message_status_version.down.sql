@@ -0,0 +1,3 @@
+ALTER TABLE message_history DROP COLUMN IF EXISTS accepted;
+ALTER TABLE message_history DROP COLUMN IF EXISTS from_status;
+ALTER TABLE messages DROP COLUMN IF EXISTS version;
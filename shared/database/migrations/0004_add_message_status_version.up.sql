@@ -0,0 +1,8 @@
+-- Optimistic concurrency for status updates: every accepted transition
+-- bumps version, and updates only apply to the version they read
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- Transitions rejected by the status state machine are kept in the history
+-- with accepted = FALSE and the status the message was in
+ALTER TABLE message_history ADD COLUMN IF NOT EXISTS from_status VARCHAR(50);
+ALTER TABLE message_history ADD COLUMN IF NOT EXISTS accepted BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_payload;
+DROP INDEX IF EXISTS idx_messages_updated_at;
+DROP INDEX IF EXISTS idx_messages_correlation_created_at_id;
+DROP INDEX IF EXISTS idx_messages_status_created_at_id;
+DROP INDEX IF EXISTS idx_messages_created_at_id;
@@ -0,0 +1,11 @@
+-- Keyset pagination of message listings (newest first), alone or combined
+-- with the status and correlation_id filters
+CREATE INDEX IF NOT EXISTS idx_messages_created_at_id ON messages(created_at DESC, idempotency_id DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_status_created_at_id ON messages(status, created_at DESC, idempotency_id DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_correlation_created_at_id ON messages(correlation_id, created_at DESC, idempotency_id DESC);
+
+-- Updated time range filter
+CREATE INDEX IF NOT EXISTS idx_messages_updated_at ON messages(updated_at);
+
+-- Payload containment filter (payload @> '{...}')
+CREATE INDEX IF NOT EXISTS idx_messages_payload ON messages USING GIN (payload jsonb_path_ops);
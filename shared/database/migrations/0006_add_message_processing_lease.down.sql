@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_lease_expires_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS lease_expires_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS lease_owner;
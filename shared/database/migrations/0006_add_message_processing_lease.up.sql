@@ -0,0 +1,6 @@
+-- Processing lease: the worker that claims a message (pending -> processing)
+-- owns it until lease_expires_at, after which another worker may reclaim it
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS lease_owner VARCHAR(255);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_messages_lease_expires_at ON messages(lease_expires_at) WHERE status = 'processing';
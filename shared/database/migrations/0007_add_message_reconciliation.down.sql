@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_unfinished_updated_at;
+ALTER TABLE message_history DROP COLUMN IF EXISTS action;
+ALTER TABLE messages DROP COLUMN IF EXISTS reconcile_attempts;
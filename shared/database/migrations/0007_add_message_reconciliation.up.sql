@@ -0,0 +1,7 @@
+-- Stuck-message reconciler: attempts made to recover each message, and the
+-- reconciler action (republish, fail) recorded with each history entry
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reconcile_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE message_history ADD COLUMN IF NOT EXISTS action VARCHAR(50);
+
+-- Stale pending and processing messages
+CREATE INDEX IF NOT EXISTS idx_messages_unfinished_updated_at ON messages(updated_at) WHERE status IN ('pending', 'processing');
@@ -0,0 +1,25 @@
+-- Notification deliveries: one row per attempt to deliver a notification
+-- (webhook), with the request needed to replay it
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id VARCHAR(64) NOT NULL,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    url TEXT NOT NULL,
+    request_body JSONB NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    latency_ms DOUBLE PRECISION NOT NULL,
+    response_snippet TEXT,
+    error_message TEXT,
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_idempotency_id ON notification_deliveries(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_delivery_attempt ON notification_deliveries(delivery_id, attempt DESC);
+
+-- Undelivered attempts, for replay
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_undelivered_created_at ON notification_deliveries(created_at) WHERE outcome <> 'delivered';
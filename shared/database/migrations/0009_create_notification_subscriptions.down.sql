@@ -0,0 +1,3 @@
+ALTER TABLE notification_deliveries DROP COLUMN IF EXISTS recipient_id;
+DROP TABLE IF EXISTS notification_subscriptions;
+DROP TABLE IF EXISTS notification_recipients;
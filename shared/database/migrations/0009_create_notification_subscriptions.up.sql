@@ -0,0 +1,34 @@
+-- Notification recipients and their preferences (quiet hours, opt-outs)
+CREATE TABLE IF NOT EXISTS notification_recipients (
+    id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    quiet_hours_start TIME,
+    quiet_hours_end TIME,
+    opted_out BOOLEAN NOT NULL DEFAULT FALSE,
+    opted_out_channels TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Subscriptions: the status updates a recipient is notified about, and
+-- through which channel. Empty statuses match every status; correlation_id
+-- and metadata_match are optional filters
+CREATE TABLE IF NOT EXISTS notification_subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    recipient_id VARCHAR(64) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    statuses TEXT[] NOT NULL DEFAULT '{}',
+    correlation_id VARCHAR(255),
+    metadata_match JSONB,
+    disabled BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (recipient_id) REFERENCES notification_recipients(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_subscriptions_recipient_id ON notification_subscriptions(recipient_id);
+CREATE INDEX IF NOT EXISTS idx_notification_subscriptions_correlation_id ON notification_subscriptions(correlation_id) WHERE correlation_id IS NOT NULL;
+
+-- Recipient of each webhook delivery, if it was sent to a subscriber
+ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS recipient_id VARCHAR(64);
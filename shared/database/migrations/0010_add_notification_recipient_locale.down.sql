@@ -0,0 +1 @@
+ALTER TABLE notification_recipients DROP COLUMN IF EXISTS locale;
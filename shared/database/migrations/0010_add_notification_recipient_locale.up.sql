@@ -0,0 +1,3 @@
+-- Locale of the notifications of a recipient ("pt-BR", "en"); empty uses
+-- the default locale of the notification service
+ALTER TABLE notification_recipients ADD COLUMN IF NOT EXISTS locale VARCHAR(35) NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+ALTER TABLE notification_subscriptions DROP COLUMN IF EXISTS digest_window_seconds;
+DROP TABLE IF EXISTS notification_digest_items;
+DROP TABLE IF EXISTS notification_digests;
+DROP TABLE IF EXISTS notification_rate_limits;
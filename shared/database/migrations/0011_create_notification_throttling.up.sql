@@ -0,0 +1,39 @@
+-- Fixed-window counters of the notification rate limits, one row per limit
+-- ("recipient:<id>", "channel:<name>")
+CREATE TABLE IF NOT EXISTS notification_rate_limits (
+    limit_key VARCHAR(255) PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    count INTEGER NOT NULL
+);
+
+-- Digests: notifications to one address of a channel batched until due_at.
+-- lease_expires_at is set while a replica sends the digest
+CREATE TABLE IF NOT EXISTS notification_digests (
+    digest_key TEXT PRIMARY KEY,
+    recipient_id VARCHAR(64),
+    channel VARCHAR(50) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    due_at TIMESTAMP NOT NULL,
+    lease_expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_digests_due_at ON notification_digests(due_at);
+
+-- Notifications waiting in a digest, rendered for its channel
+CREATE TABLE IF NOT EXISTS notification_digest_items (
+    id BIGSERIAL PRIMARY KEY,
+    digest_key TEXT NOT NULL,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    subject TEXT NOT NULL,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (digest_key) REFERENCES notification_digests(digest_key) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_digest_items_digest_key ON notification_digest_items(digest_key, id);
+
+-- Subscriptions batched into digests over this window; 0 sends at once
+ALTER TABLE notification_subscriptions ADD COLUMN IF NOT EXISTS digest_window_seconds INTEGER NOT NULL DEFAULT 0;
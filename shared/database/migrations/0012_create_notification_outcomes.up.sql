@@ -0,0 +1,12 @@
+-- What became of the notification of an event to one channel and recipient
+-- (sent, deferred to a digest or failed for good). A redelivery of the
+-- event skips these targets. recipient_id is '' for the channels routed by
+-- status
+CREATE TABLE IF NOT EXISTS notification_outcomes (
+    event_id VARCHAR(255) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    recipient_id VARCHAR(64) NOT NULL DEFAULT '',
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (event_id, channel, recipient_id)
+);
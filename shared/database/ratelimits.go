@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RateLimit allows Limit notifications per Window under Key, counted in
+// fixed windows aligned on the epoch
+type RateLimit struct {
+	Key    string
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitExceeded is returned by AcquireRateLimits for the first limit
+// that was reached
+type RateLimitExceeded struct {
+	Limit RateLimit
+	// RetryAfter is how long until the window of the limit ends
+	RetryAfter time.Duration
+}
+
+// AcquireRateLimits counts one notification against every limit. If any
+// limit is reached nothing is counted and the limit is returned, so a
+// notification refused by one limit does not use up the others. The
+// counters are rows of notification_rate_limits, so the limits hold across
+// replicas
+func (r *Repository) AcquireRateLimits(ctx context.Context, limits []RateLimit) (_ *RateLimitExceeded, err error) {
+	ctx, end := r.startOperation(ctx, "acquire_rate_limits")
+	defer end(&err)
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	// Lock the counters in the same order in every transaction
+	limits = append([]RateLimit(nil), limits...)
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Key < limits[j].Key })
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO notification_rate_limits (limit_key, window_start, count)
+		VALUES ($1, to_timestamp(floor(extract(epoch FROM NOW()) / $2::float8) * $2::float8), 1)
+		ON CONFLICT (limit_key) DO UPDATE SET
+			count = CASE WHEN notification_rate_limits.window_start = EXCLUDED.window_start
+				THEN notification_rate_limits.count + 1 ELSE 1 END,
+			window_start = EXCLUDED.window_start
+		RETURNING count, extract(epoch FROM window_start + make_interval(secs => $2::float8) - LOCALTIMESTAMP)
+	`
+	for _, limit := range limits {
+		if limit.Limit <= 0 || limit.Window <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %s: %d per %s", limit.Key, limit.Limit, limit.Window)
+		}
+		var count int
+		var retryAfter float64
+		if err := tx.QueryRowContext(ctx, query, limit.Key, limit.Window.Seconds()).Scan(&count, &retryAfter); err != nil {
+			return nil, fmt.Errorf("failed to count rate limit %s: %w", limit.Key, err)
+		}
+		if count > limit.Limit {
+			return &RateLimitExceeded{Limit: limit, RetryAfter: time.Duration(retryAfter * float64(time.Second))}, nil
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit rate limits: %w", err)
+	}
+	return nil, nil
+}
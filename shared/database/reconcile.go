@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Actions of the stuck-message reconciler, recorded in message_history
+const (
+	ActionRepublish = "republish"
+	ActionFail      = "fail"
+)
+
+// StuckCriteria defines when an unfinished message counts as stuck
+type StuckCriteria struct {
+	// PendingAfter is how long a message may stay pending without updates
+	PendingAfter time.Duration
+	// ProcessingAfter is how long a message may stay processing past the
+	// expiry of its lease (or its last update, if it has no lease)
+	ProcessingAfter time.Duration
+	// Limit caps the number of messages returned
+	Limit int
+}
+
+// FindStuckMessages returns the pending and processing messages stuck
+// according to criteria, least recently updated first
+func (r *Repository) FindStuckMessages(ctx context.Context, criteria StuckCriteria) (_ []Message, err error) {
+	ctx, end := r.startOperation(ctx, "find_stuck_messages")
+	defer end(&err)
+
+	query := `
+		SELECT ` + messageColumns + `
+		FROM messages
+		WHERE status IN ('pending', 'processing')
+			AND (
+				(status = 'pending' AND updated_at < NOW() - make_interval(secs => $1))
+				OR (status = 'processing' AND COALESCE(lease_expires_at, updated_at) < NOW() - make_interval(secs => $2))
+			)
+		ORDER BY updated_at ASC
+		LIMIT $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, criteria.PendingAfter.Seconds(), criteria.ProcessingAfter.Seconds(), criteria.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stuck messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stuck messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// MarkRepublished records that the reconciler is about to publish msg
+// again: it counts the attempt, restarts the stuck timer and expires the
+// processing lease so the republished event can be claimed. It applies only
+// if msg is unchanged since it was read, so concurrent reconcilers republish
+// a message once; the others get a *TransitionError wrapping ErrVersionConflict
+func (r *Repository) MarkRepublished(ctx context.Context, msg *Message, serviceName, eventID string) (err error) {
+	ctx, end := r.startOperation(ctx, "mark_republished")
+	defer end(&err)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE messages SET reconcile_attempts = reconcile_attempts + 1, version = version + 1, updated_at = NOW(),
+			lease_expires_at = CASE WHEN status = 'processing' THEN NOW() ELSE lease_expires_at END
+		WHERE idempotency_id = $1 AND version = $2
+	`
+	result, err := tx.ExecContext(ctx, query, msg.IdempotencyID, msg.Version)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	if updated == 0 {
+		return &TransitionError{IdempotencyID: msg.IdempotencyID, From: msg.Status, To: msg.Status, Version: msg.Version, Err: ErrVersionConflict}
+	}
+
+	action := ActionRepublish
+	note := fmt.Sprintf("stuck in %s since %s, republished (attempt %d)", msg.Status, msg.UpdatedAt.UTC().Format(time.RFC3339), msg.ReconcileAttempts+1)
+	if err := insertHistory(ctx, tx, &MessageHistory{
+		IdempotencyID: msg.IdempotencyID,
+		CorrelationID: msg.CorrelationID,
+		Status:        msg.Status,
+		FromStatus:    &msg.Status,
+		Accepted:      true,
+		Action:        &action,
+		ServiceName:   serviceName,
+		EventID:       eventID,
+		ErrorMessage:  &note,
+	}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit republish: %w", err)
+	}
+	return nil
+}
+
+// FailStuckMessage moves a stuck message to failed, if it is unchanged since
+// it was read, recording reason in the history
+func (r *Repository) FailStuckMessage(ctx context.Context, msg *Message, reason, serviceName string) (err error) {
+	ctx, end := r.startOperation(ctx, "fail_stuck_message")
+	defer end(&err)
+
+	action := ActionFail
+	_, err = r.updateStatus(ctx, msg.Version, &MessageHistory{
+		IdempotencyID: msg.IdempotencyID,
+		CorrelationID: msg.CorrelationID,
+		Status:        StatusFailed,
+		Action:        &action,
+		ServiceName:   serviceName,
+		ErrorMessage:  &reason,
+	})
+	return err
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,11 +12,17 @@ import (
 
 type Message struct {
 	IdempotencyID string                 `json:"idempotency_id"`
-	CorrelationID  string                 `json:"correlation_id"`
-	Status       string                 `json:"status"`
-	Payload      map[string]interface{} `json:"payload"`
-	CreatedAt    time.Time              `json:"created_at"`
-	UpdatedAt    time.Time              `json:"updated_at"`
+	CorrelationID string                 `json:"correlation_id"`
+	Status        string                 `json:"status"`
+	Version       int64                  `json:"version"`
+	Payload       map[string]interface{} `json:"payload"`
+	// LeaseOwner holds a processing message until LeaseExpiresAt (see ClaimMessage)
+	LeaseOwner     *string    `json:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	// ReconcileAttempts counts the recoveries of the message while stuck
+	ReconcileAttempts int       `json:"reconcile_attempts"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
 }
 
 type MessageHistory struct {
@@ -26,149 +33,309 @@ type MessageHistory struct {
 	ServiceName   string    `json:"service_name"`
 	EventID       string    `json:"event_id"`
 	ErrorMessage  *string   `json:"error_message,omitempty"`
+	FromStatus    *string   `json:"from_status,omitempty"`
+	Accepted      bool      `json:"accepted"`
+	Action        *string   `json:"action,omitempty"` // reconciler action, if any
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// DefaultQueryTimeout bounds every repository call whose context has no
+// earlier deadline, so a hung database fails handlers instead of blocking them
+const DefaultQueryTimeout = 5 * time.Second
+
 type Repository struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
 }
 
-func NewRepository(connectionString string) (*Repository, error) {
+// Option configures optional repository behaviour
+type Option func(*Repository)
+
+// WithQueryTimeout sets the timeout applied to each repository call.
+// Zero or a negative value disables it
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(r *Repository) {
+		r.queryTimeout = timeout
+	}
+}
+
+func NewRepository(connectionString string, opts ...Option) (*Repository, error) {
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	if err := db.Ping(); err != nil {
+	r := &Repository{db: db, queryTimeout: DefaultQueryTimeout}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &Repository{db: db}, nil
+	return r, nil
 }
 
-// CreateOrGetMessage creates a message or returns existing one (idempotency check)
-func (r *Repository) CreateOrGetMessage(idempotencyID, correlationID string, payload map[string]interface{}) (*Message, bool, error) {
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		return nil, false, fmt.Errorf("failed to marshal payload: %w", err)
+// withTimeout bounds ctx by the query timeout
+func (r *Repository) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
 
-	var msg Message
-	var exists bool
+// messageColumns are the messages columns read by scanMessage, in order
+const messageColumns = `idempotency_id, correlation_id, status, version, payload, lease_owner, lease_expires_at, reconcile_attempts, created_at, updated_at`
 
-	query := `
-		INSERT INTO messages (idempotency_id, correlation_id, status, payload, created_at, updated_at)
-		VALUES ($1, $2, 'pending', $3, NOW(), NOW())
-		ON CONFLICT (idempotency_id) DO UPDATE SET updated_at = NOW()
-		RETURNING idempotency_id, correlation_id, status, payload, created_at, updated_at
-	`
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanMessage reads a row selecting messageColumns, followed by the extra
+// destinations
+func scanMessage(row rowScanner, extra ...interface{}) (*Message, error) {
+	var msg Message
 	var payloadBytes []byte
-	err = r.db.QueryRow(query, idempotencyID, correlationID, payloadJSON).Scan(
+	dest := append([]interface{}{
 		&msg.IdempotencyID,
 		&msg.CorrelationID,
 		&msg.Status,
+		&msg.Version,
 		&payloadBytes,
+		&msg.LeaseOwner,
+		&msg.LeaseExpiresAt,
+		&msg.ReconcileAttempts,
 		&msg.CreatedAt,
 		&msg.UpdatedAt,
-	)
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(payloadBytes, &msg.Payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	return &msg, nil
+}
+
+// CreateOrGetMessage creates a message or returns existing one (idempotency check)
+func (r *Repository) CreateOrGetMessage(ctx context.Context, idempotencyID, correlationID string, payload map[string]interface{}) (_ *Message, _ bool, err error) {
+	ctx, end := r.startOperation(ctx, "create_or_get_message")
+	defer end(&err)
 
+	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
-		// Check if it's a conflict (already exists)
-		if err == sql.ErrNoRows {
-			// Try to get existing message
-			query = `SELECT idempotency_id, correlation_id, status, payload, created_at, updated_at 
-					 FROM messages WHERE idempotency_id = $1`
-			err = r.db.QueryRow(query, idempotencyID).Scan(
-				&msg.IdempotencyID,
-				&msg.CorrelationID,
-				&msg.Status,
-				&payloadBytes,
-				&msg.CreatedAt,
-				&msg.UpdatedAt,
-			)
-			if err == nil {
-				exists = true
-			}
-		}
-		if !exists {
-			return nil, false, fmt.Errorf("failed to create/get message: %w", err)
-		}
+		return nil, false, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	// Unmarshal payload
-	if err := json.Unmarshal(payloadBytes, &msg.Payload); err != nil {
-		return nil, exists, fmt.Errorf("failed to unmarshal payload: %w", err)
+	// The upsert returns the row whether it was inserted or not; xmax is
+	// only set on rows that already existed and went through the update
+	query := `
+		INSERT INTO messages (idempotency_id, correlation_id, status, payload, created_at, updated_at)
+		VALUES ($1, $2, 'pending', $3, NOW(), NOW())
+		ON CONFLICT (idempotency_id) DO UPDATE SET updated_at = NOW()
+		RETURNING ` + messageColumns + `, xmax <> 0
+	`
+
+	var exists bool
+	msg, err := scanMessage(r.db.QueryRowContext(ctx, query, idempotencyID, correlationID, payloadJSON), &exists)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create/get message: %w", err)
+	}
+
+	return msg, exists, nil
+}
+
+// UpdateMessageStatus moves a message to status from whatever version it is
+// at, and creates a history entry. Transitions the status state machine does
+// not allow are recorded in the history as rejected and return a
+// *TransitionError wrapping ErrIllegalTransition
+func (r *Repository) UpdateMessageStatus(ctx context.Context, idempotencyID, correlationID, status, serviceName, eventID string, errorMsg *string) (err error) {
+	ctx, end := r.startOperation(ctx, "update_message_status")
+	defer end(&err)
+
+	_, err = r.updateStatus(ctx, 0, &MessageHistory{
+		IdempotencyID: idempotencyID,
+		CorrelationID: correlationID,
+		Status:        status,
+		ServiceName:   serviceName,
+		EventID:       eventID,
+		ErrorMessage:  errorMsg,
+	})
+	return err
+}
+
+// CompareAndSwapStatus moves a message to status only if it is still at
+// expectedVersion, and returns its new version. A message modified since it
+// was read returns a *TransitionError wrapping ErrVersionConflict
+func (r *Repository) CompareAndSwapStatus(ctx context.Context, idempotencyID, correlationID string, expectedVersion int64, status, serviceName, eventID string, errorMsg *string) (_ int64, err error) {
+	ctx, end := r.startOperation(ctx, "compare_and_swap_status")
+	defer end(&err)
+
+	return r.updateStatus(ctx, expectedVersion, &MessageHistory{
+		IdempotencyID: idempotencyID,
+		CorrelationID: correlationID,
+		Status:        status,
+		ServiceName:   serviceName,
+		EventID:       eventID,
+		ErrorMessage:  errorMsg,
+	})
+}
+
+// UpdateMessagePayload replaces the payload of a message if it is still at
+// expectedVersion, and returns its new version. A message modified since it
+// was read returns ErrVersionConflict
+func (r *Repository) UpdateMessagePayload(ctx context.Context, idempotencyID string, expectedVersion int64, payload map[string]interface{}) (_ int64, err error) {
+	ctx, end := r.startOperation(ctx, "update_message_payload")
+	defer end(&err)
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	return &msg, exists, nil
+	query := `
+		UPDATE messages SET payload = $1, version = version + 1, updated_at = NOW()
+		WHERE idempotency_id = $2 AND version = $3
+	`
+	result, err := r.db.ExecContext(ctx, query, payloadJSON, idempotencyID, expectedVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update payload: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to update payload: %w", err)
+	}
+	if updated == 0 {
+		return 0, fmt.Errorf("%w: %s (version %d)", ErrVersionConflict, idempotencyID, expectedVersion)
+	}
+	return expectedVersion + 1, nil
 }
 
-// UpdateMessageStatus updates message status and creates history entry
-func (r *Repository) UpdateMessageStatus(idempotencyID, correlationID, status, serviceName, eventID string, errorMsg *string) error {
-	tx, err := r.db.Begin()
+// updateStatus applies the status transition described by entry, with a
+// version check, and records entry in the history. An expectedVersion of 0
+// means the version currently stored
+func (r *Repository) updateStatus(ctx context.Context, expectedVersion int64, entry *MessageHistory) (int64, error) {
+	idempotencyID, status := entry.IdempotencyID, entry.Status
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Update message
-	updateQuery := `UPDATE messages SET status = $1, updated_at = NOW() WHERE idempotency_id = $2`
-	_, err = tx.Exec(updateQuery, status, idempotencyID)
+	var current string
+	var version int64
+	err = tx.QueryRowContext(ctx, `SELECT status, version FROM messages WHERE idempotency_id = $1`, idempotencyID).Scan(&current, &version)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrMessageNotFound, idempotencyID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get message status: %w", err)
+	}
+	if expectedVersion == 0 {
+		expectedVersion = version
+	}
+
+	transitionErr := &TransitionError{IdempotencyID: idempotencyID, From: current, To: status, Version: expectedVersion}
+	if version != expectedVersion {
+		transitionErr.Err = ErrVersionConflict
+		return 0, transitionErr
+	}
+
+	if err := checkTransition(current, status); err != nil {
+		// Keep a trace of the rejected transition, then report it
+		transitionErr.Err = err
+		reason := transitionErr.Error()
+		rejected := *entry
+		rejected.FromStatus, rejected.Accepted, rejected.ErrorMessage = &current, false, &reason
+		if err := insertHistory(ctx, tx, &rejected); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("failed to record rejected transition: %w", err)
+		}
+		return 0, transitionErr
+	}
+
+	// Update message; the processing lease ends with the processing status
+	updateQuery := `
+		UPDATE messages SET status = $1, version = version + 1, updated_at = NOW(),
+			lease_owner = NULL, lease_expires_at = NULL
+		WHERE idempotency_id = $2 AND version = $3
+	`
+	result, err := tx.ExecContext(ctx, updateQuery, status, idempotencyID, expectedVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update message: %w", err)
+	}
+	updated, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to update message: %w", err)
+		return 0, fmt.Errorf("failed to update message: %w", err)
+	}
+	if updated == 0 {
+		transitionErr.Err = ErrVersionConflict
+		return 0, transitionErr
+	}
+
+	accepted := *entry
+	accepted.FromStatus, accepted.Accepted = &current, true
+	if err := insertHistory(ctx, tx, &accepted); err != nil {
+		return 0, err
 	}
 
-	// Insert history
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit status update: %w", err)
+	}
+	return expectedVersion + 1, nil
+}
+
+// insertHistory adds h to the history of its message
+func insertHistory(ctx context.Context, tx *sql.Tx, h *MessageHistory) error {
 	historyQuery := `
-		INSERT INTO message_history (idempotency_id, correlation_id, status, service_name, event_id, error_message, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		INSERT INTO message_history (idempotency_id, correlation_id, status, from_status, accepted, action, service_name, event_id, error_message, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW())
 	`
-	_, err = tx.Exec(historyQuery, idempotencyID, correlationID, status, serviceName, eventID, errorMsg)
+	_, err := tx.ExecContext(ctx, historyQuery, h.IdempotencyID, h.CorrelationID, h.Status, h.FromStatus, h.Accepted, h.Action, h.ServiceName, h.EventID, h.ErrorMessage)
 	if err != nil {
 		return fmt.Errorf("failed to insert history: %w", err)
 	}
-
-	return tx.Commit()
+	return nil
 }
 
 // GetMessage retrieves a message by idempotency_id
-func (r *Repository) GetMessage(idempotencyID string) (*Message, error) {
-	var msg Message
-	query := `SELECT idempotency_id, correlation_id, status, payload, created_at, updated_at 
-			  FROM messages WHERE idempotency_id = $1`
-
-	var payloadBytes []byte
-	err := r.db.QueryRow(query, idempotencyID).Scan(
-		&msg.IdempotencyID,
-		&msg.CorrelationID,
-		&msg.Status,
-		&payloadBytes,
-		&msg.CreatedAt,
-		&msg.UpdatedAt,
-	)
+func (r *Repository) GetMessage(ctx context.Context, idempotencyID string) (_ *Message, err error) {
+	ctx, end := r.startOperation(ctx, "get_message")
+	defer end(&err)
 
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE idempotency_id = $1`
+	msg, err := scanMessage(r.db.QueryRowContext(ctx, query, idempotencyID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, idempotencyID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get message: %w", err)
 	}
 
-	if err := json.Unmarshal(payloadBytes, &msg.Payload); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-
-	return &msg, nil
+	return msg, nil
 }
 
 // GetMessageHistory retrieves all history entries for a message
-func (r *Repository) GetMessageHistory(idempotencyID string) ([]MessageHistory, error) {
+func (r *Repository) GetMessageHistory(ctx context.Context, idempotencyID string) (_ []MessageHistory, err error) {
+	ctx, end := r.startOperation(ctx, "get_message_history")
+	defer end(&err)
+
 	query := `
-		SELECT id, idempotency_id, correlation_id, status, service_name, event_id, error_message, created_at
+		SELECT id, idempotency_id, correlation_id, status, service_name, event_id, error_message, from_status, accepted, action, created_at
 		FROM message_history
 		WHERE idempotency_id = $1
 		ORDER BY created_at ASC
 	`
 
-	rows, err := r.db.Query(query, idempotencyID)
+	rows, err := r.db.QueryContext(ctx, query, idempotencyID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query history: %w", err)
 	}
@@ -185,6 +352,9 @@ func (r *Repository) GetMessageHistory(idempotencyID string) ([]MessageHistory,
 			&h.ServiceName,
 			&h.EventID,
 			&h.ErrorMessage,
+			&h.FromStatus,
+			&h.Accepted,
+			&h.Action,
 			&h.CreatedAt,
 		)
 		if err != nil {
@@ -196,8 +366,14 @@ func (r *Repository) GetMessageHistory(idempotencyID string) ([]MessageHistory,
 	return history, nil
 }
 
+// Ping verifies the database connection is alive
+func (r *Repository) Ping(ctx context.Context) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.db.PingContext(ctx)
+}
+
 // Close closes the database connection
 func (r *Repository) Close() error {
 	return r.db.Close()
 }
-
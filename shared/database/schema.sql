@@ -1,15 +1,43 @@
+-- Snapshot of the schema built by the migrations in migrations/, used to
+-- bootstrap local databases (docker-entrypoint). The services apply the
+-- versioned migrations on startup (or through "migrate"), which is the only
+-- path for schema changes: add a migration and update this snapshot.
+
 -- Messages table with idempotency_id as unique constraint
 CREATE TABLE IF NOT EXISTS messages (
     idempotency_id VARCHAR(255) PRIMARY KEY,
     correlation_id VARCHAR(255) NOT NULL,
     status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    version BIGINT NOT NULL DEFAULT 1,
     payload JSONB,
+    lease_owner VARCHAR(255),
+    lease_expires_at TIMESTAMP,
+    reconcile_attempts INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    INDEX idx_correlation_id (correlation_id),
-    INDEX idx_status (status)
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE INDEX IF NOT EXISTS idx_correlation_id ON messages(correlation_id);
+CREATE INDEX IF NOT EXISTS idx_status ON messages(status);
+
+-- Keyset pagination of message listings (newest first), alone or combined
+-- with the status and correlation_id filters
+CREATE INDEX IF NOT EXISTS idx_messages_created_at_id ON messages(created_at DESC, idempotency_id DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_status_created_at_id ON messages(status, created_at DESC, idempotency_id DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_correlation_created_at_id ON messages(correlation_id, created_at DESC, idempotency_id DESC);
+
+-- Updated time range filter
+CREATE INDEX IF NOT EXISTS idx_messages_updated_at ON messages(updated_at);
+
+-- Payload containment filter (payload @> '{...}')
+CREATE INDEX IF NOT EXISTS idx_messages_payload ON messages USING GIN (payload jsonb_path_ops);
+
+-- Expired processing leases
+CREATE INDEX IF NOT EXISTS idx_messages_lease_expires_at ON messages(lease_expires_at) WHERE status = 'processing';
+
+-- Stale pending and processing messages (reconciler)
+CREATE INDEX IF NOT EXISTS idx_messages_unfinished_updated_at ON messages(updated_at) WHERE status IN ('pending', 'processing');
+
 -- Message history table to track all status changes
 CREATE TABLE IF NOT EXISTS message_history (
     id SERIAL PRIMARY KEY,
@@ -19,10 +47,155 @@ CREATE TABLE IF NOT EXISTS message_history (
     service_name VARCHAR(100) NOT NULL,
     event_id VARCHAR(255),
     error_message TEXT,
+    from_status VARCHAR(50),
+    accepted BOOLEAN NOT NULL DEFAULT TRUE,
+    action VARCHAR(50),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (idempotency_id) REFERENCES messages(idempotency_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_history_idempotency_id ON message_history(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_history_correlation_id ON message_history(correlation_id);
+CREATE INDEX IF NOT EXISTS idx_history_created_at ON message_history(created_at);
+
+-- Claim check blobs: oversized event payloads stored as large objects
+CREATE TABLE IF NOT EXISTS claim_check_blobs (
+    ref VARCHAR(64) PRIMARY KEY,
+    blob_oid OID NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_claim_check_blobs_expires_at ON claim_check_blobs(expires_at);
+
+-- Message timings: latency breakdown of every hop (one row per consumed event and service)
+CREATE TABLE IF NOT EXISTS message_timings (
+    id BIGSERIAL PRIMARY KEY,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    service_name VARCHAR(100) NOT NULL,
+    broker VARCHAR(20) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    event_timestamp TIMESTAMP NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    handled_at TIMESTAMP NOT NULL,
+    queue_latency_ms DOUBLE PRECISION NOT NULL,
+    processing_latency_ms DOUBLE PRECISION NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_timings_idempotency_id ON message_timings(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_message_timings_broker_created_at ON message_timings(broker, created_at);
+
+-- Notification deliveries: one row per attempt (webhook), with the request needed to replay it
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id VARCHAR(64) NOT NULL,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    recipient_id VARCHAR(64),
+    url TEXT NOT NULL,
+    request_body JSONB NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    latency_ms DOUBLE PRECISION NOT NULL,
+    response_snippet TEXT,
+    error_message TEXT,
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_idempotency_id ON notification_deliveries(idempotency_id);
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_delivery_attempt ON notification_deliveries(delivery_id, attempt DESC);
+
+-- Undelivered attempts, for replay
+CREATE INDEX IF NOT EXISTS idx_notification_deliveries_undelivered_created_at ON notification_deliveries(created_at) WHERE outcome <> 'delivered';
+
+-- Notification recipients and their preferences (locale, quiet hours, opt-outs)
+CREATE TABLE IF NOT EXISTS notification_recipients (
+    id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    locale VARCHAR(35) NOT NULL DEFAULT '',
+    quiet_hours_start TIME,
+    quiet_hours_end TIME,
+    opted_out BOOLEAN NOT NULL DEFAULT FALSE,
+    opted_out_channels TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Subscriptions: the status updates a recipient is notified about, and through which channel
+CREATE TABLE IF NOT EXISTS notification_subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    recipient_id VARCHAR(64) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    statuses TEXT[] NOT NULL DEFAULT '{}',
+    correlation_id VARCHAR(255),
+    metadata_match JSONB,
+    disabled BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Batches the notifications into digests over this window; 0 sends at once
+    digest_window_seconds INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (idempotency_id) REFERENCES messages(idempotency_id) ON DELETE CASCADE,
-    INDEX idx_idempotency_id (idempotency_id),
-    INDEX idx_correlation_id (correlation_id),
-    INDEX idx_created_at (created_at)
+    FOREIGN KEY (recipient_id) REFERENCES notification_recipients(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_subscriptions_recipient_id ON notification_subscriptions(recipient_id);
+CREATE INDEX IF NOT EXISTS idx_notification_subscriptions_correlation_id ON notification_subscriptions(correlation_id) WHERE correlation_id IS NOT NULL;
+
+-- Fixed-window counters of the notification rate limits, one row per limit
+-- ("recipient:<id>", "channel:<name>")
+CREATE TABLE IF NOT EXISTS notification_rate_limits (
+    limit_key VARCHAR(255) PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    count INTEGER NOT NULL
 );
 
+-- Digests: notifications to one address of a channel batched until due_at.
+-- lease_expires_at is set while a replica sends the digest
+CREATE TABLE IF NOT EXISTS notification_digests (
+    digest_key TEXT PRIMARY KEY,
+    recipient_id VARCHAR(64),
+    channel VARCHAR(50) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    due_at TIMESTAMP NOT NULL,
+    lease_expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_digests_due_at ON notification_digests(due_at);
+
+-- Notifications waiting in a digest, rendered for its channel
+CREATE TABLE IF NOT EXISTS notification_digest_items (
+    id BIGSERIAL PRIMARY KEY,
+    digest_key TEXT NOT NULL,
+    idempotency_id VARCHAR(255) NOT NULL,
+    correlation_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    subject TEXT NOT NULL,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (digest_key) REFERENCES notification_digests(digest_key) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_digest_items_digest_key ON notification_digest_items(digest_key, id);
+
+-- What became of the notification of an event to one channel and recipient
+-- (sent, deferred to a digest or failed for good). A redelivery of the
+-- event skips these targets. recipient_id is '' for the channels routed by
+-- status
+CREATE TABLE IF NOT EXISTS notification_outcomes (
+    event_id VARCHAR(255) NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    recipient_id VARCHAR(64) NOT NULL DEFAULT '',
+    outcome VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (event_id, channel, recipient_id)
+);
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Page sizes of ListMessages
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+var ErrInvalidCursor = errors.New("invalid pagination cursor")
+
+// MessageFilter selects messages. Zero fields are ignored; time ranges
+// include their lower bound and exclude their upper bound
+type MessageFilter struct {
+	CorrelationID string
+	Statuses      []string
+	CreatedFrom   time.Time
+	CreatedTo     time.Time
+	UpdatedFrom   time.Time
+	UpdatedTo     time.Time
+	// Payload matches messages whose payload contains this JSON document
+	// (JSONB containment, e.g. {"customer": {"tier": "gold"}})
+	Payload map[string]interface{}
+}
+
+// MessageQuery is a filtered, paginated message listing. Messages are
+// returned newest first
+type MessageQuery struct {
+	MessageFilter
+	// Limit is the page size (DefaultPageSize if zero, capped at MaxPageSize)
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first one
+	Cursor string
+}
+
+// MessagePage is one page of a listing. NextCursor is empty on the last page;
+// Total counts every message matching the filter, across all pages
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Total      int64     `json:"total"`
+}
+
+// cursor is the keyset position after the last message of a page
+type cursor struct {
+	CreatedAt     time.Time `json:"c"`
+	IdempotencyID string    `json:"i"`
+}
+
+func encodeCursor(msg *Message) string {
+	data, _ := json.Marshal(cursor{CreatedAt: msg.CreatedAt, IdempotencyID: msg.IdempotencyID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.IdempotencyID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// whereClause accumulates the SQL conditions of a filter and their
+// arguments, numbering placeholders in order
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument and returns its placeholder
+func (w *whereClause) arg(value interface{}) string {
+	w.args = append(w.args, value)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+func (w *whereClause) add(condition string) {
+	w.conditions = append(w.conditions, condition)
+}
+
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+func (f *MessageFilter) where() (*whereClause, error) {
+	w := &whereClause{}
+	if f.CorrelationID != "" {
+		w.add("correlation_id = " + w.arg(f.CorrelationID))
+	}
+	if len(f.Statuses) > 0 {
+		placeholders := make([]string, len(f.Statuses))
+		for i, status := range f.Statuses {
+			if !IsKnownStatus(status) {
+				return nil, fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+			}
+			placeholders[i] = w.arg(status)
+		}
+		w.add("status IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+	if !f.CreatedFrom.IsZero() {
+		w.add("created_at >= " + w.arg(f.CreatedFrom.UTC()))
+	}
+	if !f.CreatedTo.IsZero() {
+		w.add("created_at < " + w.arg(f.CreatedTo.UTC()))
+	}
+	if !f.UpdatedFrom.IsZero() {
+		w.add("updated_at >= " + w.arg(f.UpdatedFrom.UTC()))
+	}
+	if !f.UpdatedTo.IsZero() {
+		w.add("updated_at < " + w.arg(f.UpdatedTo.UTC()))
+	}
+	if len(f.Payload) > 0 {
+		payloadJSON, err := json.Marshal(f.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload filter: %w", err)
+		}
+		w.add("payload @> " + w.arg(string(payloadJSON)) + "::jsonb")
+	}
+	return w, nil
+}
+
+// ListMessages returns a page of the messages matching query, newest first,
+// using keyset pagination on (created_at, idempotency_id) so deep pages cost
+// the same as the first one and concurrent inserts do not shift pages
+func (r *Repository) ListMessages(ctx context.Context, query MessageQuery) (_ *MessagePage, err error) {
+	ctx, end := r.startOperation(ctx, "list_messages")
+	defer end(&err)
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	where, err := query.where()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{Messages: []Message{}}
+	countQuery := `SELECT COUNT(*) FROM messages ` + where.String()
+	if err := r.db.QueryRowContext(ctx, countQuery, where.args...).Scan(&page.Total); err != nil {
+		return nil, fmt.Errorf("failed to count messages: %w", err)
+	}
+
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		where.add("(created_at, idempotency_id) < (" + where.arg(after.CreatedAt) + ", " + where.arg(after.IdempotencyID) + ")")
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	limitArg := where.arg(limit + 1)
+	listQuery := fmt.Sprintf(`
+		SELECT `+messageColumns+`
+		FROM messages
+		%s
+		ORDER BY created_at DESC, idempotency_id DESC
+		LIMIT %s
+	`, where.String(), limitArg)
+
+	rows, err := r.db.QueryContext(ctx, listQuery, where.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		page.Messages = append(page.Messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	if len(page.Messages) > limit {
+		page.Messages = page.Messages[:limit]
+		page.NextCursor = encodeCursor(&page.Messages[limit-1])
+	}
+
+	return page, nil
+}
+
+// ListMessagesByCorrelationID returns a page of the messages of one
+// correlation ID, newest first
+func (r *Repository) ListMessagesByCorrelationID(ctx context.Context, correlationID string, limit int, cursor string) (*MessagePage, error) {
+	return r.ListMessages(ctx, MessageQuery{
+		MessageFilter: MessageFilter{CorrelationID: correlationID},
+		Limit:         limit,
+		Cursor:        cursor,
+	})
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Message statuses. A message starts pending, is picked up (processing) and
+// ends processed or failed; it can be cancelled while not yet finished, and
+// failed without ever being picked up (by the stuck-message reconciler)
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusProcessed  = "processed"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+var (
+	ErrMessageNotFound   = errors.New("message not found")
+	ErrUnknownStatus     = errors.New("unknown message status")
+	ErrIllegalTransition = errors.New("illegal status transition")
+	ErrVersionConflict   = errors.New("message was modified concurrently")
+)
+
+// transitions lists, for each status, the statuses it can move to. Final
+// statuses have no entry
+var transitions = map[string][]string{
+	StatusPending:    {StatusProcessing, StatusFailed, StatusCancelled},
+	StatusProcessing: {StatusProcessed, StatusFailed, StatusCancelled},
+}
+
+// IsKnownStatus reports whether status is part of the state machine
+func IsKnownStatus(status string) bool {
+	switch status {
+	case StatusPending, StatusProcessing, StatusProcessed, StatusFailed, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// IsFinalStatus reports whether no transition leaves status
+func IsFinalStatus(status string) bool {
+	return IsKnownStatus(status) && len(transitions[status]) == 0
+}
+
+// CanTransition reports whether a message can move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError reports a status update the repository refused. Err is
+// ErrIllegalTransition, ErrUnknownStatus or ErrVersionConflict
+type TransitionError struct {
+	IdempotencyID string
+	From          string
+	To            string
+	Version       int64 // version the update expected
+	Err           error
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("message %s: %s -> %s (version %d): %v", e.IdempotencyID, e.From, e.To, e.Version, e.Err)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return e.Err
+}
+
+// checkTransition validates the move from one status to another
+func checkTransition(from, to string) error {
+	if !IsKnownStatus(to) {
+		return ErrUnknownStatus
+	}
+	if !CanTransition(from, to) {
+		return ErrIllegalTransition
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// MessageStore is the message persistence the services depend on.
+// Repository implements it on PostgreSQL; tests and alternative backends
+// can provide their own. The notification tables have their own
+// interfaces: DeliveryLog, SubscriptionStore and ThrottleStore
+type MessageStore interface {
+	// CreateOrGetMessage creates a pending message, or returns the existing
+	// one with exists set (idempotency check)
+	CreateOrGetMessage(ctx context.Context, idempotencyID, correlationID string, payload map[string]interface{}) (msg *Message, exists bool, err error)
+	// UpdateMessageStatus moves a message to status, enforcing the status
+	// state machine
+	UpdateMessageStatus(ctx context.Context, idempotencyID, correlationID, status, serviceName, eventID string, errorMsg *string) error
+	// CompareAndSwapStatus moves a message to status if it is still at
+	// expectedVersion, and returns the new version
+	CompareAndSwapStatus(ctx context.Context, idempotencyID, correlationID string, expectedVersion int64, status, serviceName, eventID string, errorMsg *string) (int64, error)
+	// ClaimMessage moves a pending (or expired processing) message to
+	// processing under a lease held by owner for ttl
+	ClaimMessage(ctx context.Context, idempotencyID, correlationID, owner string, ttl time.Duration, serviceName, eventID string) (*Message, error)
+	// RenewLease extends the lease owner holds on a processing message
+	RenewLease(ctx context.Context, idempotencyID, owner string, ttl time.Duration) error
+	// UpdateMessagePayload replaces the payload of a message if it is still
+	// at expectedVersion, and returns the new version
+	UpdateMessagePayload(ctx context.Context, idempotencyID string, expectedVersion int64, payload map[string]interface{}) (int64, error)
+	GetMessage(ctx context.Context, idempotencyID string) (*Message, error)
+	GetMessageHistory(ctx context.Context, idempotencyID string) ([]MessageHistory, error)
+	// ListHistoryAfter returns the accepted status changes of a message or
+	// correlation ID recorded after a history entry, oldest first
+	ListHistoryAfter(ctx context.Context, query HistoryQuery) ([]MessageHistory, error)
+	// ListMessages returns a page of the messages matching query, newest
+	// first, with keyset pagination
+	ListMessages(ctx context.Context, query MessageQuery) (*MessagePage, error)
+
+	// FindStuckMessages returns the pending and processing messages stuck
+	// according to criteria
+	FindStuckMessages(ctx context.Context, criteria StuckCriteria) ([]Message, error)
+	// MarkRepublished records a republish of msg by the reconciler
+	MarkRepublished(ctx context.Context, msg *Message, serviceName, eventID string) error
+	// FailStuckMessage moves a stuck message to failed
+	FailStuckMessage(ctx context.Context, msg *Message, reason, serviceName string) error
+
+	RecordTiming(ctx context.Context, timing *MessageTiming) error
+	GetMessageTimings(ctx context.Context, idempotencyID string) ([]MessageTiming, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// DeliveryLog records the attempts to deliver notifications and their
+// outcomes
+type DeliveryLog interface {
+	// RecordDeliveryAttempt stores one attempt to deliver a notification
+	RecordDeliveryAttempt(ctx context.Context, delivery *NotificationDelivery) error
+	// FindFailedDeliveries returns the last attempt of the deliveries that
+	// were not delivered, for replay
+	FindFailedDeliveries(ctx context.Context, criteria FailedDeliveryCriteria) ([]NotificationDelivery, error)
+	GetMessageDeliveries(ctx context.Context, idempotencyID string) ([]NotificationDelivery, error)
+	// RecordNotificationOutcome stores what became of the notification of
+	// an event to a target, so redeliveries of the event skip it
+	RecordNotificationOutcome(ctx context.Context, outcome *NotificationOutcome) error
+	ListNotificationOutcomes(ctx context.Context, eventID string) ([]NotificationOutcome, error)
+}
+
+// SubscriptionStore keeps the notification recipients and their
+// subscriptions
+type SubscriptionStore interface {
+	// SaveRecipient creates or updates a recipient and replaces its
+	// subscriptions, keeping its opt-outs
+	SaveRecipient(ctx context.Context, recipient *Recipient) error
+	// SetOptOut opts a recipient out of a channel (every channel if empty),
+	// or back in
+	SetOptOut(ctx context.Context, recipientID, channel string, optedOut bool) error
+	ListRecipients(ctx context.Context, recipientID string) ([]Recipient, error)
+	// ResolveSubscribers returns the subscriptions matching a status update
+	// whose recipients did not opt out
+	ResolveSubscribers(ctx context.Context, query SubscriberQuery) ([]Subscriber, error)
+}
+
+// ThrottleStore keeps the rate limit counters and digests of notifications
+type ThrottleStore interface {
+	// AcquireRateLimits counts a notification against every limit, or
+	// returns the limit reached without counting it
+	AcquireRateLimits(ctx context.Context, limits []RateLimit) (*RateLimitExceeded, error)
+	// AddDigestItem adds a notification to a digest, created due after
+	// delay if it does not exist
+	AddDigestItem(ctx context.Context, digest *Digest, item *DigestItem, delay time.Duration) error
+	// ClaimDueDigests leases the digests that are due, with their items
+	ClaimDueDigests(ctx context.Context, lease time.Duration, limit int) ([]Digest, error)
+	// CompleteDigest removes the sent items of a digest
+	CompleteDigest(ctx context.Context, digest *Digest) error
+}
+
+var (
+	_ MessageStore      = (*Repository)(nil)
+	_ DeliveryLog       = (*Repository)(nil)
+	_ SubscriptionStore = (*Repository)(nil)
+	_ ThrottleStore     = (*Repository)(nil)
+)
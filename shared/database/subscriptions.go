@@ -0,0 +1,449 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+
+// quietHoursLayout is the format of quiet hour bounds ("22:00")
+const quietHoursLayout = "15:04"
+
+// Recipient is someone notified about messages, with their preferences
+type Recipient struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+	// Locale picks the templates of the notifications ("pt-BR"); empty
+	// uses the default locale
+	Locale string `json:"locale,omitempty"`
+
+	// QuietHoursStart and QuietHoursEnd ("22:00", "07:00", in Timezone)
+	// bound the daily period without notifications; empty means none. The
+	// period may cross midnight
+	QuietHoursStart string `json:"quiet_hours_start,omitempty"`
+	QuietHoursEnd   string `json:"quiet_hours_end,omitempty"`
+
+	// OptedOut stops every notification to the recipient;
+	// OptedOutChannels stops only those channels. They are set by the
+	// recipient (SetOptOut) and kept by SaveRecipient
+	OptedOut         bool     `json:"opted_out"`
+	OptedOutChannels []string `json:"opted_out_channels,omitempty"`
+
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Subscription is the interest of a recipient in some status updates,
+// delivered through one channel
+type Subscription struct {
+	ID          int64  `json:"id"`
+	RecipientID string `json:"recipient_id"`
+	Channel     string `json:"channel"`
+	// Address is where the channel delivers (email address, webhook URL);
+	// empty uses the address configured for the channel
+	Address string `json:"address,omitempty"`
+
+	// Statuses filters the status updates; empty matches every status
+	Statuses []string `json:"statuses,omitempty"`
+	// CorrelationID, if set, matches only the messages of that correlation
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Metadata, if set, matches only the messages whose payload metadata
+	// contains it (JSONB containment)
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// DigestWindow ("15m") batches the notifications into one digest sent
+	// a window after the first of them; empty sends them at once
+	DigestWindow string `json:"digest_window,omitempty"`
+
+	// Disabled pauses the subscription
+	Disabled  bool      `json:"disabled,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscriber is a subscription matched by a status update, with its
+// recipient
+type Subscriber struct {
+	Recipient    Recipient
+	Subscription Subscription
+}
+
+// SubscriberQuery describes a status update to resolve subscribers for
+type SubscriberQuery struct {
+	Status        string
+	CorrelationID string
+	// Metadata is the metadata of the message payload
+	Metadata map[string]interface{}
+}
+
+// Validate checks the timezone, quiet hours and subscriptions of r
+func (r *Recipient) Validate() error {
+	if r.ID == "" {
+		return fmt.Errorf("recipient id is required")
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return fmt.Errorf("recipient %s: invalid timezone %q: %w", r.ID, r.Timezone, err)
+	}
+	if (r.QuietHoursStart == "") != (r.QuietHoursEnd == "") {
+		return fmt.Errorf("recipient %s: quiet hours require both start and end", r.ID)
+	}
+	for _, bound := range []string{r.QuietHoursStart, r.QuietHoursEnd} {
+		if _, err := time.Parse(quietHoursLayout, bound); bound != "" && err != nil {
+			return fmt.Errorf("recipient %s: invalid quiet hours bound %q (expected HH:MM)", r.ID, bound)
+		}
+	}
+	for _, s := range r.Subscriptions {
+		if s.Channel == "" {
+			return fmt.Errorf("recipient %s: subscription channel is required", r.ID)
+		}
+		for _, status := range s.Statuses {
+			if !IsKnownStatus(status) {
+				return fmt.Errorf("recipient %s: %w: %q", r.ID, ErrUnknownStatus, status)
+			}
+		}
+		if _, err := s.Digest(); err != nil {
+			return fmt.Errorf("recipient %s: %w", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// Digest returns the digest window of s, zero when it is not digested
+func (s *Subscription) Digest() (time.Duration, error) {
+	if s.DigestWindow == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(s.DigestWindow)
+	if err != nil || window < time.Second {
+		return 0, fmt.Errorf("invalid digest window %q (expected a duration of at least 1s, such as 15m)", s.DigestWindow)
+	}
+	return window, nil
+}
+
+// InQuietHours reports whether t falls in the quiet hours of r, in its
+// timezone
+func (r *Recipient) InQuietHours(t time.Time) bool {
+	if r.QuietHoursStart == "" || r.QuietHoursEnd == "" {
+		return false
+	}
+	start, errStart := time.Parse(quietHoursLayout, r.QuietHoursStart)
+	end, errEnd := time.Parse(quietHoursLayout, r.QuietHoursEnd)
+	location, errLocation := time.LoadLocation(r.Timezone)
+	if errStart != nil || errEnd != nil || errLocation != nil {
+		return false
+	}
+
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	// The period crosses midnight
+	return minute >= from || minute < to
+}
+
+const recipientColumns = `r.id, r.name, r.timezone, r.locale, COALESCE(to_char(r.quiet_hours_start, 'HH24:MI'), ''),
+	COALESCE(to_char(r.quiet_hours_end, 'HH24:MI'), ''), r.opted_out, r.opted_out_channels, r.created_at, r.updated_at`
+
+const subscriptionColumns = `s.id, s.recipient_id, s.channel, s.address, s.statuses, COALESCE(s.correlation_id, ''),
+	s.metadata_match, s.digest_window_seconds, s.disabled, s.created_at`
+
+// SaveRecipient creates or updates a recipient and replaces its
+// subscriptions with r.Subscriptions. The opt-outs of an existing recipient
+// are kept, since they belong to the recipient
+func (r *Repository) SaveRecipient(ctx context.Context, recipient *Recipient) (err error) {
+	ctx, end := r.startOperation(ctx, "save_recipient")
+	defer end(&err)
+
+	if recipient.Timezone == "" {
+		recipient.Timezone = "UTC"
+	}
+	if err := recipient.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO notification_recipients (id, name, timezone, locale, quiet_hours_start, quiet_hours_end, opted_out, opted_out_channels, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::time, NULLIF($6, '')::time, $7, $8, NOW(), NOW())
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			timezone = EXCLUDED.timezone,
+			locale = EXCLUDED.locale,
+			quiet_hours_start = EXCLUDED.quiet_hours_start,
+			quiet_hours_end = EXCLUDED.quiet_hours_end,
+			updated_at = NOW()
+	`
+	optedOutChannels := recipient.OptedOutChannels
+	if optedOutChannels == nil {
+		optedOutChannels = []string{}
+	}
+	_, err = tx.ExecContext(ctx, query,
+		recipient.ID,
+		recipient.Name,
+		recipient.Timezone,
+		recipient.Locale,
+		recipient.QuietHoursStart,
+		recipient.QuietHoursEnd,
+		recipient.OptedOut,
+		pq.Array(optedOutChannels),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save recipient: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM notification_subscriptions WHERE recipient_id = $1`, recipient.ID); err != nil {
+		return fmt.Errorf("failed to replace subscriptions: %w", err)
+	}
+	for i := range recipient.Subscriptions {
+		s := &recipient.Subscriptions[i]
+		s.RecipientID = recipient.ID
+
+		var metadata interface{}
+		if s.Metadata != nil {
+			data, err := json.Marshal(s.Metadata)
+			if err != nil {
+				return fmt.Errorf("failed to marshal subscription metadata: %w", err)
+			}
+			metadata = string(data)
+		}
+		statuses := s.Statuses
+		if statuses == nil {
+			statuses = []string{}
+		}
+		window, _ := s.Digest()
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO notification_subscriptions (recipient_id, channel, address, statuses, correlation_id, metadata_match, digest_window_seconds, disabled, created_at)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, NOW())
+			RETURNING id, created_at
+		`, s.RecipientID, s.Channel, s.Address, pq.Array(statuses), s.CorrelationID, metadata, int(window.Seconds()), s.Disabled).Scan(&s.ID, &s.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert subscription: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit recipient: %w", err)
+	}
+	return nil
+}
+
+// SetOptOut opts a recipient out of channel, or back in. An empty channel
+// applies to every channel: opting back in also clears the per-channel
+// opt-outs
+func (r *Repository) SetOptOut(ctx context.Context, recipientID, channel string, optedOut bool) (err error) {
+	ctx, end := r.startOperation(ctx, "set_opt_out")
+	defer end(&err)
+
+	var query string
+	switch {
+	case channel == "" && optedOut:
+		query = `UPDATE notification_recipients SET opted_out = TRUE, updated_at = NOW() WHERE id = $1`
+	case channel == "":
+		query = `UPDATE notification_recipients SET opted_out = FALSE, opted_out_channels = '{}', updated_at = NOW() WHERE id = $1`
+	case optedOut:
+		query = `
+			UPDATE notification_recipients
+			SET opted_out_channels = array_append(array_remove(opted_out_channels, $2), $2), updated_at = NOW()
+			WHERE id = $1`
+	default:
+		query = `
+			UPDATE notification_recipients
+			SET opted_out_channels = array_remove(opted_out_channels, $2), updated_at = NOW()
+			WHERE id = $1`
+	}
+
+	args := []interface{}{recipientID}
+	if channel != "" {
+		args = append(args, channel)
+	}
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update opt-out: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: %s", ErrRecipientNotFound, recipientID)
+	}
+	return nil
+}
+
+// ListRecipients returns the recipients, or only recipientID if set, with
+// their subscriptions
+func (r *Repository) ListRecipients(ctx context.Context, recipientID string) (_ []Recipient, err error) {
+	ctx, end := r.startOperation(ctx, "list_recipients")
+	defer end(&err)
+
+	query := `
+		SELECT ` + recipientColumns + `, ` + subscriptionColumns + `
+		FROM notification_recipients r
+		LEFT JOIN notification_subscriptions s ON s.recipient_id = r.id
+		WHERE $1 = '' OR r.id = $1
+		ORDER BY r.id, s.id
+	`
+	rows, err := r.db.QueryContext(ctx, query, recipientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recipients: %w", err)
+	}
+	defer rows.Close()
+
+	var recipients []Recipient
+	for rows.Next() {
+		var recipient Recipient
+		var sub nullableSubscription
+		if err := rows.Scan(append(recipientDest(&recipient), sub.dest()...)...); err != nil {
+			return nil, fmt.Errorf("failed to scan recipient: %w", err)
+		}
+		if n := len(recipients); n == 0 || recipients[n-1].ID != recipient.ID {
+			recipients = append(recipients, recipient)
+		}
+		if sub.ID.Valid {
+			s, err := sub.subscription()
+			if err != nil {
+				return nil, err
+			}
+			last := &recipients[len(recipients)-1]
+			last.Subscriptions = append(last.Subscriptions, s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %w", err)
+	}
+	return recipients, nil
+}
+
+// ResolveSubscribers returns the active subscriptions matching a status
+// update, leaving out recipients that opted out of the channel. Quiet hours
+// are left to the caller (see Recipient.InQuietHours)
+func (r *Repository) ResolveSubscribers(ctx context.Context, query SubscriberQuery) (_ []Subscriber, err error) {
+	ctx, end := r.startOperation(ctx, "resolve_subscribers")
+	defer end(&err)
+
+	metadata := []byte("{}")
+	if query.Metadata != nil {
+		if metadata, err = json.Marshal(query.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+	}
+
+	sqlQuery := `
+		SELECT ` + recipientColumns + `, ` + subscriptionColumns + `
+		FROM notification_subscriptions s
+		JOIN notification_recipients r ON r.id = s.recipient_id
+		WHERE NOT s.disabled
+			AND NOT r.opted_out
+			AND NOT (s.channel = ANY(r.opted_out_channels))
+			AND (cardinality(s.statuses) = 0 OR $1 = ANY(s.statuses))
+			AND (s.correlation_id IS NULL OR s.correlation_id = $2)
+			AND (s.metadata_match IS NULL OR $3::jsonb @> s.metadata_match)
+		ORDER BY r.id, s.id
+	`
+	rows, err := r.db.QueryContext(ctx, sqlQuery, query.Status, query.CorrelationID, string(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscribers: %w", err)
+	}
+	defer rows.Close()
+
+	var subscribers []Subscriber
+	for rows.Next() {
+		var subscriber Subscriber
+		var sub nullableSubscription
+		if err := rows.Scan(append(recipientDest(&subscriber.Recipient), sub.dest()...)...); err != nil {
+			return nil, fmt.Errorf("failed to scan subscriber: %w", err)
+		}
+		if subscriber.Subscription, err = sub.subscription(); err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read subscribers: %w", err)
+	}
+	return subscribers, nil
+}
+
+func recipientDest(r *Recipient) []interface{} {
+	return []interface{}{
+		&r.ID,
+		&r.Name,
+		&r.Timezone,
+		&r.Locale,
+		&r.QuietHoursStart,
+		&r.QuietHoursEnd,
+		&r.OptedOut,
+		pq.Array(&r.OptedOutChannels),
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	}
+}
+
+// nullableSubscription scans subscriptionColumns, which are NULL for a
+// recipient without subscriptions in ListRecipients
+type nullableSubscription struct {
+	ID            sql.NullInt64
+	RecipientID   sql.NullString
+	Channel       sql.NullString
+	Address       sql.NullString
+	Statuses      []string
+	CorrelationID sql.NullString
+	Metadata      []byte
+	DigestWindow  sql.NullInt64
+	Disabled      sql.NullBool
+	CreatedAt     sql.NullTime
+}
+
+func (n *nullableSubscription) dest() []interface{} {
+	return []interface{}{
+		&n.ID,
+		&n.RecipientID,
+		&n.Channel,
+		&n.Address,
+		pq.Array(&n.Statuses),
+		&n.CorrelationID,
+		&n.Metadata,
+		&n.DigestWindow,
+		&n.Disabled,
+		&n.CreatedAt,
+	}
+}
+
+func (n *nullableSubscription) subscription() (Subscription, error) {
+	s := Subscription{
+		ID:            n.ID.Int64,
+		RecipientID:   n.RecipientID.String,
+		Channel:       n.Channel.String,
+		Address:       n.Address.String,
+		Statuses:      n.Statuses,
+		CorrelationID: n.CorrelationID.String,
+		Disabled:      n.Disabled.Bool,
+		CreatedAt:     n.CreatedAt.Time,
+	}
+	if n.DigestWindow.Int64 > 0 {
+		s.DigestWindow = (time.Duration(n.DigestWindow.Int64) * time.Second).String()
+	}
+	if n.Metadata != nil {
+		if err := json.Unmarshal(n.Metadata, &s.Metadata); err != nil {
+			return Subscription{}, fmt.Errorf("failed to unmarshal subscription metadata: %w", err)
+		}
+	}
+	return s, nil
+}
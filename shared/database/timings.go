@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MessageTiming is the latency breakdown of one event at one service (a hop
+// of the message path), stored in message_timings
+type MessageTiming struct {
+	ID                  int64     `json:"id"`
+	IdempotencyID       string    `json:"idempotency_id"`
+	CorrelationID       string    `json:"correlation_id"`
+	EventID             string    `json:"event_id"`
+	EventType           string    `json:"event_type"`
+	ServiceName         string    `json:"service_name"`
+	Broker              string    `json:"broker"`
+	Topic               string    `json:"topic"`
+	EventTimestamp      time.Time `json:"event_timestamp"`
+	ReceivedAt          time.Time `json:"received_at"`
+	HandledAt           time.Time `json:"handled_at"`
+	QueueLatencyMs      float64   `json:"queue_latency_ms"`
+	ProcessingLatencyMs float64   `json:"processing_latency_ms"`
+	Outcome             string    `json:"outcome"` // "success" or "error"
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// RecordTiming stores the timing of one hop. Timestamps are stored in UTC
+func (r *Repository) RecordTiming(ctx context.Context, timing *MessageTiming) (err error) {
+	ctx, end := r.startOperation(ctx, "record_timing")
+	defer end(&err)
+
+	query := `
+		INSERT INTO message_timings (idempotency_id, correlation_id, event_id, event_type, service_name, broker, topic,
+			event_timestamp, received_at, handled_at, queue_latency_ms, processing_latency_ms, outcome, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW())
+	`
+	_, err = r.db.ExecContext(ctx, query,
+		timing.IdempotencyID,
+		timing.CorrelationID,
+		timing.EventID,
+		timing.EventType,
+		timing.ServiceName,
+		timing.Broker,
+		timing.Topic,
+		timing.EventTimestamp.UTC(),
+		timing.ReceivedAt.UTC(),
+		timing.HandledAt.UTC(),
+		timing.QueueLatencyMs,
+		timing.ProcessingLatencyMs,
+		timing.Outcome,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert timing: %w", err)
+	}
+	return nil
+}
+
+// GetMessageTimings retrieves the timings of every hop of a message, in
+// the order the events were received
+func (r *Repository) GetMessageTimings(ctx context.Context, idempotencyID string) (_ []MessageTiming, err error) {
+	ctx, end := r.startOperation(ctx, "get_message_timings")
+	defer end(&err)
+
+	query := `
+		SELECT id, idempotency_id, correlation_id, event_id, event_type, service_name, broker, topic,
+			event_timestamp, received_at, handled_at, queue_latency_ms, processing_latency_ms, outcome, created_at
+		FROM message_timings
+		WHERE idempotency_id = $1
+		ORDER BY received_at ASC
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, idempotencyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query timings: %w", err)
+	}
+	defer rows.Close()
+
+	var timings []MessageTiming
+	for rows.Next() {
+		var t MessageTiming
+		err := rows.Scan(
+			&t.ID,
+			&t.IdempotencyID,
+			&t.CorrelationID,
+			&t.EventID,
+			&t.EventType,
+			&t.ServiceName,
+			&t.Broker,
+			&t.Topic,
+			&t.EventTimestamp,
+			&t.ReceivedAt,
+			&t.HandledAt,
+			&t.QueueLatencyMs,
+			&t.ProcessingLatencyMs,
+			&t.Outcome,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan timing: %w", err)
+		}
+		timings = append(timings, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read timings: %w", err)
+	}
+
+	return timings, nil
+}
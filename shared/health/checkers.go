@@ -0,0 +1,57 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Pinger is implemented by dependencies that can verify their connection
+// (database.Repository, messaging.MessageBroker...)
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks a dependency connection
+func Ping(name string, pinger Pinger) Checker {
+	return NewChecker(name, pinger.Ping)
+}
+
+// HeartbeatSource reports the last time a loop was known to make progress
+type HeartbeatSource interface {
+	LastHeartbeat() time.Time
+}
+
+// Heartbeat fails when source has not made progress for longer than maxAge
+func Heartbeat(name string, source HeartbeatSource, maxAge time.Duration) Checker {
+	return NewChecker(name, func(ctx context.Context) error {
+		last := source.LastHeartbeat()
+		if last.IsZero() {
+			return fmt.Errorf("no heartbeat")
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last heartbeat %s ago (max %s)", age.Round(time.Second), maxAge)
+		}
+		return nil
+	})
+}
+
+// LagSource reports how many messages are waiting to be consumed
+type LagSource interface {
+	Lag(ctx context.Context) (int64, error)
+}
+
+// ConsumerLag fails when source lags more than maxLag messages. A maxLag of
+// zero or less only reports errors fetching the lag
+func ConsumerLag(name string, source LagSource, maxLag int64) Checker {
+	return NewChecker(name, func(ctx context.Context) error {
+		lag, err := source.Lag(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get consumer lag: %w", err)
+		}
+		if maxLag > 0 && lag > maxLag {
+			return fmt.Errorf("consumer lag %d exceeds %d", lag, maxLag)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,4 @@
+module queue-microservice-case/shared/health
+
+go 1.21
+
@@ -0,0 +1,153 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCheckTimeout bounds how long a single checker may run
+const DefaultCheckTimeout = 2 * time.Second
+
+var ErrShuttingDown = errors.New("service is shutting down")
+
+// Checker reports the health of one dependency or component
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type checkerFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (c checkerFunc) Name() string                    { return c.name }
+func (c checkerFunc) Check(ctx context.Context) error { return c.check(ctx) }
+
+// NewChecker adapts a function to a Checker
+func NewChecker(name string, check func(ctx context.Context) error) Checker {
+	return checkerFunc{name: name, check: check}
+}
+
+// Health aggregates liveness and readiness checkers and serves them over
+// HTTP. Liveness answers "should this process be restarted?", readiness
+// answers "should this process receive work?"; readiness includes liveness
+type Health struct {
+	mu           sync.RWMutex
+	liveness     []Checker
+	readiness    []Checker
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+// New creates an empty set of checks
+func New() *Health {
+	return &Health{timeout: DefaultCheckTimeout}
+}
+
+// AddLivenessCheck registers a checker used by /healthz and /readyz
+func (h *Health) AddLivenessCheck(checker Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness = append(h.liveness, checker)
+}
+
+// AddReadinessCheck registers a checker used by /readyz
+func (h *Health) AddReadinessCheck(checker Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness = append(h.readiness, checker)
+}
+
+// MarkShuttingDown makes readiness fail, so the service stops receiving
+// traffic while it drains
+func (h *Health) MarkShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Register mounts /healthz and /readyz on mux
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.serveLiveness)
+	mux.HandleFunc("/readyz", h.serveReadiness)
+}
+
+// CheckResult is the outcome of one checker
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body returned by the endpoints
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+func (h *Health) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	checkers := append([]Checker(nil), h.liveness...)
+	h.mu.RUnlock()
+
+	h.writeReport(w, h.run(r.Context(), checkers))
+}
+
+func (h *Health) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	checkers := append(append([]Checker(nil), h.liveness...), h.readiness...)
+	h.mu.RUnlock()
+
+	report := h.run(r.Context(), checkers)
+	if h.shuttingDown.Load() {
+		report.Status = "fail"
+		report.Checks["shutdown"] = CheckResult{Status: "fail", Error: ErrShuttingDown.Error()}
+	}
+	h.writeReport(w, report)
+}
+
+// run executes the checkers concurrently, each with its own timeout
+func (h *Health) run(ctx context.Context, checkers []Checker) Report {
+	report := Report{Status: "ok", Checks: make(map[string]CheckResult, len(checkers))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, checker := range checkers {
+		wg.Add(1)
+		go func(checker Checker) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			result := CheckResult{Status: "ok"}
+			if err := checker.Check(checkCtx); err != nil {
+				result = CheckResult{Status: "fail", Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[checker.Name()] = result
+			if result.Status != "ok" {
+				report.Status = "fail"
+			}
+		}(checker)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func (h *Health) writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(report)
+}
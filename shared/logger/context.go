@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Fields are the IDs that identify what a log entry is about
+type Fields struct {
+	CorrelationID string
+	IdempotencyID string
+	EventID       string
+}
+
+type fieldsKey struct{}
+
+// ContextWithFields returns a copy of ctx carrying fields. Empty fields
+// keep the value already present in ctx
+func ContextWithFields(ctx context.Context, fields Fields) context.Context {
+	current := FieldsFromContext(ctx)
+	if fields.CorrelationID == "" {
+		fields.CorrelationID = current.CorrelationID
+	}
+	if fields.IdempotencyID == "" {
+		fields.IdempotencyID = current.IdempotencyID
+	}
+	if fields.EventID == "" {
+		fields.EventID = current.EventID
+	}
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// FieldsFromContext returns the fields attached to ctx, if any
+func FieldsFromContext(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// contextHandler adds the fields of the context, and the trace and span IDs
+// of the active span, to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if ctx != nil {
+		fields := FieldsFromContext(ctx)
+		if fields.CorrelationID != "" {
+			record.AddAttrs(slog.String("correlation_id", fields.CorrelationID))
+		}
+		if fields.IdempotencyID != "" {
+			record.AddAttrs(slog.String("idempotency_id", fields.IdempotencyID))
+		}
+		if fields.EventID != "" {
+			record.AddAttrs(slog.String("event_id", fields.EventID))
+		}
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			record.AddAttrs(
+				slog.String("trace_id", span.TraceID().String()),
+				slog.String("span_id", span.SpanID().String()),
+			)
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
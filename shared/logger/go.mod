@@ -2,3 +2,9 @@ module queue-microservice-case/shared/logger
 
 go 1.21
 
+require (
+	go.opentelemetry.io/otel/trace v1.28.0
+	queue-microservice-case/shared/redact v0.0.0
+)
+
+replace queue-microservice-case/shared/redact => ../redact
@@ -1,76 +1,180 @@
 package logger
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
+
+	"queue-microservice-case/shared/redact"
 )
 
-type LogEntry struct {
-	Level          string `json:"level"`
-	Service        string `json:"service"`
-	CorrelationID  string `json:"correlation_id,omitempty"`
-	IdempotencyID  string `json:"idempotency_id,omitempty"`
-	Message        string `json:"message"`
-	Timestamp      string `json:"timestamp"`
-	AdditionalData map[string]interface{} `json:"additional_data,omitempty"`
-}
+// Supported output formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
 
-type Logger struct {
-	serviceName string
+// Config selects the minimum level, format and destination of the logs,
+// and the redaction rules applied to every entry (nil disables redaction)
+type Config struct {
+	Level    slog.Level
+	Format   string
+	Writer   io.Writer
+	Redactor *redact.Redactor
 }
 
-func NewLogger(serviceName string) *Logger {
-	return &Logger{serviceName: serviceName}
-}
+// ConfigFromEnv reads LOG_LEVEL (DEBUG, INFO, WARN or ERROR; defaults to
+// INFO), LOG_FORMAT (json or text; defaults to json) and LOG_OUTPUT (stdout,
+// stderr or a file path; defaults to stdout). Redaction rules come from
+// redact.ConfigFromEnv
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Level: slog.LevelInfo, Format: FormatJSON, Writer: os.Stdout}
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := cfg.Level.UnmarshalText([]byte(level)); err != nil {
+			return Config{}, fmt.Errorf("invalid LOG_LEVEL %q: %w", level, err)
+		}
+	}
+
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", FormatJSON:
+	case FormatText:
+		cfg.Format = FormatText
+	default:
+		return Config{}, fmt.Errorf("unsupported LOG_FORMAT %q (supported: json, text)", format)
+	}
 
-func (l *Logger) log(level, message, correlationID, idempotencyID string, additionalData map[string]interface{}) {
-	entry := LogEntry{
-		Level:         level,
-		Service:       l.serviceName,
-		CorrelationID: correlationID,
-		IdempotencyID: idempotencyID,
-		Message:       message,
-		Timestamp:     getTimestamp(),
-		AdditionalData: additionalData,
+	switch output := os.Getenv("LOG_OUTPUT"); output {
+	case "", "stdout":
+	case "stderr":
+		cfg.Writer = os.Stderr
+	default:
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to open LOG_OUTPUT: %w", err)
+		}
+		cfg.Writer = file
 	}
 
-	jsonBytes, err := json.Marshal(entry)
+	redactor, err := redact.FromEnv()
 	if err != nil {
-		log.Printf("Failed to marshal log entry: %v", err)
-		return
+		return Config{}, fmt.Errorf("failed to load redaction rules: %w", err)
 	}
+	cfg.Redactor = redactor
 
-	log.Println(string(jsonBytes))
+	return cfg, nil
 }
 
-func (l *Logger) Info(message, correlationID, idempotencyID string, additionalData map[string]interface{}) {
-	l.log("INFO", message, correlationID, idempotencyID, additionalData)
+// Logger writes one structured line per entry with the service name, the
+// IDs found in the context (see ContextWithFields) and the given attributes
+type Logger struct {
+	slog *slog.Logger
 }
 
-func (l *Logger) Error(message, correlationID, idempotencyID string, err error, additionalData map[string]interface{}) {
-	if additionalData == nil {
-		additionalData = make(map[string]interface{})
-	}
+// NewLogger creates a logger configured from the environment
+func NewLogger(serviceName string) (*Logger, error) {
+	cfg, err := ConfigFromEnv()
 	if err != nil {
-		additionalData["error"] = err.Error()
+		return nil, err
 	}
-	l.log("ERROR", message, correlationID, idempotencyID, additionalData)
+	return New(serviceName, cfg), nil
 }
 
-func (l *Logger) Warn(message, correlationID, idempotencyID string, additionalData map[string]interface{}) {
-	l.log("WARN", message, correlationID, idempotencyID, additionalData)
+// New creates a logger for serviceName
+func New(serviceName string, cfg Config) *Logger {
+	if cfg.Writer == nil {
+		cfg.Writer = os.Stdout
+	}
+	opts := &slog.HandlerOptions{Level: cfg.Level, ReplaceAttr: replaceAttr(cfg.Redactor)}
+
+	var handler slog.Handler
+	if cfg.Format == FormatText {
+		handler = slog.NewTextHandler(cfg.Writer, opts)
+	} else {
+		handler = slog.NewJSONHandler(cfg.Writer, opts)
+	}
+	handler = &contextHandler{Handler: handler.WithAttrs([]slog.Attr{slog.String("service", serviceName)})}
+
+	return &Logger{slog: slog.New(handler)}
 }
 
-func (l *Logger) Debug(message, correlationID, idempotencyID string, additionalData map[string]interface{}) {
-	if os.Getenv("LOG_LEVEL") == "DEBUG" {
-		l.log("DEBUG", message, correlationID, idempotencyID, additionalData)
+// replaceAttr keeps the field names used by every service of the project
+// (timestamp, level, message), formats the time in UTC and redacts the
+// message and the attributes. Attribute paths join the groups and the key,
+// as in "payload.metadata.email"
+func replaceAttr(redactor *redact.Redactor) func(groups []string, attr slog.Attr) slog.Attr {
+	return func(groups []string, attr slog.Attr) slog.Attr {
+		if len(groups) == 0 {
+			switch attr.Key {
+			case slog.TimeKey:
+				return slog.String("timestamp", attr.Value.Time().UTC().Format(time.RFC3339Nano))
+			case slog.LevelKey:
+				return attr
+			case slog.MessageKey:
+				return slog.String("message", redactor.String(attr.Value.String()))
+			}
+		}
+		if redactor == nil {
+			return attr
+		}
+
+		path := strings.Join(append(groups[:len(groups):len(groups)], attr.Key), ".")
+		if redactor.Sensitive(path) {
+			return slog.String(attr.Key, redactor.Replace(attr.Value.Any()))
+		}
+		switch attr.Value.Kind() {
+		case slog.KindString:
+			attr.Value = slog.StringValue(redactor.String(attr.Value.String()))
+		case slog.KindAny:
+			attr.Value = slog.AnyValue(redactor.Value(path, attr.Value.Any()))
+		}
+		return attr
 	}
 }
 
-func getTimestamp() string {
-	// Use RFC3339 format (ISO-8601 compatible)
-	return time.Now().UTC().Format(time.RFC3339)
+// With returns a child logger that adds args (key-value pairs or
+// slog.Attr) to every entry
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{slog: l.slog.With(args...)}
 }
 
+// Slog returns the underlying slog.Logger
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
+}
+
+// SetDefault makes l the default slog logger, so entries written through
+// the std log package become structured lines too
+func (l *Logger) SetDefault() {
+	slog.SetDefault(l.slog)
+}
+
+func (l *Logger) Debug(ctx context.Context, message string, args ...any) {
+	l.slog.DebugContext(ctx, message, args...)
+}
+
+func (l *Logger) Info(ctx context.Context, message string, args ...any) {
+	l.slog.InfoContext(ctx, message, args...)
+}
+
+func (l *Logger) Warn(ctx context.Context, message string, args ...any) {
+	l.slog.WarnContext(ctx, message, args...)
+}
+
+// Error logs at ERROR level, adding err as the "error" attribute
+func (l *Logger) Error(ctx context.Context, message string, err error, args ...any) {
+	if err != nil {
+		args = append(args, slog.String("error", err.Error()))
+	}
+	l.slog.ErrorContext(ctx, message, args...)
+}
+
+// Fatal logs at ERROR level and exits the process with status 1
+func (l *Logger) Fatal(ctx context.Context, message string, err error, args ...any) {
+	l.Error(ctx, message, err, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,90 @@
+package messaging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"queue-microservice-case/shared/claimcheck"
+	"queue-microservice-case/shared/contracts"
+)
+
+// ClaimCheckPayloadKey is the only payload key of an event whose payload was
+// offloaded to the claim check store
+const ClaimCheckPayloadKey = "_claim_check"
+
+var ErrClaimCheckNotConfigured = errors.New("event payload was offloaded but no claim check store is configured")
+
+// claimChecker offloads payloads larger than threshold to store and
+// rehydrates them on consume
+type claimChecker struct {
+	store     claimcheck.Store
+	threshold int
+	ttl       time.Duration
+}
+
+// offload returns the event to publish: event itself when its payload is
+// small enough, otherwise a copy whose payload only references the blob
+func (c *claimChecker) offload(ctx context.Context, event *contracts.Event) (*contracts.Event, error) {
+	if c == nil {
+		return event, nil
+	}
+
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	if len(payload) <= c.threshold {
+		return event, nil
+	}
+
+	ref, err := c.store.Put(ctx, payload, c.ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to offload payload: %w", err)
+	}
+
+	checksum := sha256.Sum256(payload)
+	offloaded := *event
+	offloaded.Payload = map[string]interface{}{
+		ClaimCheckPayloadKey: map[string]interface{}{
+			"ref":    ref,
+			"size":   len(payload),
+			"sha256": hex.EncodeToString(checksum[:]),
+		},
+	}
+	return &offloaded, nil
+}
+
+// rehydrate replaces a claim check reference with the stored payload.
+// Events that were not offloaded are left untouched
+func (c *claimChecker) rehydrate(ctx context.Context, event *contracts.Event) error {
+	reference, ok := event.Payload[ClaimCheckPayloadKey].(map[string]interface{})
+	if !ok || len(event.Payload) != 1 {
+		return nil
+	}
+	if c == nil {
+		return ErrClaimCheckNotConfigured
+	}
+
+	ref, _ := reference["ref"].(string)
+	payload, err := c.store.Get(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("failed to rehydrate payload: %w", err)
+	}
+
+	checksum := sha256.Sum256(payload)
+	if expected, _ := reference["sha256"].(string); expected != hex.EncodeToString(checksum[:]) {
+		return fmt.Errorf("claim check blob %s does not match its checksum", ref)
+	}
+
+	var rehydrated map[string]interface{}
+	if err := json.Unmarshal(payload, &rehydrated); err != nil {
+		return fmt.Errorf("failed to unmarshal rehydrated payload: %w", err)
+	}
+	event.Payload = rehydrated
+	return nil
+}
@@ -0,0 +1,30 @@
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Delivery carries the transport-level details of a consumed message
+// (topic, headers and the raw body) so that middlewares can inspect what
+// was actually received, not only the decoded event
+type Delivery struct {
+	Broker     string // "kafka" or "rabbitmq"
+	Topic      string
+	Headers    map[string]string
+	Body       []byte
+	ReceivedAt time.Time
+}
+
+type deliveryKey struct{}
+
+// ContextWithDelivery returns a copy of ctx carrying the delivery
+func ContextWithDelivery(ctx context.Context, delivery *Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, delivery)
+}
+
+// DeliveryFromContext returns the delivery attached by the broker, if any
+func DeliveryFromContext(ctx context.Context) (*Delivery, bool) {
+	delivery, ok := ctx.Value(deliveryKey{}).(*Delivery)
+	return delivery, ok && delivery != nil
+}
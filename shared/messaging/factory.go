@@ -3,11 +3,73 @@ package messaging
 import (
 	"fmt"
 	"os"
+	"time"
+
+	"queue-microservice-case/shared/claimcheck"
+	"queue-microservice-case/shared/redact"
 )
 
+// Option configures optional broker behaviour
+type Option func(*brokerOptions)
+
+type brokerOptions struct {
+	keys       *KeyRing
+	claimCheck *claimChecker
+	redactor   *redact.Redactor
+	broadcast  string
+}
+
+// WithKeyRing signs every published event with the active key of keys
+func WithKeyRing(keys *KeyRing) Option {
+	return func(o *brokerOptions) {
+		o.keys = keys
+	}
+}
+
+// WithClaimCheck offloads payloads larger than threshold bytes to store,
+// keeping them for ttl, and rehydrates offloaded payloads on consume.
+// A nil store disables the claim check
+func WithClaimCheck(store claimcheck.Store, threshold int, ttl time.Duration) Option {
+	return func(o *brokerOptions) {
+		if store != nil {
+			o.claimCheck = &claimChecker{store: store, threshold: threshold, ttl: ttl}
+		}
+	}
+}
+
+// WithRedactor redacts the original payload and the error message of DLQ
+// records before they are published. A nil redactor disables redaction
+func WithRedactor(redactor *redact.Redactor) Option {
+	return func(o *brokerOptions) {
+		o.redactor = redactor
+	}
+}
+
+// WithBroadcast makes every subscription receive all the events published
+// to its topic from then on, instead of sharing them with the other
+// consumers of the topic. consumer must be unique per process, such as the
+// pod name. On Kafka it is the consumer group, starting at the newest
+// offset; on RabbitMQ it names an exclusive queue, deleted with the
+// connection, bound to the fanout exchange of the topic. Events missed
+// while disconnected are not redelivered. PublishToDLQ does nothing: the
+// consumers sharing the topic dead-letter its invalid events once
+func WithBroadcast(consumer string) Option {
+	return func(o *brokerOptions) {
+		o.broadcast = consumer
+	}
+}
+
+func newBrokerOptions(opts []Option) brokerOptions {
+	var o brokerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // NewMessageBroker creates a message broker based on MESSAGE_BROKER environment variable
 // Supported values: "kafka", "rabbit" or "rabbitmq"
-func NewMessageBroker() (MessageBroker, error) {
+func NewMessageBroker(opts ...Option) (MessageBroker, error) {
 	brokerType := os.Getenv("MESSAGE_BROKER")
 	if brokerType == "" {
 		brokerType = "kafka" // default
@@ -16,10 +78,10 @@ func NewMessageBroker() (MessageBroker, error) {
 	switch brokerType {
 	case "kafka":
 		brokers := getKafkaBrokers()
-		return NewKafkaBroker(brokers)
+		return NewKafkaBroker(brokers, opts...)
 	case "rabbit", "rabbitmq":
 		url := getRabbitMQURL()
-		return NewRabbitMQBroker(url)
+		return NewRabbitMQBroker(url, opts...)
 	default:
 		return nil, fmt.Errorf("unsupported message broker: %s (supported: kafka, rabbit, rabbitmq)", brokerType)
 	}
@@ -41,4 +103,3 @@ func getRabbitMQURL() string {
 	}
 	return url
 }
-
@@ -5,5 +5,24 @@ go 1.21
 require (
 	github.com/IBM/sarama v1.42.1
 	github.com/streadway/amqp v1.1.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	queue-microservice-case/shared/claimcheck v0.0.0
+	queue-microservice-case/shared/contracts v0.0.0
+	queue-microservice-case/shared/database v0.0.0
+	queue-microservice-case/shared/logger v0.0.0
+	queue-microservice-case/shared/metrics v0.0.0
+	queue-microservice-case/shared/redact v0.0.0
 )
 
+replace queue-microservice-case/shared/claimcheck => ../claimcheck
+
+replace queue-microservice-case/shared/contracts => ../contracts
+
+replace queue-microservice-case/shared/database => ../database
+
+replace queue-microservice-case/shared/logger => ../logger
+
+replace queue-microservice-case/shared/metrics => ../metrics
+
+replace queue-microservice-case/shared/redact => ../redact
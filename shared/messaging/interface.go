@@ -2,7 +2,10 @@ package messaging
 
 import (
 	"context"
+	"time"
+
 	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/redact"
 )
 
 // MessageBroker defines the interface for message brokers
@@ -15,15 +18,47 @@ type MessageBroker interface {
 	// Subscribe starts consuming events from a topic/queue
 	// The handler function will be called for each message
 	// If the handler returns an error, the message will be retried or sent to DLQ
-	Subscribe(ctx context.Context, topic string, handler MessageHandler) error
+	Subscribe(ctx context.Context, topic string, handler MessageHandler) (Subscription, error)
 
-	// PublishToDLQ sends a failed event to the Dead Letter Queue
+	// PublishToDLQ sends a failed event to the Dead Letter Queue.
+	// The whole DLQEvent record is published and, unlike Publish, the
+	// original event is not validated, since it may be the reason it failed
 	PublishToDLQ(ctx context.Context, topic string, dlqEvent *DLQEvent) error
 
-	// Close gracefully closes the broker connection
+	// Ping reports whether the broker connection is usable. It fails while
+	// the connection is being re-established
+	Ping(ctx context.Context) error
+
+	// Shutdown stops fetching on every subscription and waits for in-flight
+	// handlers until ctx is done. Messages whose handler finished are
+	// acknowledged/committed; the others are left for redelivery
+	Shutdown(ctx context.Context) error
+
+	// Close closes the broker connection. Call Shutdown first to drain
+	// in-flight messages
 	Close() error
 }
 
+// Subscription is a handle on a running consumer
+type Subscription interface {
+	// Topic returns the subscribed topic/queue
+	Topic() string
+
+	// Drain stops fetching and waits for the in-flight handler until ctx is
+	// done, leaving an unfinished message for redelivery
+	Drain(ctx context.Context) error
+
+	// Done is closed once the consumer has stopped
+	Done() <-chan struct{}
+
+	// LastHeartbeat returns the last time the consumer loop was known to
+	// make progress (zero once it has stopped)
+	LastHeartbeat() time.Time
+
+	// Lag returns the number of messages waiting to be consumed
+	Lag(ctx context.Context) (int64, error)
+}
+
 // MessageHandler processes a single event
 // Returns error if processing failed and should be retried/sent to DLQ
 type MessageHandler func(ctx context.Context, event *contracts.Event) error
@@ -32,7 +67,45 @@ type MessageHandler func(ctx context.Context, event *contracts.Event) error
 type DLQEvent struct {
 	OriginalEvent *contracts.Event `json:"original_event"`
 	Error         string           `json:"error"`
+	ErrorField    string           `json:"error_field,omitempty"` // set when the event failed validation
 	RetryCount    int              `json:"retry_count"`
-	LastAttempt   string           `json:"last_attempt"` // ISO-8601 timestamp
+	LastAttempt   string           `json:"last_attempt"`          // ISO-8601 timestamp
+	ReasonCode    string           `json:"reason_code,omitempty"` // set by the service that gave up on the event
+	Service       string           `json:"service,omitempty"`     // service that dead-lettered the event
+}
+
+// NewDLQEvent builds the DLQ record for event, filling ErrorField when err
+// is a contracts.ValidationError
+func NewDLQEvent(event *contracts.Event, err error, retryCount int) *DLQEvent {
+	return &DLQEvent{
+		OriginalEvent: event,
+		Error:         err.Error(),
+		ErrorField:    contracts.ValidationField(err),
+		RetryCount:    retryCount,
+		LastAttempt:   time.Now().UTC().Format(time.RFC3339),
+	}
 }
 
+// redacted returns a copy of e with the sensitive data of the original
+// payload and of the error message redacted by r
+func (e *DLQEvent) redacted(r *redact.Redactor) *DLQEvent {
+	if r == nil {
+		return e
+	}
+	record := *e
+	record.Error = r.String(e.Error)
+	if e.OriginalEvent != nil {
+		event := *e.OriginalEvent
+		event.Payload = r.Payload(event.Payload)
+		record.OriginalEvent = &event
+	}
+	return &record
+}
+
+// reason classifies the DLQ record for metrics
+func (e *DLQEvent) reason() string {
+	if e.ErrorField != "" {
+		return "invalid_event"
+	}
+	return "processing_failed"
+}
@@ -5,21 +5,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/metrics"
 )
 
+// brokerKafka labels the Kafka metrics
+const brokerKafka = "kafka"
+
 type KafkaBroker struct {
+	client   sarama.Client
 	producer sarama.SyncProducer
 	consumer sarama.ConsumerGroup
 	config   *sarama.Config
 	brokers  []string
+	options  brokerOptions
+
+	subscriptions subscriptions
 }
 
 // NewKafkaBroker creates a new Kafka broker instance
-func NewKafkaBroker(brokers []string) (*KafkaBroker, error) {
+func NewKafkaBroker(brokers []string, opts ...Option) (*KafkaBroker, error) {
+	options := newBrokerOptions(opts)
+	group := "default-group"
+
 	config := sarama.NewConfig()
 	config.Producer.Return.Successes = true
 	config.Producer.RequiredAcks = sarama.WaitForAll
@@ -27,36 +39,98 @@ func NewKafkaBroker(brokers []string) (*KafkaBroker, error) {
 	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
 	config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	config.Version = sarama.V2_8_0_0
+	if options.broadcast != "" {
+		group = options.broadcast
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
 
-	producer, err := sarama.NewSyncProducer(brokers, config)
+	client, err := sarama.NewClient(brokers, config)
 	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
 	}
 
-	consumer, err := sarama.NewConsumerGroup(brokers, "default-group", config)
+	consumer, err := sarama.NewConsumerGroupFromClient(group, client)
 	if err != nil {
 		producer.Close()
+		client.Close()
 		return nil, fmt.Errorf("failed to create Kafka consumer: %w", err)
 	}
 
 	return &KafkaBroker{
+		client:   client,
 		producer: producer,
 		consumer: consumer,
 		config:   config,
-		brokers:   brokers,
+		brokers:  brokers,
+		options:  options,
 	}, nil
 }
 
+// Ping checks that the cluster controller is reachable. sarama reconnects
+// on its own, so this fails while no broker connection can be established
+func (k *KafkaBroker) Ping(ctx context.Context) error {
+	if k.client.Closed() {
+		return errBrokerClosed
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		controller, err := k.client.Controller()
+		if err != nil {
+			result <- fmt.Errorf("%w: %v", ErrBrokerReconnecting, err)
+			return
+		}
+		if connected, err := controller.Connected(); !connected {
+			result <- fmt.Errorf("%w: %v", ErrBrokerReconnecting, err)
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (k *KafkaBroker) Publish(ctx context.Context, topic string, event *contracts.Event) error {
+	start := time.Now()
+	ctx, span := startPublishSpan(ctx, brokerKafka, topic, event)
+	err := k.publish(ctx, topic, event)
+	endSpan(span, err)
+	metrics.ObservePublish(brokerKafka, topic, start, err)
+	return err
+}
+
+func (k *KafkaBroker) publish(ctx context.Context, topic string, event *contracts.Event) error {
 	if err := event.Validate(); err != nil {
 		return fmt.Errorf("invalid event: %w", err)
 	}
 
+	event, err := k.options.claimCheck.offload(ctx, event)
+	if err != nil {
+		return err
+	}
+
 	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
+	return k.send(ctx, topic, event, data)
+}
+
+// send publishes data to topic, using event for the message key and headers
+// and ctx for the trace context headers
+func (k *KafkaBroker) send(ctx context.Context, topic string, event *contracts.Event, data []byte) error {
 	msg := &sarama.ProducerMessage{
 		Topic: topic,
 		Key:   sarama.StringEncoder(event.IdempotencyID),
@@ -68,6 +142,17 @@ func (k *KafkaBroker) Publish(ctx context.Context, topic string, event *contract
 		},
 	}
 
+	for key, value := range traceHeaders(ctx) {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	if k.options.keys != nil {
+		keyID, signature := k.options.keys.Sign(data)
+		msg.Headers = append(msg.Headers,
+			sarama.RecordHeader{Key: []byte(HeaderSignatureKeyID), Value: []byte(keyID)},
+			sarama.RecordHeader{Key: []byte(HeaderSignature), Value: []byte(signature)},
+		)
+	}
+
 	partition, offset, err := k.producer.SendMessage(msg)
 	if err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
@@ -79,47 +164,100 @@ func (k *KafkaBroker) Publish(ctx context.Context, topic string, event *contract
 	return nil
 }
 
-func (k *KafkaBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+func (k *KafkaBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) (Subscription, error) {
+	sub := newSubscription(ctx, brokerKafka, topic)
 	consumer := &kafkaConsumerGroupHandler{
-		topic:   topic,
+		broker:  k,
+		sub:     sub,
 		handler: handler,
+		lag:     make(map[int32]int64),
 	}
+	sub.lagFunc = consumer.totalLag
 
 	go func() {
+		defer close(sub.done)
 		for {
-			if err := k.consumer.Consume(ctx, []string{topic}, consumer); err != nil {
+			if err := k.consumer.Consume(sub.fetchCtx, []string{topic}, consumer); err != nil {
 				log.Printf("Error consuming from Kafka: %v", err)
-				time.Sleep(5 * time.Second)
+				select {
+				case <-time.After(5 * time.Second):
+				case <-sub.fetchCtx.Done():
+				}
 			}
-			if ctx.Err() != nil {
+			if sub.fetchCtx.Err() != nil {
 				return
 			}
 		}
 	}()
 
-	return nil
+	k.subscriptions.add(sub)
+	return sub, nil
 }
 
 func (k *KafkaBroker) PublishToDLQ(ctx context.Context, topic string, dlqEvent *DLQEvent) error {
+	if k.options.broadcast != "" {
+		return nil // Dead-lettered by the consumers sharing the topic
+	}
 	dlqTopic := topic + ".dlq"
-	return k.Publish(ctx, dlqTopic, dlqEvent.OriginalEvent)
+
+	dlqEvent = dlqEvent.redacted(k.options.redactor)
+	data, err := json.Marshal(dlqEvent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal DLQ event: %w", err)
+	}
+
+	event := dlqEvent.OriginalEvent
+	if event == nil {
+		event = &contracts.Event{}
+	}
+	if err := k.send(ctx, dlqTopic, event, data); err != nil {
+		return err
+	}
+	metrics.ObserveDLQ(brokerKafka, topic, dlqEvent.reason())
+	return nil
+}
+
+func (k *KafkaBroker) Shutdown(ctx context.Context) error {
+	return k.subscriptions.drain(ctx)
 }
 
 func (k *KafkaBroker) Close() error {
 	if err := k.producer.Close(); err != nil {
 		return err
 	}
-	return k.consumer.Close()
+	if err := k.consumer.Close(); err != nil {
+		return err
+	}
+	return k.client.Close()
 }
 
 // kafkaConsumerGroupHandler implements sarama.ConsumerGroupHandler
 type kafkaConsumerGroupHandler struct {
-	topic   string
+	broker  *KafkaBroker
+	sub     *subscription
 	handler MessageHandler
+
+	// lag holds, per claimed partition, how many messages are behind the
+	// last one received
+	lagMu sync.Mutex
+	lag   map[int32]int64
 }
 
-func (h *kafkaConsumerGroupHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
-func (h *kafkaConsumerGroupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+// Setup forgets the lag of partitions from the previous session, since
+// they may have been assigned to another consumer
+func (h *kafkaConsumerGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	h.lagMu.Lock()
+	defer h.lagMu.Unlock()
+	h.lag = make(map[int32]int64)
+	return nil
+}
+
+// Cleanup commits the offsets marked during the session, so messages that
+// finished while draining are not redelivered
+func (h *kafkaConsumerGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	session.Commit()
+	return nil
+}
 
 func (h *kafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for {
@@ -128,6 +266,12 @@ func (h *kafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSes
 			if message == nil {
 				return nil
 			}
+			receivedAt := time.Now()
+			if h.sub.fetchCtx.Err() != nil {
+				// Fetched while stopping: leave it uncommitted for redelivery
+				return nil
+			}
+			h.recordLag(claim.Partition(), claim.HighWaterMarkOffset()-message.Offset-1)
 
 			var event contracts.Event
 			if err := json.Unmarshal(message.Value, &event); err != nil {
@@ -135,9 +279,39 @@ func (h *kafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSes
 				session.MarkMessage(message, "")
 				continue
 			}
+			metrics.ObserveConsumed(brokerKafka, message.Topic, event.EventType)
 
-			ctx := context.Background()
-			if err := h.handler(ctx, &event); err != nil {
+			if err := h.broker.options.claimCheck.rehydrate(context.Background(), &event); err != nil {
+				log.Printf("Failed to rehydrate event %s received from %s: %v", event.EventID, message.Topic, err)
+				if err := h.broker.PublishToDLQ(context.Background(), message.Topic, NewDLQEvent(&event, err, 0)); err != nil {
+					log.Printf("Failed to send event %s to DLQ: %v", event.EventID, err)
+				}
+				session.MarkMessage(message, "")
+				continue
+			}
+
+			if err := event.Validate(); err != nil {
+				log.Printf("Invalid event %s received from %s: %v", event.EventID, message.Topic, err)
+				if err := h.broker.PublishToDLQ(context.Background(), message.Topic, NewDLQEvent(&event, err, 0)); err != nil {
+					log.Printf("Failed to send invalid event %s to DLQ: %v", event.EventID, err)
+				}
+				session.MarkMessage(message, "")
+				continue
+			}
+
+			ctx := ContextWithDelivery(h.sub.handlerCtx, &Delivery{
+				Broker:     brokerKafka,
+				Topic:      message.Topic,
+				Headers:    kafkaHeaders(message.Headers),
+				Body:       message.Value,
+				ReceivedAt: receivedAt,
+			})
+			finished, err := h.sub.handle(ctx, &event, h.handler)
+			if !finished {
+				// Abandoned by Shutdown: not marked, so it is redelivered
+				return nil
+			}
+			if err != nil {
 				log.Printf("Handler error for event %s: %v", event.EventID, err)
 				// In production, implement retry logic here
 				// For now, we mark as processed to avoid infinite loops
@@ -151,3 +325,31 @@ func (h *kafkaConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSes
 	}
 }
 
+func kafkaHeaders(recordHeaders []*sarama.RecordHeader) map[string]string {
+	headers := make(map[string]string, len(recordHeaders))
+	for _, header := range recordHeaders {
+		if header != nil {
+			headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return headers
+}
+
+func (h *kafkaConsumerGroupHandler) recordLag(partition int32, lag int64) {
+	if lag < 0 {
+		lag = 0
+	}
+	h.lagMu.Lock()
+	defer h.lagMu.Unlock()
+	h.lag[partition] = lag
+}
+
+func (h *kafkaConsumerGroupHandler) totalLag(ctx context.Context) (int64, error) {
+	h.lagMu.Lock()
+	defer h.lagMu.Unlock()
+	var total int64
+	for _, lag := range h.lag {
+		total += lag
+	}
+	return total, nil
+}
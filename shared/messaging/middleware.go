@@ -0,0 +1,14 @@
+package messaging
+
+// Middleware wraps a MessageHandler with cross-cutting behaviour
+// (signature verification, validation, instrumentation...)
+type Middleware func(MessageHandler) MessageHandler
+
+// Chain applies the middlewares to handler. The first middleware is the
+// outermost one, so it sees the event before the others do
+func Chain(handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
@@ -3,56 +3,206 @@ package messaging
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/metrics"
+)
+
+// ErrBrokerReconnecting is returned while the broker connection is being
+// re-established
+var ErrBrokerReconnecting = errors.New("broker connection is being re-established")
+
+var errBrokerClosed = errors.New("broker is closed")
+
+// brokerRabbitMQ labels the RabbitMQ metrics
+const brokerRabbitMQ = "rabbitmq"
+
+const (
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 30 * time.Second
 )
 
 type RabbitMQBroker struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	mu          sync.RWMutex
+	conn        *amqp.Connection
+	channel     *amqp.Channel
+	connected   bool
+	reconnected chan struct{} // closed (and replaced) on every reconnection
+	closed      chan struct{}
+	closeOnce   sync.Once
+
 	url     string
+	options brokerOptions
+
+	// declared maps each topic published to the channel its queue, exchange
+	// and binding were declared on, so publishing declares them once
+	declaredMu sync.Mutex
+	declared   map[string]*amqp.Channel
+
+	subscriptions subscriptions
 }
 
 // NewRabbitMQBroker creates a new RabbitMQ broker instance
-func NewRabbitMQBroker(url string) (*RabbitMQBroker, error) {
+func NewRabbitMQBroker(url string, opts ...Option) (*RabbitMQBroker, error) {
+	conn, channel, err := dialRabbitMQ(url)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RabbitMQBroker{
+		conn:        conn,
+		channel:     channel,
+		connected:   true,
+		reconnected: make(chan struct{}),
+		closed:      make(chan struct{}),
+		url:         url,
+		options:     newBrokerOptions(opts),
+		declared:    make(map[string]*amqp.Channel),
+	}
+	go r.watch(conn, channel)
+
+	return r, nil
+}
+
+func dialRabbitMQ(url string) (*amqp.Connection, *amqp.Channel, error) {
 	conn, err := amqp.Dial(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
 	channel, err := conn.Channel()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to open channel: %w", err)
+		return nil, nil, fmt.Errorf("failed to open channel: %w", err)
 	}
 
-	return &RabbitMQBroker{
-		conn:    conn,
-		channel: channel,
-		url:     url,
-	}, nil
+	return conn, channel, nil
+}
+
+// watch waits for the connection or channel to fail and reconnects with
+// exponential backoff. Subscriptions resume on the new channel
+func (r *RabbitMQBroker) watch(conn *amqp.Connection, channel *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-channelClosed:
+	case <-r.closed:
+		return
+	}
+
+	r.mu.Lock()
+	r.connected = false
+	r.mu.Unlock()
+	conn.Close()
+
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	log.Printf("RabbitMQ connection lost: %v. Reconnecting...", reason)
+
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-r.closed:
+			return
+		}
+
+		conn, channel, err := dialRabbitMQ(r.url)
+		if err != nil {
+			log.Printf("RabbitMQ reconnection failed: %v", err)
+			backoff *= 2
+			if backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			continue
+		}
+
+		r.mu.Lock()
+		r.conn = conn
+		r.channel = channel
+		r.connected = true
+		close(r.reconnected)
+		r.reconnected = make(chan struct{})
+		r.mu.Unlock()
+
+		log.Println("RabbitMQ connection re-established")
+		go r.watch(conn, channel)
+		return
+	}
+}
+
+// currentChannel returns the channel of the live connection
+func (r *RabbitMQBroker) currentChannel() (*amqp.Channel, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	select {
+	case <-r.closed:
+		return nil, errBrokerClosed
+	default:
+	}
+	if !r.connected {
+		return nil, ErrBrokerReconnecting
+	}
+	return r.channel, nil
+}
+
+// waitConnected blocks until the broker is connected. Returns false if ctx
+// is done or the broker is closed first
+func (r *RabbitMQBroker) waitConnected(ctx context.Context) bool {
+	for {
+		r.mu.RLock()
+		connected, reconnected := r.connected, r.reconnected
+		r.mu.RUnlock()
+		if connected {
+			return true
+		}
+
+		select {
+		case <-reconnected:
+		case <-ctx.Done():
+			return false
+		case <-r.closed:
+			return false
+		}
+	}
+}
+
+// Ping fails while the connection is being re-established
+func (r *RabbitMQBroker) Ping(ctx context.Context) error {
+	_, err := r.currentChannel()
+	return err
 }
 
 func (r *RabbitMQBroker) Publish(ctx context.Context, queue string, event *contracts.Event) error {
+	start := time.Now()
+	ctx, span := startPublishSpan(ctx, brokerRabbitMQ, queue, event)
+	err := r.publish(ctx, queue, event)
+	endSpan(span, err)
+	metrics.ObservePublish(brokerRabbitMQ, queue, start, err)
+	return err
+}
+
+func (r *RabbitMQBroker) publish(ctx context.Context, queue string, event *contracts.Event) error {
 	if err := event.Validate(); err != nil {
 		return fmt.Errorf("invalid event: %w", err)
 	}
 
-	// Declare queue
-	_, err := r.channel.QueueDeclare(
-		queue,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+	event, err := r.options.claimCheck.offload(ctx, event)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return err
 	}
 
 	data, err := json.Marshal(event)
@@ -60,22 +210,47 @@ func (r *RabbitMQBroker) Publish(ctx context.Context, queue string, event *contr
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	err = r.channel.Publish(
-		"",    // exchange
+	return r.send(ctx, queue, event, data)
+}
+
+// send publishes data to queue, using event for the message properties and
+// headers and ctx for the trace context headers
+func (r *RabbitMQBroker) send(ctx context.Context, queue string, event *contracts.Event, data []byte) error {
+	channel, err := r.currentChannel()
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	if err := r.declareTopic(channel, queue); err != nil {
+		return err
+	}
+
+	headers := amqp.Table{
+		"correlation_id": event.CorrelationID,
+		"idempotency_id": event.IdempotencyID,
+		"event_type":     event.EventType,
+	}
+	for key, value := range traceHeaders(ctx) {
+		headers[key] = value
+	}
+	if r.options.keys != nil {
+		keyID, signature := r.options.keys.Sign(data)
+		headers[HeaderSignatureKeyID] = keyID
+		headers[HeaderSignature] = signature
+	}
+
+	err = channel.Publish(
+		queue, // exchange
 		queue, // routing key
 		false, // mandatory
 		false, // immediate
 		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         data,
-			DeliveryMode: amqp.Persistent,
-			Headers: amqp.Table{
-				"correlation_id": event.CorrelationID,
-				"idempotency_id": event.IdempotencyID,
-				"event_type":     event.EventType,
-			},
-			MessageId:    event.EventID,
-			Timestamp:    time.Now(),
+			ContentType:   "application/json",
+			Body:          data,
+			DeliveryMode:  amqp.Persistent,
+			Headers:       headers,
+			MessageId:     event.EventID,
+			Timestamp:     time.Now(),
 			CorrelationId: event.CorrelationID,
 		},
 	)
@@ -90,9 +265,98 @@ func (r *RabbitMQBroker) Publish(ctx context.Context, queue string, event *contr
 	return nil
 }
 
-func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler MessageHandler) error {
+// declareTopic declares the durable queue of topic and the exchange its
+// events are published to, bound to it, unless they were already declared
+// on channel
+func (r *RabbitMQBroker) declareTopic(channel *amqp.Channel, topic string) error {
+	r.declaredMu.Lock()
+	defer r.declaredMu.Unlock()
+	if r.declared[topic] == channel {
+		return nil
+	}
+
+	_, err := channel.QueueDeclare(
+		topic,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+	if err := declareTopicExchange(channel, topic); err != nil {
+		return err
+	}
+	if err := channel.QueueBind(topic, "", topic, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue to exchange: %w", err)
+	}
+
+	r.declared[topic] = channel
+	return nil
+}
+
+func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler MessageHandler) (Subscription, error) {
+	consumerTag := fmt.Sprintf("%s-%d", queue, time.Now().UnixNano())
+
+	consume, consumed := r.consume, queue
+	if r.options.broadcast != "" {
+		consume, consumed = r.consumeBroadcast, r.broadcastQueue(queue)
+	}
+
+	channel, msgs, err := consume(queue, consumerTag)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newSubscription(ctx, brokerRabbitMQ, queue)
+	sub.lagFunc = func(ctx context.Context) (int64, error) {
+		return r.queueDepth(consumed)
+	}
+
+	go func() {
+		defer close(sub.done)
+		for {
+			if r.deliver(sub, channel, consumerTag, msgs, handler) {
+				return
+			}
+
+			// The channel was closed by a connection failure: resume
+			// consuming once the broker has reconnected
+			for {
+				if !r.waitConnected(sub.fetchCtx) {
+					return
+				}
+				channel, msgs, err = consume(queue, consumerTag)
+				if err == nil {
+					break
+				}
+				log.Printf("Failed to resume consuming from %s: %v", queue, err)
+				select {
+				case <-time.After(reconnectMinBackoff):
+				case <-sub.fetchCtx.Done():
+					return
+				}
+			}
+			log.Printf("Resumed consuming from RabbitMQ queue %s", queue)
+		}
+	}()
+
+	r.subscriptions.add(sub)
+	return sub, nil
+}
+
+// consume declares the queue with its DLQ and starts consuming it on the
+// current channel
+func (r *RabbitMQBroker) consume(queue, consumerTag string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := r.currentChannel()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Declare queue
-	_, err := r.channel.QueueDeclare(
+	_, err = channel.QueueDeclare(
 		queue,
 		true,  // durable
 		false, // delete when unused
@@ -103,11 +367,11 @@ func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler Me
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return nil, nil, fmt.Errorf("failed to declare queue: %w", err)
 	}
 
 	// Declare DLX
-	err = r.channel.ExchangeDeclare(
+	err = channel.ExchangeDeclare(
 		"dlx",
 		"direct",
 		true,
@@ -117,12 +381,12 @@ func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler Me
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare DLX: %w", err)
+		return nil, nil, fmt.Errorf("failed to declare DLX: %w", err)
 	}
 
 	// Declare DLQ
 	dlqName := queue + ".dlq"
-	_, err = r.channel.QueueDeclare(
+	_, err = channel.QueueDeclare(
 		dlqName,
 		true,
 		false,
@@ -131,11 +395,11 @@ func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler Me
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare DLQ: %w", err)
+		return nil, nil, fmt.Errorf("failed to declare DLQ: %w", err)
 	}
 
 	// Bind DLQ to DLX
-	err = r.channel.QueueBind(
+	err = channel.QueueBind(
 		dlqName,
 		queue,
 		"dlx",
@@ -143,22 +407,22 @@ func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler Me
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to bind DLQ: %w", err)
+		return nil, nil, fmt.Errorf("failed to bind DLQ: %w", err)
 	}
 
 	// Set QoS
-	err = r.channel.Qos(
+	err = channel.Qos(
 		1,     // prefetch count
 		0,     // prefetch size
 		false, // global
 	)
 	if err != nil {
-		return fmt.Errorf("failed to set QoS: %w", err)
+		return nil, nil, fmt.Errorf("failed to set QoS: %w", err)
 	}
 
-	msgs, err := r.channel.Consume(
+	msgs, err := channel.Consume(
 		queue,
-		"",    // consumer
+		consumerTag,
 		false, // auto-ack (manual ack for retry logic)
 		false, // exclusive
 		false, // no-local
@@ -166,53 +430,251 @@ func (r *RabbitMQBroker) Subscribe(ctx context.Context, queue string, handler Me
 		nil,   // args
 	)
 	if err != nil {
-		return fmt.Errorf("failed to register consumer: %w", err)
+		return nil, nil, fmt.Errorf("failed to register consumer: %w", err)
 	}
 
-	go func() {
-		for {
-			select {
-			case msg, ok := <-msgs:
-				if !ok {
-					log.Println("RabbitMQ channel closed")
-					return
-				}
+	return channel, msgs, nil
+}
 
-				var event contracts.Event
-				if err := json.Unmarshal(msg.Body, &event); err != nil {
-					log.Printf("Failed to unmarshal event: %v", err)
-					msg.Nack(false, false) // Reject without requeue
-					continue
-				}
+// declareTopicExchange declares the fanout exchange named after queue
+// that its events are published to. Publishers bind queue to it and
+// WithBroadcast subscribers their own queues
+func declareTopicExchange(channel *amqp.Channel, queue string) error {
+	err := channel.ExchangeDeclare(
+		queue,
+		"fanout",
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+	return nil
+}
 
-				ctx := context.Background()
-				if err := handler(ctx, &event); err != nil {
-					log.Printf("Handler error for event %s: %v", event.EventID, err)
-					// Nack with requeue for retry, or send to DLQ after max retries
-					// For simplicity, we'll reject without requeue (goes to DLQ)
-					msg.Nack(false, false)
-				} else {
-					msg.Ack(false)
-				}
+// broadcastQueue names the queue of the WithBroadcast subscription to topic
+func (r *RabbitMQBroker) broadcastQueue(topic string) string {
+	return topic + "." + r.options.broadcast
+}
 
-			case <-ctx.Done():
-				return
+// consumeBroadcast declares the exclusive queue of a WithBroadcast
+// subscription to topic, bound to the exchange of topic, and starts
+// consuming it on the current channel
+func (r *RabbitMQBroker) consumeBroadcast(topic, consumerTag string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := r.currentChannel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := declareTopicExchange(channel, topic); err != nil {
+		return nil, nil, err
+	}
+
+	queue := r.broadcastQueue(topic)
+	_, err = channel.QueueDeclare(
+		queue,
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to declare broadcast queue: %w", err)
+	}
+	if err := channel.QueueBind(queue, "", topic, false, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to bind broadcast queue: %w", err)
+	}
+
+	err = channel.Qos(
+		1,     // prefetch count
+		0,     // prefetch size
+		false, // global
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set QoS: %w", err)
+	}
+
+	msgs, err := channel.Consume(
+		queue,
+		consumerTag,
+		false, // auto-ack
+		true,  // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // args
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to register consumer: %w", err)
+	}
+
+	return channel, msgs, nil
+}
+
+// deliver hands the messages of msgs to handler. It returns true when the
+// subscription is over (stopped or abandoned) and false when msgs was
+// closed by a connection failure
+func (r *RabbitMQBroker) deliver(sub *subscription, channel *amqp.Channel, consumerTag string, msgs <-chan amqp.Delivery, handler MessageHandler) bool {
+	queue := sub.topic
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				log.Println("RabbitMQ channel closed")
+				return sub.fetchCtx.Err() != nil
+			}
+			receivedAt := time.Now()
+			if sub.fetchCtx.Err() != nil {
+				msg.Nack(false, true) // Fetched while stopping: requeue
+				continue
+			}
+
+			var event contracts.Event
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal event: %v", err)
+				msg.Nack(false, false) // Reject without requeue
+				continue
+			}
+			metrics.ObserveConsumed(brokerRabbitMQ, queue, event.EventType)
+			if msg.Redelivered {
+				metrics.ObserveRetry(brokerRabbitMQ, queue, event.EventType)
+			}
+
+			err := r.options.claimCheck.rehydrate(context.Background(), &event)
+			if err == nil {
+				err = event.Validate()
+			}
+			if err != nil {
+				log.Printf("Invalid event %s received from %s: %v", event.EventID, queue, err)
+				r.deadLetter(msg, queue, &event, err)
+				continue
+			}
+
+			ctx := ContextWithDelivery(sub.handlerCtx, &Delivery{
+				Broker:     brokerRabbitMQ,
+				Topic:      queue,
+				Headers:    amqpHeaders(msg.Headers),
+				Body:       msg.Body,
+				ReceivedAt: receivedAt,
+			})
+			finished, err := sub.handle(ctx, &event, handler)
+			if !finished {
+				msg.Nack(false, true) // Abandoned by Shutdown: requeue for redelivery
+				return true
+			}
+			if err != nil {
+				log.Printf("Handler error for event %s: %v", event.EventID, err)
+				r.deadLetter(msg, queue, &event, err)
+			} else {
+				msg.Ack(false)
+			}
+
+		case <-sub.fetchCtx.Done():
+			// Stop fetching and requeue what was already prefetched;
+			// msgs is closed once the consumer is cancelled
+			if err := channel.Cancel(consumerTag, false); err != nil {
+				return true
 			}
+			for msg := range msgs {
+				msg.Nack(false, true)
+			}
+			return true
 		}
-	}()
+	}
+}
 
-	return nil
+// queueDepth returns the number of messages ready in queue. It uses a
+// dedicated channel because a failed inspection closes the channel
+func (r *RabbitMQBroker) queueDepth(queue string) (int64, error) {
+	r.mu.RLock()
+	conn, connected := r.conn, r.connected
+	r.mu.RUnlock()
+	if !connected {
+		return 0, ErrBrokerReconnecting
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer channel.Close()
+
+	state, err := channel.QueueInspect(queue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect queue: %w", err)
+	}
+	return int64(state.Messages), nil
+}
+
+// deadLetter sends event, received in msg, to the DLQ of queue with its
+// sensitive fields redacted, then acknowledges msg. Only when that fails is
+// msg rejected, and the DLX dead-letters its raw, unredacted body
+func (r *RabbitMQBroker) deadLetter(msg amqp.Delivery, queue string, event *contracts.Event, cause error) {
+	if err := r.PublishToDLQ(context.Background(), queue, NewDLQEvent(event, cause, 0)); err != nil {
+		log.Printf("Failed to send event %s to DLQ, dead-lettering it unredacted through the DLX: %v", event.EventID, err)
+		msg.Nack(false, false)
+		return
+	}
+	msg.Ack(false)
 }
 
 func (r *RabbitMQBroker) PublishToDLQ(ctx context.Context, queue string, dlqEvent *DLQEvent) error {
+	if r.options.broadcast != "" {
+		return nil // Dead-lettered by the consumers sharing the queue
+	}
 	dlqQueue := queue + ".dlq"
-	return r.Publish(ctx, dlqQueue, dlqEvent.OriginalEvent)
+
+	dlqEvent = dlqEvent.redacted(r.options.redactor)
+	data, err := json.Marshal(dlqEvent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal DLQ event: %w", err)
+	}
+
+	event := dlqEvent.OriginalEvent
+	if event == nil {
+		event = &contracts.Event{}
+	}
+	if err := r.send(ctx, dlqQueue, event, data); err != nil {
+		return err
+	}
+	metrics.ObserveDLQ(brokerRabbitMQ, queue, dlqEvent.reason())
+	return nil
+}
+
+func (r *RabbitMQBroker) Shutdown(ctx context.Context) error {
+	return r.subscriptions.drain(ctx)
 }
 
 func (r *RabbitMQBroker) Close() error {
-	if err := r.channel.Close(); err != nil {
+	r.closeOnce.Do(func() { close(r.closed) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = false
+
+	if err := r.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
 		return err
 	}
-	return r.conn.Close()
+	if err := r.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
 }
 
+func amqpHeaders(table amqp.Table) map[string]string {
+	headers := make(map[string]string, len(table))
+	for key, value := range table {
+		switch v := value.(type) {
+		case string:
+			headers[key] = v
+		case []byte:
+			headers[key] = string(v)
+		default:
+			headers[key] = fmt.Sprint(v)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,186 @@
+package messaging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"queue-microservice-case/shared/contracts"
+)
+
+// Headers used to transport the event signature
+const (
+	HeaderSignatureKeyID = "signature_key_id"
+	HeaderSignature      = "signature"
+)
+
+var (
+	ErrMissingSignature  = errors.New("event signature is missing")
+	ErrUnknownSigningKey = errors.New("event signed with unknown key")
+	ErrInvalidSignature  = errors.New("event signature is invalid")
+)
+
+// KeyRing holds the HMAC keys, identified by key ID, used to sign and verify
+// events. Publishers sign with the active key; consumers accept any key in
+// the ring, which allows keys to be rotated without downtime
+type KeyRing struct {
+	activeKeyID string
+	keys        map[string][]byte
+}
+
+// NewKeyRing creates a key ring. activeKeyID must be one of the keys
+func NewKeyRing(activeKeyID string, keys map[string][]byte) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("key ring requires at least one key")
+	}
+	if _, ok := keys[activeKeyID]; !ok {
+		return nil, fmt.Errorf("active signing key %q not found in key ring", activeKeyID)
+	}
+	return &KeyRing{activeKeyID: activeKeyID, keys: keys}, nil
+}
+
+// KeyRingFromEnv builds the key ring from EVENT_SIGNING_KEYS
+// ("key-id:secret,key-id:secret") and EVENT_SIGNING_KEY_ID (defaults to the
+// first key). Returns nil when no keys are configured, meaning events are
+// neither signed nor verifiable
+func KeyRingFromEnv() (*KeyRing, error) {
+	spec := os.Getenv("EVENT_SIGNING_KEYS")
+	if spec == "" {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte)
+	activeKeyID := os.Getenv("EVENT_SIGNING_KEY_ID")
+	for _, pair := range strings.Split(spec, ",") {
+		keyID, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || keyID == "" || secret == "" {
+			return nil, fmt.Errorf("invalid EVENT_SIGNING_KEYS entry: %q (expected key-id:secret)", pair)
+		}
+		keys[keyID] = []byte(secret)
+		if activeKeyID == "" {
+			activeKeyID = keyID
+		}
+	}
+
+	return NewKeyRing(activeKeyID, keys)
+}
+
+// Sign computes the signature of body with the active key
+func (k *KeyRing) Sign(body []byte) (keyID, signature string) {
+	return k.activeKeyID, computeSignature(k.keys[k.activeKeyID], body)
+}
+
+// Verify checks that signature is a valid signature of body by keyID
+func (k *KeyRing) Verify(keyID, signature string, body []byte) error {
+	if keyID == "" || signature == "" {
+		return ErrMissingSignature
+	}
+	key, ok := k.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSigningKey, keyID)
+	}
+	expected := computeSignature(key, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func computeSignature(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureMode defines what happens to events that fail verification
+type SignatureMode string
+
+const (
+	// SignatureOff disables verification
+	SignatureOff SignatureMode = "off"
+	// SignatureReject drops unsigned or badly signed events
+	SignatureReject SignatureMode = "reject"
+	// SignatureDeadLetter sends unsigned or badly signed events to the DLQ
+	SignatureDeadLetter SignatureMode = "dlq"
+)
+
+// SignaturePolicy maps topics to their verification mode
+type SignaturePolicy map[string]SignatureMode
+
+// Mode returns the verification mode for topic (SignatureOff if unset)
+func (p SignaturePolicy) Mode(topic string) SignatureMode {
+	if mode, ok := p[topic]; ok {
+		return mode
+	}
+	return SignatureOff
+}
+
+// SignaturePolicyFromEnv parses EVENT_SIGNATURE_POLICY
+// ("topic=mode,topic=mode", modes: off, reject, dlq)
+func SignaturePolicyFromEnv() (SignaturePolicy, error) {
+	policy := SignaturePolicy{}
+	spec := os.Getenv("EVENT_SIGNATURE_POLICY")
+	if spec == "" {
+		return policy, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		topic, mode, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid EVENT_SIGNATURE_POLICY entry: %q (expected topic=mode)", pair)
+		}
+		switch SignatureMode(mode) {
+		case SignatureOff, SignatureReject, SignatureDeadLetter:
+			policy[topic] = SignatureMode(mode)
+		default:
+			return nil, fmt.Errorf("unsupported signature mode %q for topic %s (supported: off, reject, dlq)", mode, topic)
+		}
+	}
+
+	return policy, nil
+}
+
+// VerifySignatures returns a middleware that checks the signature of every
+// consumed event against keys, according to the mode configured for the
+// delivery topic. Rejected events are dropped; dead-lettered events are sent
+// to the topic DLQ through broker. In both cases the handler is not called
+func VerifySignatures(keys *KeyRing, policy SignaturePolicy, broker MessageBroker) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, event *contracts.Event) error {
+			delivery, ok := DeliveryFromContext(ctx)
+			if !ok {
+				return next(ctx, event)
+			}
+
+			mode := policy.Mode(delivery.Topic)
+			if mode == SignatureOff {
+				return next(ctx, event)
+			}
+
+			err := ErrMissingSignature
+			if keys != nil {
+				err = keys.Verify(delivery.Headers[HeaderSignatureKeyID], delivery.Headers[HeaderSignature], delivery.Body)
+			}
+			if err == nil {
+				return next(ctx, event)
+			}
+
+			log.Printf("Signature verification failed: topic=%s, event_id=%s, correlation_id=%s, idempotency_id=%s, mode=%s, error=%v",
+				delivery.Topic, event.EventID, event.CorrelationID, event.IdempotencyID, mode, err)
+
+			if mode == SignatureDeadLetter {
+				if dlqErr := broker.PublishToDLQ(ctx, delivery.Topic, NewDLQEvent(event, err, 0)); dlqErr != nil {
+					return fmt.Errorf("failed to dead-letter unsigned event: %w", dlqErr)
+				}
+			}
+
+			return nil
+		}
+	}
+}
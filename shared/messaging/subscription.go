@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/metrics"
+)
+
+// subscription is the Subscription shared by the broker implementations.
+// Its consume loop stops fetching when fetchCtx is cancelled and gives up
+// on in-flight handlers when handlerCtx is cancelled (abandoned)
+type subscription struct {
+	broker string // broker type, used as metrics label
+	topic  string
+
+	fetchCtx  context.Context
+	stopFetch context.CancelFunc
+
+	handlerCtx context.Context
+	abandon    context.CancelFunc
+
+	// done is closed by the consume loop when it exits, which happens only
+	// after the in-flight handler finished or was abandoned
+	done chan struct{}
+
+	// busySince holds the start of the in-flight handler (unix nanos), or
+	// zero while the subscription is idle
+	busySince atomic.Int64
+
+	// lagFunc reports the number of messages waiting; set by the broker
+	lagFunc func(ctx context.Context) (int64, error)
+}
+
+func newSubscription(ctx context.Context, broker, topic string) *subscription {
+	fetchCtx, stopFetch := context.WithCancel(ctx)
+	handlerCtx, abandon := context.WithCancel(context.Background())
+	return &subscription{
+		broker:     broker,
+		topic:      topic,
+		fetchCtx:   fetchCtx,
+		stopFetch:  stopFetch,
+		handlerCtx: handlerCtx,
+		abandon:    abandon,
+		done:       make(chan struct{}),
+	}
+}
+
+func (s *subscription) Topic() string {
+	return s.topic
+}
+
+func (s *subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// LastHeartbeat returns now while the consume loop is idle, the start of
+// the in-flight handler while one is running (so a stuck handler ages the
+// heartbeat), and the zero time once the loop has stopped
+func (s *subscription) LastHeartbeat() time.Time {
+	select {
+	case <-s.done:
+		return time.Time{}
+	default:
+	}
+	if since := s.busySince.Load(); since != 0 {
+		return time.Unix(0, since)
+	}
+	return time.Now()
+}
+
+func (s *subscription) Lag(ctx context.Context) (int64, error) {
+	if s.lagFunc == nil {
+		return 0, nil
+	}
+	return s.lagFunc(ctx)
+}
+
+func (s *subscription) Drain(ctx context.Context) error {
+	s.stopFetch()
+
+	select {
+	case <-s.done:
+		s.abandon()
+		return nil
+	case <-ctx.Done():
+		// The in-flight handler did not finish in time: the consume loop
+		// leaves its message unacknowledged so the broker redelivers it
+		s.abandon()
+		<-s.done
+		return fmt.Errorf("subscription %s: in-flight message abandoned: %w", s.topic, ctx.Err())
+	}
+}
+
+// handle runs handler for one message. finished is false when the
+// subscription was abandoned before the handler returned; in that case the
+// message must be neither acknowledged nor committed
+func (s *subscription) handle(ctx context.Context, event *contracts.Event, handler MessageHandler) (finished bool, err error) {
+	start := time.Now()
+	s.busySince.Store(start.UnixNano())
+	defer s.busySince.Store(0)
+
+	if eventTime, err := event.Time(); err == nil {
+		receivedAt := start
+		if delivery, ok := DeliveryFromContext(ctx); ok {
+			receivedAt = delivery.ReceivedAt
+		}
+		metrics.ObserveQueueLatency(s.broker, s.topic, event.EventType, receivedAt.Sub(eventTime))
+	}
+
+	ctx = logger.ContextWithFields(ctx, logger.Fields{
+		CorrelationID: event.CorrelationID,
+		IdempotencyID: event.IdempotencyID,
+		EventID:       event.EventID,
+	})
+	ctx, span := startProcessSpan(ctx, s.broker, s.topic, event)
+	result := make(chan error, 1)
+	go func() {
+		result <- handler(ctx, event)
+	}()
+
+	select {
+	case err := <-result:
+		endSpan(span, err)
+		outcome := metrics.OutcomeSuccess
+		if err != nil {
+			outcome = metrics.OutcomeError
+		}
+		metrics.ObserveHandler(s.broker, s.topic, event.EventType, outcome, start)
+		return true, err
+	case <-s.handlerCtx.Done():
+		endSpan(span, errHandlerAbandoned)
+		metrics.ObserveHandler(s.broker, s.topic, event.EventType, metrics.OutcomeAbandoned, start)
+		return false, nil
+	}
+}
+
+// subscriptions keeps the subscriptions of a broker so it can drain them
+type subscriptions struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+func (s *subscriptions) add(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, sub)
+}
+
+// drain drains every subscription concurrently, stopping all fetches first
+func (s *subscriptions) drain(ctx context.Context) error {
+	s.mu.Lock()
+	subs := append([]*subscription(nil), s.subs...)
+	s.mu.Unlock()
+
+	errs := make([]error, len(subs))
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		wg.Add(1)
+		go func(i int, sub *subscription) {
+			defer wg.Done()
+			errs[i] = sub.Drain(ctx)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
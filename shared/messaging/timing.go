@@ -0,0 +1,108 @@
+package messaging
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+)
+
+// Timing is the latency breakdown of one consumed event at this service:
+// how long it waited in the broker (queue latency) and how long the
+// service took to handle it (processing latency)
+type Timing struct {
+	Broker     string
+	Topic      string
+	Event      *contracts.Event
+	EventTime  time.Time // creation of the event (Event.Timestamp)
+	ReceivedAt time.Time
+	HandledAt  time.Time
+	Err        error // returned by the handler
+}
+
+// QueueLatency is the time between the creation of the event and its
+// reception. It includes every hop before this one and the clock skew
+// between the hosts
+func (t *Timing) QueueLatency() time.Duration {
+	return t.ReceivedAt.Sub(t.EventTime)
+}
+
+// ProcessingLatency is the time between the reception of the event and the
+// end of its handler
+func (t *Timing) ProcessingLatency() time.Duration {
+	return t.HandledAt.Sub(t.ReceivedAt)
+}
+
+// TimingRecorder persists the timing of a consumed event
+type TimingRecorder func(ctx context.Context, timing *Timing) error
+
+// RecordTimings returns a middleware that hands the Timing of every consumed
+// event to record once the rest of the chain has returned. Recording
+// failures are logged and never fail the message. Put it right after
+// VerifySignatures, so rejected events record no timings and the processing
+// latency covers the other middlewares
+func RecordTimings(record TimingRecorder) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, event *contracts.Event) error {
+			delivery, ok := DeliveryFromContext(ctx)
+			if !ok {
+				return next(ctx, event)
+			}
+
+			err := next(ctx, event)
+
+			eventTime, parseErr := event.Time()
+			if parseErr != nil {
+				return err
+			}
+			timing := &Timing{
+				Broker:     delivery.Broker,
+				Topic:      delivery.Topic,
+				Event:      event,
+				EventTime:  eventTime,
+				ReceivedAt: delivery.ReceivedAt,
+				HandledAt:  time.Now(),
+				Err:        err,
+			}
+			if recordErr := record(ctx, timing); recordErr != nil {
+				log.Printf("Failed to record timing of event %s: correlation_id=%s, idempotency_id=%s, error=%v",
+					event.EventID, event.CorrelationID, event.IdempotencyID, recordErr)
+			}
+
+			return err
+		}
+	}
+}
+
+// TimingStore persists the timing rows of consumed events
+type TimingStore interface {
+	RecordTiming(ctx context.Context, timing *database.MessageTiming) error
+}
+
+// StoreTimings returns a TimingRecorder that stores the latency breakdown of
+// every event consumed by serviceName in message_timings, one row per hop
+func StoreTimings(store TimingStore, serviceName string) TimingRecorder {
+	return func(ctx context.Context, timing *Timing) error {
+		outcome := "success"
+		if timing.Err != nil {
+			outcome = "error"
+		}
+		return store.RecordTiming(ctx, &database.MessageTiming{
+			IdempotencyID:       timing.Event.IdempotencyID,
+			CorrelationID:       timing.Event.CorrelationID,
+			EventID:             timing.Event.EventID,
+			EventType:           timing.Event.EventType,
+			ServiceName:         serviceName,
+			Broker:              timing.Broker,
+			Topic:               timing.Topic,
+			EventTimestamp:      timing.EventTime,
+			ReceivedAt:          timing.ReceivedAt,
+			HandledAt:           timing.HandledAt,
+			QueueLatencyMs:      float64(timing.QueueLatency()) / float64(time.Millisecond),
+			ProcessingLatencyMs: float64(timing.ProcessingLatency()) / float64(time.Millisecond),
+			Outcome:             outcome,
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"queue-microservice-case/shared/contracts"
+)
+
+var tracer = otel.Tracer("queue-microservice-case/shared/messaging")
+
+var errHandlerAbandoned = errors.New("handler abandoned on shutdown")
+
+// startPublishSpan starts the producer span of a publish to topic
+func startPublishSpan(ctx context.Context, broker, topic string, event *contracts.Event) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "publish "+topic,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(eventAttributes(broker, topic, event)...),
+	)
+}
+
+// startProcessSpan starts the consumer span of a handler run. Its parent is
+// the trace context carried by the delivery headers, so the trace continues
+// the one of the publisher
+func startProcessSpan(ctx context.Context, broker, topic string, event *contracts.Event) (context.Context, trace.Span) {
+	if delivery, ok := DeliveryFromContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(delivery.Headers))
+	}
+	return tracer.Start(ctx, "process "+topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(eventAttributes(broker, topic, event)...),
+	)
+}
+
+func eventAttributes(broker, topic string, event *contracts.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", broker),
+		semconv.MessagingDestinationName(topic),
+		semconv.MessagingMessageID(event.EventID),
+		attribute.String("event.type", event.EventType),
+		attribute.String("correlation_id", event.CorrelationID),
+		attribute.String("idempotency_id", event.IdempotencyID),
+	}
+}
+
+// traceHeaders returns the W3C trace context headers (traceparent,
+// tracestate) and baggage of ctx, to be sent along with a message
+func traceHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,8 @@
+module queue-microservice-case/shared/metrics
+
+go 1.21
+
+require (
+	github.com/prometheus/client_golang v1.19.1
+)
+
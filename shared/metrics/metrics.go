@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler outcomes
+const (
+	OutcomeSuccess   = "success"
+	OutcomeError     = "error"
+	OutcomeAbandoned = "abandoned"
+)
+
+// Registry holds every collector of the service. It is exposed on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	PublishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "queue_publish_duration_seconds",
+		Help:    "Time taken to publish an event to the broker.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"broker", "topic"})
+
+	PublishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_publish_errors_total",
+		Help: "Events that could not be published.",
+	}, []string{"broker", "topic"})
+
+	ConsumedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_consumed_messages_total",
+		Help: "Messages received from the broker.",
+	}, []string{"broker", "topic", "event_type"})
+
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "queue_handler_duration_seconds",
+		Help:    "Time taken by the message handler, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"broker", "topic", "event_type", "outcome"})
+
+	QueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "queue_event_latency_seconds",
+		Help:    "Time between the creation of an event and its reception by the consumer.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"broker", "topic", "event_type"})
+
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_retries_total",
+		Help: "Messages delivered again after a failed or interrupted attempt.",
+	}, []string{"broker", "topic", "event_type"})
+
+	DLQMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_dlq_messages_total",
+		Help: "Events sent to the dead letter queue, by reason.",
+	}, []string{"broker", "topic", "reason"})
+
+	ReconcilerActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reconciler_actions_total",
+		Help: "Stuck messages handled by the reconciler, by action and outcome.",
+	}, []string{"action", "outcome"})
+
+	NotificationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notification_send_duration_seconds",
+		Help:    "Time taken to send a notification, by channel and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"channel", "outcome"})
+
+	NotificationsDeferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notification_deferred_total",
+		Help: "Notifications added to a digest instead of sent, by channel and reason (digest, rate_limited).",
+	}, []string{"channel", "reason"})
+
+	StreamClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stream_clients",
+		Help: "Clients connected to the status stream, by transport (sse, websocket).",
+	}, []string{"transport"})
+
+	StreamUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_updates_sent_total",
+		Help: "Status updates sent to stream clients, by transport and type (status, stage).",
+	}, []string{"transport", "type"})
+
+	StreamDisconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_disconnects_total",
+		Help: "Stream clients disconnected, by transport and reason (closed, slow, error, shutdown).",
+	}, []string{"transport", "reason"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Time taken by repository operations, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PublishDuration,
+		PublishErrors,
+		ConsumedMessages,
+		HandlerDuration,
+		QueueLatency,
+		Retries,
+		DLQMessages,
+		ReconcilerActions,
+		NotificationDuration,
+		NotificationsDeferred,
+		StreamClients,
+		StreamUpdates,
+		StreamDisconnects,
+		DBQueryDuration,
+	)
+}
+
+// Register mounts /metrics on mux
+func Register(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+}
+
+// ObservePublish records a publish attempt that started at start
+func ObservePublish(broker, topic string, start time.Time, err error) {
+	PublishDuration.WithLabelValues(broker, topic).Observe(time.Since(start).Seconds())
+	if err != nil {
+		PublishErrors.WithLabelValues(broker, topic).Inc()
+	}
+}
+
+// ObserveConsumed records a message received from topic
+func ObserveConsumed(broker, topic, eventType string) {
+	ConsumedMessages.WithLabelValues(broker, topic, eventType).Inc()
+}
+
+// ObserveHandler records a handler run that started at start
+func ObserveHandler(broker, topic, eventType, outcome string, start time.Time) {
+	HandlerDuration.WithLabelValues(broker, topic, eventType, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveQueueLatency records the time an event spent between its creation
+// and its reception. Negative values (clock skew between hosts) count as zero
+func ObserveQueueLatency(broker, topic, eventType string, latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	QueueLatency.WithLabelValues(broker, topic, eventType).Observe(latency.Seconds())
+}
+
+// ObserveRetry records a redelivered message
+func ObserveRetry(broker, topic, eventType string) {
+	Retries.WithLabelValues(broker, topic, eventType).Inc()
+}
+
+// ObserveDLQ records an event sent to the DLQ of topic
+func ObserveDLQ(broker, topic, reason string) {
+	DLQMessages.WithLabelValues(broker, topic, reason).Inc()
+}
+
+// ObserveReconcile records a reconciler action on a stuck message
+func ObserveReconcile(action string, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	}
+	ReconcilerActions.WithLabelValues(action, outcome).Inc()
+}
+
+// ObserveNotification records a notification sent through channel that
+// started at start
+func ObserveNotification(channel string, start time.Time, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	}
+	NotificationDuration.WithLabelValues(channel, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveNotificationDeferred records a notification of channel added to a
+// digest for reason
+func ObserveNotificationDeferred(channel, reason string) {
+	NotificationsDeferred.WithLabelValues(channel, reason).Inc()
+}
+
+// ObserveStreamClient records a stream client connecting through transport,
+// and returns the func recording its disconnection for reason
+func ObserveStreamClient(transport string) func(reason string) {
+	StreamClients.WithLabelValues(transport).Inc()
+	return func(reason string) {
+		StreamClients.WithLabelValues(transport).Dec()
+		StreamDisconnects.WithLabelValues(transport, reason).Inc()
+	}
+}
+
+// ObserveStreamUpdate records an update of updateType sent through transport
+func ObserveStreamUpdate(transport, updateType string) {
+	StreamUpdates.WithLabelValues(transport, updateType).Inc()
+}
+
+// ObserveQuery records a repository operation that started at start.
+// err is a pointer so it can be deferred before the error is known:
+//
+//	defer metrics.ObserveQuery("get_message", time.Now(), &err)
+func ObserveQuery(operation string, start time.Time, err *error) {
+	outcome := OutcomeSuccess
+	if err != nil && *err != nil {
+		outcome = OutcomeError
+	}
+	DBQueryDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,125 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Mode defines how sensitive values are replaced
+type Mode string
+
+const (
+	// ModeOff disables redaction
+	ModeOff Mode = "off"
+	// ModeMask replaces sensitive values with Mask
+	ModeMask Mode = "mask"
+	// ModeHash replaces sensitive values with a keyed hash, so equal values
+	// stay correlatable across services and records without being exposed
+	ModeHash Mode = "hash"
+)
+
+// Built-in patterns
+const (
+	PatternEmail = "email"
+	PatternPhone = "phone"
+	PatternCard  = "card"
+)
+
+// Config holds the redaction rules
+type Config struct {
+	Mode Mode `json:"mode"`
+
+	// HashKey is the HMAC key used by ModeHash. Services that must produce
+	// the same hashes have to share it
+	HashKey string `json:"hash_key"`
+
+	// Fields are key names redacted wherever they appear (case-insensitive)
+	Fields []string `json:"fields"`
+
+	// Paths are dotted locations redacted entirely, such as
+	// "payload.metadata.customer"; "*" matches any single key
+	Paths []string `json:"paths"`
+
+	// Patterns are the built-in patterns searched in every string value
+	// (email, phone, card)
+	Patterns []string `json:"patterns"`
+
+	// Regexes are additional patterns searched in every string value
+	Regexes []string `json:"regexes"`
+}
+
+// DefaultConfig masks common credential and personal data fields and the
+// built-in patterns
+func DefaultConfig() Config {
+	return Config{
+		Mode: ModeMask,
+		Fields: []string{
+			"password", "passwd", "secret", "token", "api_key", "apikey", "authorization",
+			"email", "phone", "phone_number", "cpf", "ssn",
+			"card_number", "credit_card", "cvv",
+		},
+		Patterns: []string{PatternEmail, PatternPhone, PatternCard},
+	}
+}
+
+// ConfigFromEnv starts from DefaultConfig, applies the JSON file named by
+// REDACTION_CONFIG, if any, and then the variables REDACTION_MODE (off,
+// mask or hash), REDACTION_HASH_KEY, REDACTION_FIELDS, REDACTION_PATHS and
+// REDACTION_PATTERNS (comma-separated lists replacing the defaults)
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+
+	if path := os.Getenv("REDACTION_CONFIG"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read REDACTION_CONFIG: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("invalid REDACTION_CONFIG %s: %w", path, err)
+		}
+	}
+
+	if mode := os.Getenv("REDACTION_MODE"); mode != "" {
+		cfg.Mode = Mode(mode)
+	}
+	if key := os.Getenv("REDACTION_HASH_KEY"); key != "" {
+		cfg.HashKey = key
+	}
+	if fields, ok := listEnv("REDACTION_FIELDS"); ok {
+		cfg.Fields = fields
+	}
+	if paths, ok := listEnv("REDACTION_PATHS"); ok {
+		cfg.Paths = paths
+	}
+	if patterns, ok := listEnv("REDACTION_PATTERNS"); ok {
+		cfg.Patterns = patterns
+	}
+
+	return cfg, nil
+}
+
+// FromEnv builds the redactor configured by ConfigFromEnv. It returns nil,
+// which redacts nothing, when the mode is off
+func FromEnv() (*Redactor, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+func listEnv(key string) ([]string, bool) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil, false
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, true
+}
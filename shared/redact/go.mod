@@ -0,0 +1,3 @@
+module queue-microservice-case/shared/redact
+
+go 1.21
@@ -0,0 +1,276 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Mask replaces sensitive values in ModeMask
+const Mask = "[REDACTED]"
+
+var builtinPatterns = map[string]*regexp.Regexp{
+	PatternEmail: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	// Only numbers with a country code or an area code in parentheses, so
+	// dates, IDs and counters are not mistaken for phone numbers
+	PatternPhone: regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?\(\d{2,3}\)\s?\d{4,5}[\s.-]?\d{4}\b|\+\d{1,3}[\s.-]?\d{2,4}[\s.-]?\d{3,5}[\s.-]?\d{4}\b`),
+	// 13 to 19 digits, optionally grouped; matches are Luhn-checked
+	PatternCard: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+}
+
+type pattern struct {
+	re   *regexp.Regexp
+	luhn bool
+}
+
+// Redactor replaces sensitive values according to its rules. A nil
+// *Redactor redacts nothing, so callers need no special case when
+// redaction is disabled
+type Redactor struct {
+	mode     Mode
+	hashKey  []byte
+	fields   map[string]bool
+	paths    [][]string
+	patterns []pattern
+}
+
+// New compiles cfg. It returns nil when the mode is off
+func New(cfg Config) (*Redactor, error) {
+	switch cfg.Mode {
+	case ModeOff:
+		return nil, nil
+	case ModeMask, "":
+		cfg.Mode = ModeMask
+	case ModeHash:
+		if cfg.HashKey == "" {
+			return nil, errors.New("redaction hash mode requires a hash key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported redaction mode %q (supported: off, mask, hash)", cfg.Mode)
+	}
+
+	r := &Redactor{
+		mode:    cfg.Mode,
+		hashKey: []byte(cfg.HashKey),
+		fields:  make(map[string]bool, len(cfg.Fields)),
+	}
+	for _, field := range cfg.Fields {
+		r.fields[strings.ToLower(field)] = true
+	}
+	for _, path := range cfg.Paths {
+		r.paths = append(r.paths, strings.Split(path, "."))
+	}
+	for _, name := range cfg.Patterns {
+		re, ok := builtinPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction pattern %q (supported: email, phone, card)", name)
+		}
+		r.patterns = append(r.patterns, pattern{re: re, luhn: name == PatternCard})
+	}
+	for _, expr := range cfg.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction regex %q: %w", expr, err)
+		}
+		r.patterns = append(r.patterns, pattern{re: re})
+	}
+
+	return r, nil
+}
+
+// String replaces the pattern matches found in s
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, p := range r.patterns {
+		s = p.re.ReplaceAllStringFunc(s, func(match string) string {
+			if p.luhn && !luhnValid(match) {
+				return match
+			}
+			return r.replace(match)
+		})
+	}
+	return s
+}
+
+// Value returns a redacted copy of value, whose dotted location is path
+// (the key it is logged or stored under, "" for a root document). Maps and
+// slices are walked; other composite values are walked as their JSON form
+func (r *Redactor) Value(path string, value interface{}) interface{} {
+	if r == nil {
+		return value
+	}
+	return r.value(path, value)
+}
+
+// Map returns a copy of m, whose dotted location is path, with its
+// entries redacted
+func (r *Redactor) Map(path string, m map[string]interface{}) map[string]interface{} {
+	if r == nil || m == nil {
+		return m
+	}
+	out := make(map[string]interface{}, len(m))
+	for key, item := range m {
+		out[key] = r.value(joinPath(path, key), item)
+	}
+	return out
+}
+
+// Payload returns a redacted copy of an event payload. Paths are relative
+// to the event, as in "payload.metadata.email"
+func (r *Redactor) Payload(payload map[string]interface{}) map[string]interface{} {
+	return r.Map("payload", payload)
+}
+
+// Sensitive reports whether the value at path is redacted as a whole
+func (r *Redactor) Sensitive(path string) bool {
+	if r == nil {
+		return false
+	}
+	segments := strings.Split(path, ".")
+	if r.fields[strings.ToLower(segments[len(segments)-1])] {
+		return true
+	}
+	for _, rule := range r.paths {
+		if matchPath(rule, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace returns the replacement of a sensitive value: Mask, or its keyed
+// hash in ModeHash
+func (r *Redactor) Replace(value interface{}) string {
+	if r == nil {
+		return fmt.Sprint(value)
+	}
+	return r.replace(value)
+}
+
+func (r *Redactor) value(path string, value interface{}) interface{} {
+	if path != "" && r.Sensitive(path) {
+		return r.replace(value)
+	}
+
+	switch v := value.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return r.String(v)
+	case json.Number:
+		if redacted := r.String(v.String()); redacted != v.String() {
+			return redacted
+		}
+		return v
+	case error:
+		return r.String(v.Error())
+	case map[string]interface{}:
+		return r.Map(path, v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.value(path, item)
+		}
+		return out
+	case []string:
+		out := make([]string, len(v))
+		for i, item := range v {
+			out[i] = r.String(item)
+		}
+		return out
+	case fmt.Stringer:
+		return r.String(v.String())
+	}
+
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		generic, err := toGeneric(value)
+		if err != nil {
+			return r.replace(value) // cannot be inspected: hide it
+		}
+		return r.value(path, generic)
+	}
+	return value
+}
+
+func (r *Redactor) replace(value interface{}) string {
+	if r.mode != ModeHash {
+		return Mask
+	}
+	var data []byte
+	if s, ok := value.(string); ok {
+		data = []byte(s)
+	} else if encoded, err := json.Marshal(value); err == nil {
+		data = encoded
+	} else {
+		data = []byte(fmt.Sprint(value))
+	}
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write(data)
+	return "hash:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// toGeneric converts value to maps, slices and scalars through JSON
+func toGeneric(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func matchPath(rule, segments []string) bool {
+	if len(rule) != len(segments) {
+		return false
+	}
+	for i, segment := range rule {
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum used by
+// payment card numbers
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
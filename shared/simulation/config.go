@@ -0,0 +1,156 @@
+package simulation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Distribution is the shape of the simulated latency
+type Distribution string
+
+const (
+	// Constant always waits Value
+	Constant Distribution = "constant"
+	// Uniform waits between Min and Max
+	Uniform Distribution = "uniform"
+	// Normal waits around Mean with StdDev (never less than zero)
+	Normal Distribution = "normal"
+	// LongTail is log-normal: most waits are close to Median, a few reach
+	// P99 and beyond
+	LongTail Distribution = "long_tail"
+)
+
+// Duration is a time.Duration written as a string ("150ms") in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"150ms\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Latency is the simulated latency of one unit of work. Only the fields of
+// its distribution are used
+type Latency struct {
+	Distribution Distribution `json:"distribution"`
+	Value        Duration     `json:"value,omitempty"`
+	Min          Duration     `json:"min,omitempty"`
+	Max          Duration     `json:"max,omitempty"`
+	Mean         Duration     `json:"mean,omitempty"`
+	StdDev       Duration     `json:"stddev,omitempty"`
+	Median       Duration     `json:"median,omitempty"`
+	P99          Duration     `json:"p99,omitempty"`
+}
+
+// Profile describes the workload simulated by a service for each message
+type Profile struct {
+	Latency Latency `json:"latency"`
+
+	// TransientFailureRate and PermanentFailureRate are the fractions
+	// (0 to 1) of runs failing with ErrTransientFailure and
+	// ErrPermanentFailure
+	TransientFailureRate float64 `json:"transient_failure_rate,omitempty"`
+	PermanentFailureRate float64 `json:"permanent_failure_rate,omitempty"`
+
+	// CPUIterations is the number of SHA-256 rounds computed per run, to
+	// simulate CPU-bound work
+	CPUIterations int `json:"cpu_iterations,omitempty"`
+
+	// Seed makes the random draws reproducible; zero seeds from the clock
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// ConstantProfile waits latency on every run, without failures
+func ConstantProfile(latency time.Duration) Profile {
+	return Profile{Latency: Latency{Distribution: Constant, Value: Duration(latency)}}
+}
+
+// Validate checks the parameters of the profile
+func (p Profile) Validate() error {
+	l := p.Latency
+	switch l.Distribution {
+	case Constant:
+		if l.Value < 0 {
+			return fmt.Errorf("constant latency requires value >= 0")
+		}
+	case Uniform:
+		if l.Min < 0 || l.Max < l.Min {
+			return fmt.Errorf("uniform latency requires 0 <= min <= max")
+		}
+	case Normal:
+		if l.Mean < 0 || l.StdDev < 0 {
+			return fmt.Errorf("normal latency requires mean >= 0 and stddev >= 0")
+		}
+	case LongTail:
+		if l.Median <= 0 || l.P99 < l.Median {
+			return fmt.Errorf("long_tail latency requires 0 < median <= p99")
+		}
+	default:
+		return fmt.Errorf("unsupported latency distribution %q (supported: constant, uniform, normal, long_tail)", l.Distribution)
+	}
+
+	if p.TransientFailureRate < 0 || p.PermanentFailureRate < 0 || p.TransientFailureRate+p.PermanentFailureRate > 1 {
+		return fmt.Errorf("failure rates must be >= 0 and add up to at most 1")
+	}
+	if p.CPUIterations < 0 {
+		return fmt.Errorf("cpu_iterations must be >= 0")
+	}
+	return nil
+}
+
+// ProfileFromEnv returns the profile of serviceName. SIMULATION_PROFILE
+// holds a profile as inline JSON; otherwise SIMULATION_PROFILE_FILE names a
+// JSON file mapping service names to profiles, where the "default" entry
+// applies to services not listed. Without either, defaultProfile is used.
+// SIMULATION_SEED overrides the seed of the resulting profile
+func ProfileFromEnv(serviceName string, defaultProfile Profile) (Profile, error) {
+	profile := defaultProfile
+
+	if inline := os.Getenv("SIMULATION_PROFILE"); inline != "" {
+		profile = Profile{}
+		if err := json.Unmarshal([]byte(inline), &profile); err != nil {
+			return Profile{}, fmt.Errorf("invalid SIMULATION_PROFILE: %w", err)
+		}
+	} else if path := os.Getenv("SIMULATION_PROFILE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Profile{}, fmt.Errorf("failed to read SIMULATION_PROFILE_FILE: %w", err)
+		}
+		var profiles map[string]Profile
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return Profile{}, fmt.Errorf("invalid SIMULATION_PROFILE_FILE %s: %w", path, err)
+		}
+		if p, ok := profiles[serviceName]; ok {
+			profile = p
+		} else if p, ok := profiles["default"]; ok {
+			profile = p
+		}
+	}
+
+	if seed := os.Getenv("SIMULATION_SEED"); seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return Profile{}, fmt.Errorf("invalid SIMULATION_SEED: %q", seed)
+		}
+		profile.Seed = value
+	}
+
+	if err := profile.Validate(); err != nil {
+		return Profile{}, fmt.Errorf("invalid simulation profile for %s: %w", serviceName, err)
+	}
+	return profile, nil
+}
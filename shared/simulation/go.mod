@@ -0,0 +1,3 @@
+module queue-microservice-case/shared/simulation
+
+go 1.21
@@ -0,0 +1,115 @@
+package simulation
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTransientFailure = errors.New("simulated transient failure")
+	ErrPermanentFailure = errors.New("simulated permanent failure")
+)
+
+// z99 is the 99th percentile of the standard normal distribution
+const z99 = 2.3263478740408408
+
+// Simulator runs the workload of a profile
+type Simulator struct {
+	profile Profile
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New creates a simulator for profile
+func New(profile Profile) (*Simulator, error) {
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	seed := profile.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Simulator{profile: profile, rng: rand.New(rand.NewSource(seed))}, nil
+}
+
+// Profile returns the simulated profile
+func (s *Simulator) Profile() Profile {
+	return s.profile
+}
+
+// Run simulates one unit of work: it computes the CPU-bound work, waits a
+// latency drawn from the distribution and then fails at the configured
+// rates. It returns ctx.Err() if ctx is done while waiting
+func (s *Simulator) Run(ctx context.Context) error {
+	latency, failure := s.draw()
+
+	burnCPU(s.profile.CPUIterations)
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return failure
+}
+
+// draw picks the latency and the outcome of a run
+func (s *Simulator) draw() (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latency := s.latency()
+
+	var failure error
+	roll := s.rng.Float64()
+	switch {
+	case roll < s.profile.PermanentFailureRate:
+		failure = ErrPermanentFailure
+	case roll < s.profile.PermanentFailureRate+s.profile.TransientFailureRate:
+		failure = ErrTransientFailure
+	}
+	return latency, failure
+}
+
+func (s *Simulator) latency() time.Duration {
+	l := s.profile.Latency
+	switch l.Distribution {
+	case Uniform:
+		return time.Duration(l.Min) + time.Duration(s.rng.Int63n(int64(l.Max-l.Min)+1))
+	case Normal:
+		return clamp(float64(l.Mean) + s.rng.NormFloat64()*float64(l.StdDev))
+	case LongTail:
+		// Log-normal with the given median and 99th percentile
+		sigma := math.Log(float64(l.P99)/float64(l.Median)) / z99
+		return clamp(float64(l.Median) * math.Exp(s.rng.NormFloat64()*sigma))
+	default:
+		return time.Duration(l.Value)
+	}
+}
+
+func clamp(nanos float64) time.Duration {
+	if nanos < 0 {
+		return 0
+	}
+	if nanos > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(nanos)
+}
+
+// burnCPU computes iterations chained SHA-256 rounds
+func burnCPU(iterations int) {
+	var sum [sha256.Size]byte
+	for i := 0; i < iterations; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+}
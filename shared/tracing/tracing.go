@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Supported span exporters
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Config selects where spans are exported
+type Config struct {
+	ServiceName string
+	Exporter    string
+	File        string // used by ExporterFile
+}
+
+// ConfigFromEnv reads OTEL_TRACES_EXPORTER (none, otlp, stdout or file;
+// defaults to none), OTEL_TRACES_FILE (defaults to traces.json) and
+// OTEL_SERVICE_NAME (defaults to serviceName). The OTLP exporter reads the
+// standard OTEL_EXPORTER_OTLP_* variables (endpoint, headers, insecure...)
+func ConfigFromEnv(serviceName string) Config {
+	exporter := getEnv("OTEL_TRACES_EXPORTER", ExporterNone)
+	if exporter == "console" { // name used by the OpenTelemetry spec
+		exporter = ExporterStdout
+	}
+	return Config{
+		ServiceName: getEnv("OTEL_SERVICE_NAME", serviceName),
+		Exporter:    exporter,
+		File:        getEnv("OTEL_TRACES_FILE", "traces.json"),
+	}
+}
+
+// Setup installs the global tracer provider and the W3C trace context and
+// baggage propagators. Propagators are installed even when exporting is
+// disabled, so incoming trace context still flows to outgoing events. The
+// returned function flushes pending spans and must be called on shutdown
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New()
+	case ExporterFile:
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open traces file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter: %s (supported: none, otlp, stdout, file)", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s span exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
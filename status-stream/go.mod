@@ -0,0 +1,25 @@
+module queue-microservice-case/status-stream
+
+go 1.21
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	queue-microservice-case/shared/claimcheck v0.0.0
+	queue-microservice-case/shared/contracts v0.0.0
+	queue-microservice-case/shared/database v0.0.0
+	queue-microservice-case/shared/health v0.0.0
+	queue-microservice-case/shared/logger v0.0.0
+	queue-microservice-case/shared/messaging v0.0.0
+	queue-microservice-case/shared/metrics v0.0.0
+	queue-microservice-case/shared/tracing v0.0.0
+)
+
+replace queue-microservice-case/shared/claimcheck => ../shared/claimcheck
+replace queue-microservice-case/shared/contracts => ../shared/contracts
+replace queue-microservice-case/shared/database => ../shared/database
+replace queue-microservice-case/shared/health => ../shared/health
+replace queue-microservice-case/shared/logger => ../shared/logger
+replace queue-microservice-case/shared/messaging => ../shared/messaging
+replace queue-microservice-case/shared/metrics => ../shared/metrics
+replace queue-microservice-case/shared/redact => ../shared/redact
+replace queue-microservice-case/shared/tracing => ../shared/tracing
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/messaging"
+)
+
+// Reasons a stream ends, recorded in stream_disconnects_total
+const (
+	disconnectClosed   = "closed"
+	disconnectSlow     = "slow"
+	disconnectError    = "error"
+	disconnectShutdown = "shutdown"
+)
+
+var (
+	errTooManyClients = errors.New("too many stream clients")
+	errHubClosed      = errors.New("status stream is shutting down")
+)
+
+// Filter selects the messages a client follows: one message, every message
+// of a correlation ID, or both (one message, checked against its
+// correlation ID)
+type Filter struct {
+	IdempotencyID string
+	CorrelationID string
+}
+
+func (f Filter) matches(event *contracts.Event) bool {
+	if f.IdempotencyID != "" && event.IdempotencyID != f.IdempotencyID {
+		return false
+	}
+	if f.CorrelationID != "" && event.CorrelationID != f.CorrelationID {
+		return false
+	}
+	return true
+}
+
+// client is a stream registered in the hub. events receives the status
+// events matching its filter; gone is closed if the hub drops the client,
+// with the reason in reason
+type client struct {
+	filter Filter
+	events chan *contracts.Event
+	gone   chan struct{}
+	reason string
+}
+
+// Hub fans the status and stage events received from the broker out
+// to the streams whose filter they match. A client that does not keep up
+// is dropped rather than slowing down the others: it reconnects and resumes
+// from message_history with Last-Event-ID
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closed  bool
+
+	// buffer is the number of events a client may lag behind
+	buffer     int
+	maxClients int
+}
+
+// NewHub creates a hub letting each client lag buffer events behind, with
+// at most maxClients clients (0 for no limit)
+func NewHub(buffer, maxClients int) *Hub {
+	return &Hub{
+		clients:    make(map[*client]struct{}),
+		buffer:     buffer,
+		maxClients: maxClients,
+	}
+}
+
+// subscribe registers a client following filter
+func (h *Hub) subscribe(filter Filter) (*client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, errHubClosed
+	}
+	if h.maxClients > 0 && len(h.clients) >= h.maxClients {
+		return nil, errTooManyClients
+	}
+	c := &client{
+		filter: filter,
+		events: make(chan *contracts.Event, h.buffer),
+		gone:   make(chan struct{}),
+	}
+	h.clients[c] = struct{}{}
+	return c, nil
+}
+
+// unsubscribe removes a client once its stream ended
+func (h *Hub) unsubscribe(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// drop removes a client and tells its stream why. h.mu must be held
+func (h *Hub) drop(c *client, reason string) {
+	delete(h.clients, c)
+	c.reason = reason
+	close(c.gone)
+}
+
+// Publish hands event to the clients following its message, without
+// blocking: clients whose buffer is full are dropped
+func (h *Hub) Publish(event *contracts.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if !c.filter.matches(event) {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			h.drop(c, disconnectSlow)
+		}
+	}
+}
+
+// Clients returns the number of connected clients
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Close drops every client, so their streams end and they reconnect to
+// another replica, and refuses new ones
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for c := range h.clients {
+		h.drop(c, disconnectShutdown)
+	}
+}
+
+// Handler is the broker handler feeding the hub
+func (h *Hub) Handler() messaging.MessageHandler {
+	return func(ctx context.Context, event *contracts.Event) error {
+		switch event.EventType {
+		case contracts.EventTypeMessageStatusUpdated, contracts.EventTypeMessageStageUpdated:
+			h.Publish(event)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"queue-microservice-case/shared/claimcheck"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/health"
+	"queue-microservice-case/shared/logger"
+	"queue-microservice-case/shared/messaging"
+	"queue-microservice-case/shared/metrics"
+	"queue-microservice-case/shared/tracing"
+)
+
+const (
+	serviceName = "status-stream"
+	topicIn     = "message.status.updated"
+)
+
+func main() {
+	// Initialize logger; std log output goes through it too
+	appLogger, err := logger.NewLogger(serviceName)
+	if err != nil {
+		log.Fatalf("Failed to configure logger: %v", err)
+	}
+	appLogger.SetDefault()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Get database connection string
+	dbConnStr := getDatabaseConnectionString()
+	repo, err := database.NewRepository(dbConnStr,
+		database.WithQueryTimeout(getDurationEnv("DB_QUERY_TIMEOUT", database.DefaultQueryTimeout)))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to connect to database", err)
+	}
+	defer repo.Close()
+
+	// "migrate" subcommand: manage the schema and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.RunMigrateCommand(ctx, repo, os.Args[2:], os.Stdout); err != nil {
+			appLogger.Fatal(ctx, "Migration failed", err)
+		}
+		return
+	}
+
+	// Apply pending migrations; replicas serialize on an advisory lock
+	if getBoolEnv("DB_MIGRATE_ON_STARTUP", true) {
+		applied, err := repo.Migrate(ctx)
+		if err != nil {
+			appLogger.Fatal(ctx, "Failed to apply database migrations", err)
+		}
+		for _, migration := range applied {
+			appLogger.Info(ctx, "Applied database migration", "version", migration.Version, "name", migration.Name)
+		}
+	}
+
+	// Export spans and propagate W3C trace context through the broker
+	shutdownTracing, err := tracing.Setup(ctx, tracing.ConfigFromEnv(serviceName))
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to set up tracing", err)
+	}
+
+	// Load event signing keys and per-topic verification policy
+	signingKeys, err := messaging.KeyRingFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signing keys", err)
+	}
+	signaturePolicy, err := messaging.SignaturePolicyFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load event signature policy", err)
+	}
+
+	// Claim check store, to rehydrate offloaded payloads
+	claimCheckConfig, err := claimcheck.ConfigFromEnv()
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to load claim check configuration", err)
+	}
+	claimCheckStore, err := claimcheck.Open(claimCheckConfig, dbConnStr)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to open claim check store", err)
+	}
+
+	// Initialize message broker. Every replica receives every status event,
+	// since its clients may follow any message
+	consumerName := getEnv("STREAM_CONSUMER_NAME", defaultConsumerName())
+	broker, err := messaging.NewMessageBroker(
+		messaging.WithKeyRing(signingKeys),
+		messaging.WithClaimCheck(claimCheckStore, claimCheckConfig.Threshold, claimCheckConfig.TTL),
+		messaging.WithBroadcast(consumerName),
+	)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to initialize message broker", err)
+	}
+	defer broker.Close()
+
+	hub := NewHub(int(getIntEnv("STREAM_CLIENT_BUFFER", 64)), int(getIntEnv("STREAM_MAX_CLIENTS", 10000)))
+	streamer := &Streamer{
+		store:        repo,
+		hub:          hub,
+		logger:       appLogger,
+		origins:      parseOrigins(os.Getenv("STREAM_ALLOWED_ORIGINS")),
+		heartbeat:    getDurationEnv("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
+		writeTimeout: getDurationEnv("STREAM_WRITE_TIMEOUT", 10*time.Second),
+		retry:        getDurationEnv("STREAM_RETRY", 3*time.Second),
+		lookback:     getDurationEnv("STREAM_HISTORY_LOOKBACK", time.Minute),
+	}
+
+	// Subscribe to message.status.updated events
+	handler := messaging.Chain(
+		hub.Handler(),
+		messaging.VerifySignatures(signingKeys, signaturePolicy, broker),
+	)
+
+	subscription, err := broker.Subscribe(ctx, topicIn, handler)
+	if err != nil {
+		appLogger.Fatal(ctx, "Failed to subscribe to topic", err)
+	}
+
+	// Expose liveness and readiness probes
+	healthChecks := health.New()
+	healthChecks.AddLivenessCheck(health.Heartbeat("consumer", subscription, getDurationEnv("HEALTH_MAX_HANDLER_DURATION", 2*time.Minute)))
+	healthChecks.AddReadinessCheck(health.Ping("database", repo))
+	healthChecks.AddReadinessCheck(health.Ping("broker", broker))
+	healthChecks.AddReadinessCheck(health.ConsumerLag("consumer_lag", subscription, getIntEnv("HEALTH_MAX_CONSUMER_LAG", 0)))
+
+	mux := http.NewServeMux()
+	healthChecks.Register(mux)
+	metrics.Register(mux)
+	mux.HandleFunc("/stream", streamer.ServeSSE)
+	mux.HandleFunc("/ws", streamer.ServeWebSocket)
+	// No write timeout: streams stay open, each write has its own deadline
+	httpServer := &http.Server{
+		Addr:              getEnv("HTTP_ADDR", ":8080"),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			appLogger.Error(ctx, "HTTP server failed", err)
+		}
+	}()
+
+	appLogger.Info(ctx, "Status stream started", "topic_in", topicIn, "consumer", consumerName)
+
+	// Wait for interrupt signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigChan:
+	case <-subscription.Done():
+		appLogger.Warn(ctx, "Subscription stopped unexpectedly", "topic", subscription.Topic())
+	}
+
+	appLogger.Info(ctx, "Shutting down status stream", "clients", hub.Clients())
+
+	// End the streams so clients resume on another replica with
+	// Last-Event-ID, then stop consuming before the deferred Close calls
+	// tear down the broker and database connections. The 25s default leaves
+	// room within the 30s Kubernetes termination grace period
+	healthChecks.MarkShuttingDown()
+	hub.Close()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), getDurationEnv("SHUTDOWN_TIMEOUT", 25*time.Second))
+	defer cancelShutdown()
+	httpServer.Shutdown(shutdownCtx)
+	if err := broker.Shutdown(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Broker did not drain before the shutdown deadline", "error", err.Error())
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		appLogger.Warn(ctx, "Failed to flush pending spans", "error", err.Error())
+	}
+}
+
+// defaultConsumerName names the broadcast consumer of this replica after
+// its host, the pod name in Kubernetes
+func defaultConsumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return serviceName + "-" + hostname
+}
+
+func getDatabaseConnectionString() string {
+	host := getEnv("DB_HOST", "localhost")
+	port := getEnv("DB_PORT", "5432")
+	user := getEnv("DB_USER", "postgres")
+	password := getEnv("DB_PASSWORD", "postgres")
+	dbname := getEnv("DB_NAME", "queue_case")
+
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getDurationEnv reads a duration such as "30s"
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func getIntEnv(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"queue-microservice-case/shared/metrics"
+)
+
+const transportSSE = "sse"
+
+// sseSender writes updates as Server-Sent Events. Status updates carry
+// the highest history ID sent, which the browser sends back in
+// Last-Event-ID when it reconnects, so an entry that committed late does
+// not move it back; stage updates have none, so they leave it unchanged
+type sseSender struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	lastID       int
+}
+
+func (s *sseSender) write(format string, args ...interface{}) error {
+	if err := s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	if err := s.rc.Flush(); err != nil {
+		return fmt.Errorf("failed to flush event: %w", err)
+	}
+	return nil
+}
+
+func (s *sseSender) Send(update StatusUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal update: %w", err)
+	}
+	if update.ID > s.lastID {
+		s.lastID = update.ID
+	}
+	if update.ID > 0 {
+		err = s.write("id: %d\nevent: %s\ndata: %s\n\n", s.lastID, update.Type, data)
+	} else {
+		err = s.write("event: %s\ndata: %s\n\n", update.Type, data)
+	}
+	if err == nil {
+		metrics.ObserveStreamUpdate(transportSSE, update.Type)
+	}
+	return err
+}
+
+// Heartbeat writes a comment, ignored by clients
+func (s *sseSender) Heartbeat() error {
+	return s.write(": heartbeat\n\n")
+}
+
+// ServeSSE streams the status updates of the messages selected by the
+// query as Server-Sent Events
+func (s *Streamer) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.origins.check(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	req, err := parseStreamRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, ok := s.subscribe(w, req)
+	if !ok {
+		return
+	}
+	defer s.hub.unsubscribe(c)
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx ingress: do not buffer
+	w.WriteHeader(http.StatusOK)
+
+	out := &sseSender{w: w, rc: http.NewResponseController(w), writeTimeout: s.writeTimeout, lastID: req.lastID}
+	disconnected := metrics.ObserveStreamClient(transportSSE)
+	reason, err := disconnectError, out.write("retry: %d\n\n", s.retry.Milliseconds())
+	if err == nil {
+		reason, err = s.run(r.Context(), c, req, out)
+	}
+	disconnected(reason)
+	if err != nil {
+		s.logger.Warn(r.Context(), "Status stream failed", "transport", transportSSE, "error", err.Error(),
+			"idempotency_id", req.filter.IdempotencyID, "correlation_id", req.filter.CorrelationID)
+	}
+}
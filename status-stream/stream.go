@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"queue-microservice-case/shared/contracts"
+	"queue-microservice-case/shared/database"
+	"queue-microservice-case/shared/logger"
+)
+
+// Update types, also the SSE event names
+const (
+	// updateStatus is a status change recorded in message_history, whose ID
+	// is the position to resume from
+	updateStatus = "status"
+	// updateStage is a processing stage of a message (see
+	// message-processor/pipeline.go). Stages are not recorded, so they have
+	// no ID and are not replayed on resume
+	updateStage = "stage"
+)
+
+// StatusUpdate is the update sent to clients, as the data of an SSE event
+// or a WebSocket text message
+type StatusUpdate struct {
+	Type          string    `json:"type"`
+	ID            int       `json:"id,omitempty"`
+	IdempotencyID string    `json:"idempotency_id"`
+	CorrelationID string    `json:"correlation_id"`
+	Status        string    `json:"status"`
+	FromStatus    *string   `json:"from_status,omitempty"`
+	Stage         string    `json:"stage,omitempty"`
+	ServiceName   string    `json:"service_name,omitempty"`
+	ErrorMessage  *string   `json:"error_message,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+func historyUpdate(h *database.MessageHistory) StatusUpdate {
+	return StatusUpdate{
+		Type:          updateStatus,
+		ID:            h.ID,
+		IdempotencyID: h.IdempotencyID,
+		CorrelationID: h.CorrelationID,
+		Status:        h.Status,
+		FromStatus:    h.FromStatus,
+		ServiceName:   h.ServiceName,
+		ErrorMessage:  h.ErrorMessage,
+		Timestamp:     h.CreatedAt,
+	}
+}
+
+// stageUpdate returns the stage update of event, if it reports a processing
+// stage rather than a status change
+func stageUpdate(event *contracts.Event) (StatusUpdate, bool) {
+	if event.EventType != contracts.EventTypeMessageStageUpdated {
+		return StatusUpdate{}, false
+	}
+	stage, _ := event.Payload["stage"].(string)
+	timestamp, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil {
+		timestamp = time.Now().UTC()
+	}
+	return StatusUpdate{
+		Type:          updateStage,
+		IdempotencyID: event.IdempotencyID,
+		CorrelationID: event.CorrelationID,
+		Status:        database.StatusProcessing,
+		Stage:         stage,
+		ServiceName:   event.SourceService,
+		Timestamp:     timestamp,
+	}, true
+}
+
+// sender writes the updates of one stream to its client
+type sender interface {
+	Send(update StatusUpdate) error
+	// Heartbeat keeps the connection (and the proxies on the way) alive
+	Heartbeat() error
+}
+
+// Streamer runs the streams of the SSE and WebSocket endpoints
+type Streamer struct {
+	store     database.MessageStore
+	hub       *Hub
+	logger    *logger.Logger
+	origins   origins
+	heartbeat time.Duration
+	// writeTimeout bounds each write to a client
+	writeTimeout time.Duration
+	// retry is the reconnection delay advertised to SSE clients
+	retry time.Duration
+	// lookback is how long after its creation a history entry may still
+	// commit, behind entries with higher IDs already sent
+	lookback time.Duration
+}
+
+// streamRequest is a stream asked for by a client: what it follows and the
+// ID of the last status update it received, 0 for the whole history
+type streamRequest struct {
+	filter Filter
+	lastID int
+}
+
+// parseStreamRequest reads the idempotency_id and correlation_id query
+// parameters and the Last-Event-ID header, or the last_event_id query
+// parameter for clients that cannot set headers
+func parseStreamRequest(r *http.Request) (*streamRequest, error) {
+	query := r.URL.Query()
+	req := &streamRequest{
+		filter: Filter{
+			IdempotencyID: strings.TrimSpace(query.Get("idempotency_id")),
+			CorrelationID: strings.TrimSpace(query.Get("correlation_id")),
+		},
+	}
+	if req.filter.IdempotencyID == "" && req.filter.CorrelationID == "" {
+		return nil, errors.New("idempotency_id or correlation_id is required")
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.Atoi(lastEventID)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid Last-Event-ID %q", lastEventID)
+		}
+		req.lastID = id
+	}
+	return req, nil
+}
+
+// run sends the status changes recorded after req.lastID, then the live
+// updates, until ctx is done or the hub drops the client. It returns the
+// reason the stream ended. The client is registered before the history is
+// read, so no update falls between the two; live status events only signal
+// that message_history has new entries, so every status update carries the
+// ID of its entry and none is sent twice in a stream. On resume the entries
+// of the last lookback are sent again, since the client may have missed
+// the ones that committed late: clients drop the IDs they already have
+func (s *Streamer) run(ctx context.Context, c *client, req *streamRequest, out sender) (string, error) {
+	lastID := req.lastID
+	sent := make(map[int]time.Time)
+	if err := s.catchUp(ctx, req.filter, &lastID, sent, out); err != nil {
+		return disconnectError, err
+	}
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-c.events:
+			if update, ok := stageUpdate(event); ok {
+				if err := out.Send(update); err != nil {
+					return disconnectError, err
+				}
+				continue
+			}
+			if err := s.catchUp(ctx, req.filter, &lastID, sent, out); err != nil {
+				return disconnectError, err
+			}
+
+		case <-heartbeat.C:
+			if err := out.Heartbeat(); err != nil {
+				return disconnectError, err
+			}
+
+		case <-c.gone:
+			return c.reason, nil
+
+		case <-ctx.Done():
+			return disconnectClosed, nil
+		}
+	}
+}
+
+// catchUp sends the status changes recorded after *lastID, advancing it to
+// the highest ID sent. History IDs are taken on insert, not on commit, so
+// it then reads again the entries created within the lookback and sends
+// those that committed behind higher IDs. sent holds the IDs sent in the
+// last lookback, when they were sent
+func (s *Streamer) catchUp(ctx context.Context, filter Filter, lastID *int, sent map[int]time.Time, out sender) error {
+	query := database.HistoryQuery{
+		IdempotencyID: filter.IdempotencyID,
+		CorrelationID: filter.CorrelationID,
+		AfterID:       *lastID,
+	}
+	if err := s.sendHistory(ctx, query, lastID, sent, out); err != nil {
+		return err
+	}
+
+	query.AfterID, query.CreatedWithin = 0, s.lookback
+	if err := s.sendHistory(ctx, query, lastID, sent, out); err != nil {
+		return err
+	}
+
+	// Twice the lookback, leaving room for skew with the database clock
+	forget := time.Now().Add(-2 * s.lookback)
+	for id, sentAt := range sent {
+		if sentAt.Before(forget) {
+			delete(sent, id)
+		}
+	}
+	return nil
+}
+
+// sendHistory sends the entries matching query that are not in sent, page
+// by page
+func (s *Streamer) sendHistory(ctx context.Context, query database.HistoryQuery, lastID *int, sent map[int]time.Time, out sender) error {
+	query.Limit = database.DefaultHistoryPageSize
+	for {
+		history, err := s.store.ListHistoryAfter(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to read message history: %w", err)
+		}
+		for i := range history {
+			h := &history[i]
+			query.AfterID = h.ID
+			if _, ok := sent[h.ID]; ok {
+				continue
+			}
+			if err := out.Send(historyUpdate(h)); err != nil {
+				return err
+			}
+			sent[h.ID] = time.Now()
+			if h.ID > *lastID {
+				*lastID = h.ID
+			}
+		}
+		if len(history) < query.Limit {
+			return nil
+		}
+	}
+}
+
+// subscribe registers the client of req, answering the request with an
+// error if the hub refuses it
+func (s *Streamer) subscribe(w http.ResponseWriter, req *streamRequest) (*client, bool) {
+	c, err := s.hub.subscribe(req.filter)
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.retry.Seconds())))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return c, true
+}
+
+// origins are the origins allowed to open streams from a browser, from
+// STREAM_ALLOWED_ORIGINS: a comma-separated list, or * for any. Without it
+// only same-origin pages can
+type origins struct {
+	any     bool
+	allowed map[string]bool
+}
+
+func parseOrigins(value string) origins {
+	o := origins{allowed: make(map[string]bool)}
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+		case "*":
+			o.any = true
+		default:
+			o.allowed[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	return o
+}
+
+// check reports whether r may open a stream: requests without an Origin
+// header (not from a browser) and same-origin ones always may
+func (o origins) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || o.any || o.allowed[origin] {
+		return true
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"queue-microservice-case/shared/metrics"
+)
+
+const transportWebSocket = "websocket"
+
+// wsMaxMessageSize bounds the messages read from clients, which have
+// nothing to send but control frames
+const wsMaxMessageSize = 512
+
+// wsSender writes updates as JSON text messages and heartbeats as pings
+type wsSender struct {
+	conn         *websocket.Conn
+	writeTimeout time.Duration
+}
+
+func (s *wsSender) Send(update StatusUpdate) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	if err := s.conn.WriteJSON(update); err != nil {
+		return fmt.Errorf("failed to write update: %w", err)
+	}
+	metrics.ObserveStreamUpdate(transportWebSocket, update.Type)
+	return nil
+}
+
+func (s *wsSender) Heartbeat() error {
+	if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.writeTimeout)); err != nil {
+		return fmt.Errorf("failed to write ping: %w", err)
+	}
+	return nil
+}
+
+// close tells the client why the stream ended: going away on shutdown, try
+// again later when it was too slow, so it reconnects with last_event_id
+func (s *wsSender) close(reason string) {
+	code, text := websocket.CloseNormalClosure, ""
+	switch reason {
+	case disconnectShutdown:
+		code, text = websocket.CloseGoingAway, "server shutting down"
+	case disconnectSlow:
+		code, text = websocket.CloseTryAgainLater, "client too slow"
+	case disconnectError:
+		code, text = websocket.CloseInternalServerErr, "stream failed"
+	}
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(s.writeTimeout))
+}
+
+// ServeWebSocket streams the status updates of the messages selected by the
+// query over a WebSocket. Since browsers cannot set headers on WebSocket
+// requests, clients resume with the last_event_id query parameter, the
+// highest id of the status updates they received
+func (s *Streamer) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	req, err := parseStreamRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, ok := s.subscribe(w, req)
+	if !ok {
+		return
+	}
+	defer s.hub.unsubscribe(c)
+
+	upgrader := websocket.Upgrader{CheckOrigin: s.origins.check}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade answered the request with the error
+	}
+	defer conn.Close()
+
+	// Read the control frames: pongs keep the connection alive and a close
+	// frame, or a missing pong, ends the stream
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * s.heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * s.heartbeat))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	out := &wsSender{conn: conn, writeTimeout: s.writeTimeout}
+	disconnected := metrics.ObserveStreamClient(transportWebSocket)
+	reason, err := s.run(ctx, c, req, out)
+	disconnected(reason)
+	out.close(reason)
+	if err != nil {
+		s.logger.Warn(r.Context(), "Status stream failed", "transport", transportWebSocket, "error", err.Error(),
+			"idempotency_id", req.filter.IdempotencyID, "correlation_id", req.filter.CorrelationID)
+	}
+}